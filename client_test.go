@@ -1,16 +1,31 @@
 package ftp
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"net"
+	"net/textproto"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/charmap"
 )
 
 const (
@@ -154,8 +169,10 @@ func testConn(t *testing.T, disableEPSV bool) {
 	err = c.ChangeDir(testDir)
 	assert.NoError(err)
 
-	err = c.ChangeDirToParent()
-	assert.NoError(err)
+	dir, err = c.ChangeDirToParent()
+	if assert.NoError(err) {
+		assert.Equal("/incoming", dir)
+	}
 
 	entries, err := c.NameList("/")
 	assert.NoError(err)
@@ -231,6 +248,150 @@ func TestWrongLogin(t *testing.T) {
 	}
 }
 
+func TestLoginWithAccount(t *testing.T) {
+	handlers := map[string]mockHandler{
+		"PASS": func(mock *ftpMock, cmdParts []string) bool {
+			if cmdParts[1] != "needs-account" {
+				return false
+			}
+			mock.printfLine("332 Need account for login")
+			return true
+		},
+		"ACCT": func(mock *ftpMock, cmdParts []string) bool {
+			if cmdParts[1] == "acct" {
+				mock.printfLine("230 Access granted")
+			} else {
+				mock.printfLine("530 Unknown account")
+			}
+			return true
+		},
+	}
+
+	// The account is not sent when not asked for
+	mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", handlers)
+	require.NoError(t, err)
+	defer mock.Close()
+
+	c, err := Dial(mock.Addr())
+	require.NoError(t, err)
+	assert.NoError(t, c.LoginWithAccount("anonymous", "anonymous", "acct"))
+
+	closeConn(t, mock, c, nil)
+
+	mock, err = newFtpMockHandlers(t, "127.0.0.1", "no-time", handlers)
+	require.NoError(t, err)
+	defer mock.Close()
+
+	c, err = Dial(mock.Addr())
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, c.Login("anonymous", "needs-account"), ErrAccountRequired)
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, c.LoginWithAccount("anonymous", "needs-account", "other"), &protoErr) {
+		assert.Equal(t, StatusNotLoggedIn, protoErr.Code)
+	}
+	assert.NoError(t, c.LoginWithAccount("anonymous", "needs-account", "acct"))
+
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+	assert.Equal(t, []string{
+		"USER", "PASS",
+		"USER", "PASS", "ACCT",
+		"USER", "PASS", "ACCT", "FEAT", "TYPE", "OPTS", "QUIT",
+	}, mock.commands)
+}
+
+func TestLoginAnonymous(t *testing.T) {
+	var passwords []string
+	mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"PASS": func(mock *ftpMock, cmdParts []string) bool {
+			passwords = append(passwords, cmdParts[1])
+			if strings.Contains(cmdParts[1], ".") {
+				return false
+			}
+			mock.printfLine("530 Please use your e-mail address as password")
+			return true
+		},
+	})
+	require.NoError(t, err)
+	defer mock.Close()
+
+	c, err := Dial(mock.Addr())
+	require.NoError(t, err)
+	assert.NoError(t, c.LoginAnonymous())
+	assert.Equal(t, []string{"anonymous@", anonymousEmail}, passwords)
+
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "PASS", "USER", "PASS", "FEAT", "TYPE", "OPTS", "QUIT"}, mock.commands)
+
+	// Other rejections are not retried
+	mock, err = newFtpMockHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"PASS": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("530 Login incorrect")
+			return true
+		},
+	})
+	require.NoError(t, err)
+	defer mock.Close()
+
+	c, err = Dial(mock.Addr())
+	require.NoError(t, err)
+
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, c.LoginAnonymous(), &protoErr) {
+		assert.Equal(t, StatusNotLoggedIn, protoErr.Code)
+	}
+
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "PASS", "QUIT"}, mock.commands)
+}
+
+func TestPing(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+	assert.NoError(t, c.Ping())
+	closeConn(t, mock, c, []string{"NOOP"})
+}
+
+func TestPingAuth(t *testing.T) {
+	mock, err := newFtpMock(t, "127.0.0.1")
+	require.NoError(t, err)
+	defer mock.Close()
+
+	assert.NoError(t, PingAuth(mock.Addr(), "anonymous", "anonymous"))
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "PASS", "FEAT", "TYPE", "OPTS", "NOOP", "QUIT"}, mock.commands)
+
+	mock, err = newFtpMock(t, "127.0.0.1")
+	require.NoError(t, err)
+	defer mock.Close()
+
+	assert.Error(t, PingAuth(mock.Addr(), "zoo2Shia", "fei5Yix9"))
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "QUIT"}, mock.commands)
+}
+
+func TestRequireTLS(t *testing.T) {
+	mock, err := newFtpMock(t, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	c, err := Dial(mock.Addr(), DialWithRequireTLS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Login("anonymous", "anonymous")
+	assert.ErrorIs(t, err, ErrTLSRequired)
+
+	// Wait for the connection to close
+	mock.Wait()
+	assert.Empty(t, mock.commands, "credentials must not be sent")
+}
+
 func TestDeleteDirRecur(t *testing.T) {
 	mock, c := openConn(t, "127.0.0.1")
 
@@ -296,6 +457,52 @@ func TestListCurrentDir(t *testing.T) {
 	mock.Wait()
 }
 
+func TestNameListWithForceListHidden(t *testing.T) {
+	for _, tC := range []struct {
+		desc  string
+		flag  func(mock *ftpMock)
+		names []string
+		cmds  []string
+	}{
+		{"supported", func(mock *ftpMock) {
+			mock.sendDataConn([]byte(".hidden\r\nfile\r\n"))
+		}, []string{".hidden", "file"}, []string{"EPSV", "NLST"}},
+		{"refused", func(mock *ftpMock) {
+			mock.dataConn.Wait()
+			mock.printfLine("550 -a: No such file or directory")
+			mock.closeDataConn()
+		}, []string{"file"}, []string{"EPSV", "NLST", "EPSV", "NLST"}},
+		{"empty", func(mock *ftpMock) {
+			mock.sendDataConn(nil)
+		}, []string{"file"}, []string{"EPSV", "NLST", "EPSV", "NLST"}},
+	} {
+		t.Run(tC.desc, func(t *testing.T) {
+			var fulls []string
+			mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+				"NLST": func(mock *ftpMock, cmdParts []string) bool {
+					fulls = append(fulls, strings.Join(cmdParts, " "))
+					if len(cmdParts) > 1 && cmdParts[1] == "-a" {
+						tC.flag(mock)
+					} else {
+						mock.sendDataConn([]byte("file\r\n"))
+					}
+					return true
+				},
+			}, DialWithForceListHidden(true))
+
+			names, err := c.NameList("/pub")
+			assert.NoError(t, err)
+			assert.Equal(t, tC.names, names)
+			assert.Equal(t, "NLST -a /pub", fulls[0])
+			if len(fulls) > 1 {
+				assert.Equal(t, "NLST /pub", fulls[1])
+			}
+
+			closeConn(t, mock, c, tC.cmds)
+		})
+	}
+}
+
 func TestListCurrentDirWithForceListHidden(t *testing.T) {
 	mock, c := openConnExt(t, "127.0.0.1", "no-time", DialWithDisabledMLSD(true), DialWithForceListHidden(true))
 
@@ -310,6 +517,260 @@ func TestListCurrentDirWithForceListHidden(t *testing.T) {
 	mock.Wait()
 }
 
+func TestListDirsAndFiles(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte("type=cdir;modify=20150813224845; /home/user\r\n" +
+				"type=pdir;modify=20150813224845; ..\r\n" +
+				"type=dir;modify=20150813224845; docs\r\n" +
+				"type=file;size=42;modify=20150813224845; notes.txt\r\n" +
+				"type=dir;modify=20150813224845; src\r\n"))
+			return true
+		},
+	})
+
+	dirs, err := c.ListDirs("")
+	assert.NoError(t, err)
+	if assert.Len(t, dirs, 2) {
+		assert.Equal(t, "docs", dirs[0].Name)
+		assert.Equal(t, "src", dirs[1].Name)
+	}
+
+	files, err := c.ListFiles("")
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "notes.txt", files[0].Name)
+	}
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD", "EPSV", "MLSD"})
+}
+
+func TestListStream(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte("type=file;size=1; a\r\ntype=dir; b\r\ntype=file;size=3; c\r\n"))
+			return true
+		},
+	})
+
+	entries, errs := c.ListStream(context.Background(), "")
+
+	var names []string
+	for entry := range entries {
+		names = append(names, entry.Name)
+	}
+	assert.NoError(t, <-errs)
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+
+	// The connection must still be usable
+	assert.NoError(t, c.NoOp())
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD", "NOOP"})
+}
+
+func TestListStreamCancel(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			var listing strings.Builder
+			for i := 0; i < 100; i++ {
+				fmt.Fprintf(&listing, "type=file;size=%d; file%d\r\n", i, i)
+			}
+			mock.sendDataConn([]byte(listing.String()))
+			return true
+		},
+		"ABOR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("226 Abort successful")
+			return true
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entries, errs := c.ListStream(ctx, "")
+
+	// Stop after the first entry, without draining the channel
+	entry := <-entries
+	assert.Equal(t, "file0", entry.Name)
+	cancel()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+
+	// The transfer was aborted and the connection released
+	assert.NoError(t, c.NoOp())
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD", "ABOR", "NOOP"})
+}
+
+func TestListPage(t *testing.T) {
+	mlsd := new(bytes.Buffer)
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(mlsd, "type=file;size=%d; file%d\r\n", i, i)
+	}
+
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn(mlsd.Bytes())
+			return true
+		},
+	})
+
+	entries, err := c.ListPage("", 5000, 3)
+	if assert.NoError(t, err) && assert.Len(t, entries, 3) {
+		assert.Equal(t, "file5000", entries[0].Name)
+		assert.Equal(t, uint64(5002), entries[2].Size)
+	}
+
+	// The last page is short
+	entries, err = c.ListPage("", 9998, 10)
+	if assert.NoError(t, err) && assert.Len(t, entries, 2) {
+		assert.Equal(t, "file9999", entries[1].Name)
+	}
+
+	entries, err = c.ListPage("", 10000, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// The data connection must have been drained
+	assert.NoError(t, c.NoOp())
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD", "EPSV", "MLSD", "EPSV", "MLSD", "NOOP"})
+}
+
+func TestListedWith(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+	assert.Equal(t, ListMethod(""), c.ListedWith())
+
+	_, err := c.List(".")
+	assert.NoError(t, err)
+	assert.Equal(t, ListMethodMLSD, c.ListedWith())
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD"})
+
+	mock, c = openConn(t, "127.0.0.1", DialWithDisabledMLSD(true))
+
+	_, err = c.List(".")
+	assert.NoError(t, err)
+	assert.Equal(t, ListMethodLIST, c.ListedWith())
+
+	closeConn(t, mock, c, []string{"EPSV", "LIST"})
+}
+
+func TestListNameListFallback(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"LIST": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			mock.closeDataConn()
+			mock.printfLine("502 Command not implemented")
+			return true
+		},
+	}, DialWithDisabledMLSD(true))
+
+	entries, err := c.List(".")
+	if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+		assert.Equal(t, "/incoming", entries[0].Name)
+	}
+	assert.Equal(t, ListMethodNLST, c.ListedWith())
+
+	closeConn(t, mock, c, []string{"EPSV", "LIST", "EPSV", "NLST"})
+}
+
+func TestListLenientParsing(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"LIST": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte("total 42\r\n\r\n-rw-r--r--   1 ftp      wheel           0 Jan 29 10:29 lo\r\nsome garbage\r\n"))
+			return true
+		},
+	}, DialWithDisabledMLSD(true), DialWithLenientListParsing())
+
+	entries, err := c.List("")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "lo", entries[0].Name)
+	}
+	assert.Equal(t, []string{"some garbage"}, c.UnparsedListLines())
+
+	closeConn(t, mock, c, []string{"EPSV", "LIST"})
+}
+
+func TestListTruncationCheck(t *testing.T) {
+	mlsd := new(bytes.Buffer)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(mlsd, "type=file;size=0; file%d\r\n", i)
+	}
+
+	statCount := int32(1001)
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			if len(cmdParts) > 1 && cmdParts[1] == "aborted" {
+				mock.dataConn.Wait()
+				mock.printfLine("150 Opening data connection")
+				mock.dataConn.write(mlsd.Bytes())
+				mock.printfLine("426 Connection closed; transfer aborted")
+				mock.closeDataConn()
+				return true
+			}
+			mock.sendDataConn(mlsd.Bytes())
+			return true
+		},
+		"STAT": func(mock *ftpMock, cmdParts []string) bool {
+			stat := new(bytes.Buffer)
+			stat.WriteString("213-Status follows:\r\n")
+			for i := int32(0); i < atomic.LoadInt32(&statCount); i++ {
+				fmt.Fprintf(stat, "-rw-r--r--   1 ftp      ftp             0 Jan 29 10:29 file%d\r\n", i)
+			}
+			stat.WriteString("213 End of status")
+			mock.printfLine(stat.String())
+			return true
+		},
+	}, DialWithListTruncationCheck())
+
+	entries, err := c.List("dir")
+	assert.ErrorIs(t, err, ErrListTruncated)
+	assert.Len(t, entries, 1000)
+
+	atomic.StoreInt32(&statCount, 1000)
+	_, err = c.List("dir")
+	assert.NoError(t, err)
+
+	_, err = c.List("aborted")
+	assert.ErrorIs(t, err, ErrListTruncated)
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD", "STAT", "EPSV", "MLSD", "STAT", "EPSV", "MLSD"})
+}
+
+func TestListWithParserOrder(t *testing.T) {
+	mock, c := openConnExt(t, "127.0.0.1", "no-time", DialWithDisabledMLSD(true), DialWithParserOrder([]ParserKind{ParserDOS}))
+
+	entries, err := c.List("")
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "ls lines must not be parsed by the DOS parser")
+
+	closeConn(t, mock, c, []string{"EPSV", "LIST"})
+}
+
+func TestCharsetDecoder(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte("Type=file;Size=0;Modify=20201213202400; caf\xe9\r\n"))
+			return true
+		},
+		"NLST": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte("caf\xe9\r\n"))
+			return true
+		},
+	}, DialWithDisabledUTF8(true), DialWithCharsetDecoder(charmap.ISO8859_1.NewDecoder()))
+
+	entries, err := c.List("")
+	if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+		assert.Equal(t, "café", entries[0].Name)
+	}
+
+	names, err := c.NameList("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"café"}, names)
+
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+}
+
 func TestTimeUnsupported(t *testing.T) {
 	mock, c := openConnExt(t, "127.0.0.1", "no-time")
 
@@ -389,32 +850,2790 @@ func TestTimeVsftpdFull(t *testing.T) {
 	mock.Wait()
 }
 
-func TestDialWithDialFunc(t *testing.T) {
-	dialErr := fmt.Errorf("this is proof that dial function was called")
+func TestSetTimeUTC(t *testing.T) {
+	// MFMT and MDTM take UTC times, whatever the location of the connection
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	mtime := time.Date(2020, 12, 13, 22, 24, 0, 0, loc)
+
+	for _, tC := range []struct {
+		modtime string
+		cmd     string
+		options []DialOption
+	}{
+		{"std-time", "MFMT", nil},
+		{"vsftpd", "MDTM", []DialOption{DialWithWritingMDTM(true)}},
+	} {
+		t.Run(tC.cmd, func(t *testing.T) {
+			options := append([]DialOption{DialWithLocation(loc)}, tC.options...)
+			mock, c := openConnExt(t, "127.0.0.1", tC.modtime, options...)
+
+			assert.NoError(t, c.SetTime("file1", mtime))
+			assert.Equal(t, tC.cmd+" 20201213202400 file1", mock.lastFull)
+
+			assert.NoError(t, c.Quit())
+			mock.Wait()
+		})
+	}
+}
 
-	f := func(network, address string) (net.Conn, error) {
-		return nil, dialErr
+func TestClockSkew(t *testing.T) {
+	const offset = time.Hour
+	var mtime string
+
+	mock, c := openConnHandlers(t, "127.0.0.1", "std-time", map[string]mockHandler{
+		"MFMT": func(mock *ftpMock, cmdParts []string) bool {
+			mtime = cmdParts[1]
+			mock.printfLine("213 UTIME OK")
+			return true
+		},
+		"MDTM": func(mock *ftpMock, cmdParts []string) bool {
+			if mtime == "" {
+				// The clock of the server is ahead
+				mtime = time.Now().Add(offset).UTC().Format(timeFormat)
+			}
+			mock.printfLine("213 %s", mtime)
+			return true
+		},
+	})
+
+	skew, err := c.ClockSkew()
+	assert.NoError(t, err)
+	assert.InDelta(t, offset, skew, float64(2*time.Second))
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR", "MDTM", "MFMT", "MDTM", "DELE"})
+}
+
+func TestStorUnique(t *testing.T) {
+	for _, tC := range []struct {
+		desc        string
+		preliminary string
+		completion  string
+		name        string
+	}{
+		{"preliminary", "150 FILE: unique.1", "226 Transfer complete", "unique.1"},
+		{"completion", "150 Ok to send data", "250 Transfer complete, stored as \"unique.2\"", "unique.2"},
+		{"completion file", "150 Ok to send data", "250 FILE: unique.3", "unique.3"},
+		{"none", "150 Ok to send data", "226 Transfer complete", ""},
+		{"completion without name", "150 Ok to send data", "250 Transfer complete", ""},
+	} {
+		t.Run(tC.desc, func(t *testing.T) {
+			mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+				"STOU": func(mock *ftpMock, cmdParts []string) bool {
+					mock.printfLine(tC.preliminary)
+					mock.dataConn.Wait()
+					mock.fileCont = new(bytes.Buffer)
+					if _, err := io.Copy(mock.fileCont, mock.dataConn.conn); err != nil {
+						t.Error(err)
+					}
+					mock.printfLine(tC.completion)
+					mock.closeDataConn()
+					return true
+				},
+			})
+
+			name, err := c.StorUnique(bytes.NewBufferString(testData))
+			assert.NoError(t, err)
+			assert.Equal(t, tC.name, name)
+
+			closeConn(t, mock, c, []string{"EPSV", "STOU"})
+			assert.Equal(t, testData, mock.fileCont.String())
+		})
 	}
+}
 
-	_, err := Dial("bogus-address", DialWithDialFunc(f))
-	assert.Equal(t, dialErr, err)
+func TestPauseTransfer(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte(testData))
+			return true
+		},
+	})
+
+	c.PauseTransfer()
+
+	r, err := c.Retr("file")
+	assert.NoError(t, err)
+
+	var read int32
+	done := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(io.TeeReader(r, writerFunc(func(p []byte) (int, error) {
+			atomic.AddInt32(&read, int32(len(p)))
+			return len(p), nil
+		})))
+		assert.NoError(t, err)
+		done <- buf
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("transfer must not complete while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&read), "no bytes must be read while paused")
+
+	c.ResumeTransfer()
+	assert.Equal(t, testData, string(<-done))
+	assert.NoError(t, r.Close())
+
+	closeConn(t, mock, c, []string{"EPSV", "RETR"})
 }
 
-func TestDialWithDialer(t *testing.T) {
-	dialerCalled := false
-	dialer := net.Dialer{
-		Control: func(network, address string, c syscall.RawConn) error {
-			dialerCalled = true
-			return nil
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestDataConnRetries(t *testing.T) {
+	attempts := 0
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			attempts++
+			if attempts == 1 {
+				mock.dataConn.Wait()
+				mock.printfLine("425 Can't open data connection.")
+				mock.closeDataConn()
+			} else {
+				mock.sendDataConn([]byte(testData))
+			}
+			return true
 		},
+	}, DialWithDataConnRetries(2))
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(buf))
+		assert.NoError(t, r.Close())
 	}
 
-	mock, err := newFtpMock(t, "127.0.0.1")
+	closeConn(t, mock, c, []string{"EPSV", "RETR", "EPSV", "RETR"})
+	assert.Equal(t, 2, attempts)
+}
+
+func TestDialWithTransferIdleTimeout(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			mock.printfLine("150 Opening data connection")
+			// Slow but steady, then stalled
+			for i := 0; i < 3; i++ {
+				mock.dataConn.write([]byte(testData[i*4 : i*4+4]))
+				time.Sleep(50 * time.Millisecond)
+			}
+			return true
+		},
+		"ABOR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.closeDataConn()
+			mock.printfLine("426 Transfer aborted. Data connection closed.")
+			mock.printfLine("226 Abort successful")
+			return true
+		},
+	}, DialWithTransferIdleTimeout(200*time.Millisecond))
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.ErrorIs(t, err, ErrTransferIdleTimeout)
+		assert.Equal(t, testData[:12], string(buf))
+
+		assert.NoError(t, r.Abort())
+	}
+
+	closeConn(t, mock, c, []string{"EPSV", "RETR", "ABOR"})
+}
+
+func TestAbort(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			mock.printfLine("150 Opening data connection")
+			mock.dataConn.write([]byte(testData))
+			// The transfer is kept in progress
+			return true
+		},
+		"ABOR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.closeDataConn()
+			mock.printfLine("426 Transfer aborted. Data connection closed.")
+			mock.printfLine("226 Abort successful")
+			return true
+		},
+	})
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(r, buf)
+		assert.NoError(t, err)
+
+		assert.NoError(t, r.Abort())
+		assert.NoError(t, r.Close(), "Close must do nothing after Abort")
+	}
+
+	// The control connection must be in sync
+	assert.NoError(t, c.NoOp())
+	code, _ := c.LastResponse()
+	assert.Equal(t, StatusCommandOK, code)
+
+	closeConn(t, mock, c, []string{"EPSV", "RETR", "ABOR", "NOOP"})
+}
+
+func TestConcurrentTransfer(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte(testData))
+			return true
+		},
+	})
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		_, err = c.List(".")
+		assert.ErrorIs(t, err, ErrConcurrentTransfer)
+		_, err = c.CurrentDir()
+		assert.ErrorIs(t, err, ErrConcurrentTransfer)
+
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(buf))
+		assert.NoError(t, r.Close())
+	}
+
+	// Closing the Response releases the connection
+	_, err = c.List(".")
 	assert.NoError(t, err)
 
-	c, err := Dial(mock.Addr(), DialWithDialer(dialer))
+	closeConn(t, mock, c, []string{"EPSV", "RETR", "EPSV", "MLSD"})
+}
+
+func TestConcurrentRetr(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte(testData))
+			return true
+		},
+	})
+
+	start := make(chan struct{})
+	responses := make(chan *Response, 2)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			<-start
+			r, err := c.Retr("file")
+			if err != nil {
+				errs <- err
+				return
+			}
+			responses <- r
+		}()
+	}
+	close(start)
+
+	// The second Retr must not interleave its commands with the first one
+	r := <-responses
+	assert.ErrorIs(t, <-errs, ErrConcurrentTransfer)
+
+	buf, err := io.ReadAll(r)
 	assert.NoError(t, err)
-	assert.NoError(t, c.Quit())
+	assert.Equal(t, testData, string(buf))
+	assert.NoError(t, r.Close())
 
-	assert.Equal(t, true, dialerCalled)
+	closeConn(t, mock, c, []string{"EPSV", "RETR"})
+}
+
+func TestSeveralPreliminaryReplies(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			mock.printfLine("125 Data connection already open")
+			mock.printfLine("150 Opening data connection")
+			mock.dataConn.write([]byte(testData))
+			mock.printfLine("226 Transfer complete")
+			mock.closeDataConn()
+			return true
+		},
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			mock.printfLine("125 Data connection already open")
+			mock.printfLine("150 Opening data connection")
+			mock.dataConn.write([]byte("type=file;size=1; a\r\n"))
+			mock.printfLine("226 Transfer complete")
+			mock.closeDataConn()
+			return true
+		},
+	})
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(buf))
+		assert.NoError(t, r.Close())
+	}
+
+	entries, err := c.List(".")
+	if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+		assert.Equal(t, "a", entries[0].Name)
+	}
+
+	// The control connection must be in sync
+	assert.NoError(t, c.NoOp())
+	code, _ := c.LastResponse()
+	assert.Equal(t, StatusCommandOK, code)
+
+	closeConn(t, mock, c, []string{"EPSV", "RETR", "EPSV", "MLSD", "NOOP"})
+}
+
+func TestRestartOffsetMismatch(t *testing.T) {
+	var offsets []string
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"REST": func(mock *ftpMock, cmdParts []string) bool {
+			offsets = append(offsets, cmdParts[1])
+			// The server ignores the requested offset
+			mock.printfLine("350 Restarting at 0. Send STORE or RETRIEVE to initiate transfer")
+			return true
+		},
+	})
+
+	_, err := c.RetrFrom("file", 1024)
+	assert.ErrorIs(t, err, ErrRestartOffsetMismatch)
+
+	closeConn(t, mock, c, []string{"EPSV", "REST", "REST"})
+	// The accepted marker must be cleared
+	assert.Equal(t, []string{"1024", "0"}, offsets)
+}
+
+func TestRetrLazy(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte(testData))
+			return true
+		},
+	})
+
+	// Closing without reading must not send anything
+	r, err := c.RetrLazy("file")
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+
+	r, err = c.RetrLazy("file")
+	assert.NoError(t, err)
+	buf, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, string(buf))
+	assert.NoError(t, r.Close())
+
+	closeConn(t, mock, c, []string{"EPSV", "RETR"})
+}
+
+func TestTransferStatus(t *testing.T) {
+	for _, tC := range []struct {
+		desc            string
+		completedBefore bool
+		reply           string
+		status          string
+	}{
+		{"in progress", false, "213 Status: 4 of 14 bytes transferred", "Status: 4 of 14 bytes transferred"},
+		{"completed", true, "211 No transfer in progress", "No transfer in progress"},
+	} {
+		t.Run(tC.desc, func(t *testing.T) {
+			mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+				"RETR": func(mock *ftpMock, cmdParts []string) bool {
+					mock.dataConn.Wait()
+					mock.printfLine("150 Opening data connection")
+					mock.dataConn.write([]byte(testData[:4]))
+					if tC.completedBefore {
+						mock.dataConn.write([]byte(testData[4:]))
+						mock.printfLine("226 Transfer complete")
+					}
+
+					// Wait for the STAT command during the transfer
+					line, err := mock.proto.ReadLine()
+					assert.NoError(t, err)
+					assert.Equal(t, "STAT", line)
+					mock.commands = append(mock.commands, line)
+					mock.printfLine(tC.reply)
+
+					if !tC.completedBefore {
+						mock.dataConn.write([]byte(testData[4:]))
+						mock.printfLine("226 Transfer complete")
+					}
+					mock.closeDataConn()
+					return true
+				},
+			})
+
+			r, err := c.Retr("file")
+			assert.NoError(t, err)
+
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(r, buf)
+			assert.NoError(t, err)
+
+			status, err := c.TransferStatus()
+			assert.NoError(t, err)
+			assert.Equal(t, tC.status, status)
+
+			rest, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, testData, string(buf)+string(rest))
+			assert.NoError(t, r.Close())
+
+			closeConn(t, mock, c, []string{"EPSV", "RETR", "STAT"})
+		})
+	}
+}
+
+func TestTransferStatusConcurrent(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte(testData))
+			return true
+		},
+		"STAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211 No transfer in progress")
+			return true
+		},
+	})
+
+	_, err := c.TransferStatus()
+	assert.ErrorIs(t, err, ErrNoTransfer)
+
+	var commands []string
+	for i := 0; i < 10; i++ {
+		r, err := c.Retr("file")
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		var statusErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, statusErr = c.TransferStatus()
+		}()
+
+		data, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(data))
+		assert.NoError(t, r.Close())
+		wg.Wait()
+
+		commands = append(commands, "EPSV", "RETR")
+		if statusErr == nil {
+			commands = append(commands, "STAT")
+		} else {
+			// The transfer ended before
+			assert.ErrorIs(t, statusErr, ErrNoTransfer)
+		}
+	}
+
+	// The control connection must be in sync
+	assert.NoError(t, c.NoOp())
+
+	closeConn(t, mock, c, append(commands, "NOOP"))
+}
+
+func TestLastResponse(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+
+	code, msg := c.LastResponse()
+	assert.Equal(t, StatusCommandOK, code)
+	assert.Equal(t, "OK, UTF-8 enabled", msg)
+
+	_, err := c.FileSize("not-found")
+	assert.Error(t, err)
+	code, msg = c.LastResponse()
+	assert.Equal(t, StatusFileUnavailable, code)
+	assert.Equal(t, "Could not get file size.", msg)
+
+	_, err = c.FileSize("magic-file")
+	assert.NoError(t, err)
+	code, msg = c.LastResponse()
+	assert.Equal(t, StatusFile, code)
+	assert.Equal(t, "42", msg)
+
+	closeConn(t, mock, c, []string{"SIZE", "SIZE"})
+}
+
+func TestQuitWithTimeout(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+	assert.NoError(t, c.QuitWithTimeout(time.Second))
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "PASS", "FEAT", "TYPE", "OPTS", "QUIT"}, mock.commands)
+}
+
+func TestQuitWithTimeoutDeadServer(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"QUIT": func(mock *ftpMock, cmdParts []string) bool {
+			// Never acknowledge the QUIT command
+			return true
+		},
+	})
+
+	start := time.Now()
+	err := c.QuitWithTimeout(100 * time.Millisecond)
+	assert.ErrorContains(t, err, "i/o timeout")
+	assert.Less(t, time.Since(start), time.Second)
+
+	mock.Wait()
+}
+
+func TestClose(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+	assert.NoError(t, c.Close())
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "PASS", "FEAT", "TYPE", "OPTS"}, mock.commands)
+}
+
+func TestStorRetryable(t *testing.T) {
+	for _, tC := range []struct {
+		desc             string
+		maxBufferedBytes int
+		retried          bool
+	}{
+		{"buffered", len(testData), true},
+		{"committed", len(testData) - 1, false},
+	} {
+		t.Run(tC.desc, func(t *testing.T) {
+			attempts := 0
+			mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+				"STOR": func(mock *ftpMock, cmdParts []string) bool {
+					attempts++
+					if attempts > 1 {
+						return false
+					}
+
+					// Fail the first upload after receiving the data
+					mock.dataConn.Wait()
+					mock.printfLine("150 please send")
+					if _, err := io.Copy(io.Discard, mock.dataConn.conn); err != nil {
+						t.Error(err)
+					}
+					mock.printfLine("426 Connection closed; transfer aborted.")
+					mock.closeDataConn()
+					return true
+				},
+			})
+
+			// A non-seekable reader
+			r := io.MultiReader(bytes.NewBufferString(testData))
+			err := c.StorRetryable("file", r, tC.maxBufferedBytes)
+
+			if tC.retried {
+				assert.NoError(t, err)
+				closeConn(t, mock, c, []string{"EPSV", "STOR", "EPSV", "STOR"})
+				assert.Equal(t, testData, mock.fileCont.String())
+			} else {
+				assert.Error(t, err)
+				closeConn(t, mock, c, []string{"EPSV", "STOR"})
+			}
+		})
+	}
+}
+
+func TestSite(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SITE": func(mock *ftpMock, cmdParts []string) bool {
+			switch {
+			case cmdParts[1] == "HELP":
+				mock.printfLine("214-The following SITE commands are recognized\r\n CHMOD\r\n214 Direct comments to root")
+			case cmdParts[1] == "CHMOD" && cmdParts[3] == "file":
+				assert.Equal(t, "0644", cmdParts[2])
+				mock.printfLine("200 SITE CHMOD command successful")
+			default:
+				mock.printfLine("550 %s: No such file or directory", cmdParts[3])
+			}
+			return true
+		},
+	})
+
+	code, msg, err := c.Site("HELP")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusHelp, code)
+	assert.Equal(t, "The following SITE commands are recognized\n CHMOD\nDirect comments to root", msg)
+
+	assert.NoError(t, c.Chmod("file", 0644))
+
+	err = c.Chmod("missing", 0644)
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusFileUnavailable, protoErr.Code)
+	}
+
+	closeConn(t, mock, c, []string{"SITE", "SITE", "SITE"})
+}
+
+func TestRaw(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"XVND": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("200 %s", strings.Join(cmdParts[1:], " "))
+			return true
+		},
+	})
+
+	code, msg, err := c.Raw("XVND some args")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusCommandOK, code)
+	assert.Equal(t, "some args", msg)
+
+	code, _, err = c.Raw("XUNK")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusBadCommand, code)
+
+	closeConn(t, mock, c, []string{"XVND", "XUNK"})
+}
+
+func TestPostConnectCommands(t *testing.T) {
+	handlers := map[string]mockHandler{
+		"CLNT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("200 Noted.")
+			return true
+		},
+	}
+
+	mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", handlers)
+	require.NoError(t, err)
+	defer mock.Close()
+
+	c, err := Dial(mock.Addr(), DialWithPostConnectCommands("CLNT test", "OPTS UTF8 ON"))
+	require.NoError(t, err)
+	require.NoError(t, c.Login("anonymous", "anonymous"))
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+	assert.Equal(t, []string{"CLNT", "OPTS", "USER", "PASS", "FEAT", "TYPE", "OPTS", "QUIT"}, mock.commands)
+
+	// A rejected command fails the dial
+	mock, err = newFtpMockHandlers(t, "127.0.0.1", "no-time", handlers)
+	require.NoError(t, err)
+	defer mock.Close()
+
+	_, err = Dial(mock.Addr(), DialWithPostConnectCommands("CLNT test", "XUNK"))
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusBadCommand, protoErr.Code)
+	}
+	mock.Wait()
+	assert.Equal(t, []string{"CLNT", "XUNK", "QUIT"}, mock.commands)
+}
+
+func TestChown(t *testing.T) {
+	siteHandler := func(help string) mockHandler {
+		return func(mock *ftpMock, cmdParts []string) bool {
+			switch cmdParts[1] {
+			case "HELP":
+				mock.printfLine(help)
+			case "CHOWN", "CHGRP":
+				if cmdParts[3] == "file" {
+					mock.printfLine("200 %s command successful", cmdParts[1])
+				} else {
+					mock.printfLine("550 %s: No such file or directory", cmdParts[3])
+				}
+			}
+			return true
+		}
+	}
+
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SITE": siteHandler("214-The following SITE commands are recognized (* =>'s unimplemented)\r\n" +
+			" CHGRP <sp> group <sp> pathname\r\n CHMOD <sp> mode <sp> pathname\r\n" +
+			" CHOWN <sp> owner <sp> pathname\r\n HELP\r\n214 Direct comments to root"),
+	})
+
+	assert.NoError(t, c.Chown("file", "www", "staff"))
+	assert.Equal(t, "SITE CHGRP staff file", mock.lastFull)
+	assert.NoError(t, c.Chown("file", "www", ""))
+	assert.Equal(t, "SITE CHOWN www file", mock.lastFull)
+
+	err := c.Chown("missing", "www", "staff")
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusFileUnavailable, protoErr.Code)
+	}
+
+	closeConn(t, mock, c, []string{"SITE", "SITE", "SITE", "SITE", "SITE"})
+
+	mock, c = openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SITE": siteHandler("214-The following SITE commands are recognized (* =>'s unimplemented)\r\n" +
+			" CHMOD\r\n CHOWN\r\n HELP\r\n214 Direct comments to root"),
+	})
+
+	assert.ErrorIs(t, c.Chown("file", "www", "staff"), ErrSiteCommandUnsupported)
+	assert.NoError(t, c.Chown("file", "www", ""))
+
+	closeConn(t, mock, c, []string{"SITE", "SITE"})
+}
+
+func TestCopy(t *testing.T) {
+	siteHandler := func(help string) mockHandler {
+		return func(mock *ftpMock, cmdParts []string) bool {
+			switch cmdParts[1] {
+			case "HELP":
+				mock.printfLine(help)
+			case "CPFR":
+				if cmdParts[2] == "file" {
+					mock.printfLine("350 File or directory exists, ready for destination name")
+				} else {
+					mock.printfLine("550 %s: No such file or directory", cmdParts[2])
+				}
+			case "CPTO":
+				mock.printfLine("250 Copy successful")
+			}
+			return true
+		}
+	}
+
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SITE": siteHandler("214-The following SITE commands are recognized (* =>'s unimplemented)\r\n" +
+			" CHMOD <sp> mode <sp> pathname\r\n CPFR <sp> pathname\r\n CPTO <sp> pathname\r\n HELP\r\n" +
+			"214 Direct comments to root"),
+	})
+
+	assert.NoError(t, c.Copy("file", "copy"))
+
+	err := c.Copy("missing", "copy")
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusFileUnavailable, protoErr.Code)
+	}
+
+	closeConn(t, mock, c, []string{"SITE", "SITE", "SITE", "SITE"})
+
+	mock, c = openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SITE": siteHandler("214-The following SITE commands are recognized (* =>'s unimplemented)\r\n" +
+			" CHMOD\r\n CPFR*\r\n CPTO*\r\n HELP\r\n214 Direct comments to root"),
+	})
+
+	assert.ErrorIs(t, c.Copy("file", "copy"), ErrServerSideCopyUnsupported)
+	assert.ErrorIs(t, c.Copy("file", "copy"), ErrServerSideCopyUnsupported)
+
+	closeConn(t, mock, c, []string{"SITE"})
+}
+
+func TestCompression(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n EPSV\r\n UTF8\r\n MODE Z\r\n211 End")
+			return true
+		},
+		"OPTS": func(mock *ftpMock, cmdParts []string) bool {
+			if cmdParts[1] != "MODE" {
+				return false
+			}
+			assert.Equal(t, []string{"OPTS", "MODE", "Z", "LEVEL", "9"}, cmdParts)
+			mock.printfLine("200 OPTS MODE Z OK")
+			return true
+		},
+		"MODE": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("200 Mode set to %s", cmdParts[1])
+			return true
+		},
+		"STOR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			mock.printfLine("150 please send")
+			zr, err := zlib.NewReader(mock.dataConn.conn)
+			if assert.NoError(t, err) {
+				mock.fileCont = new(bytes.Buffer)
+				_, err = io.Copy(mock.fileCont, zr)
+				assert.NoError(t, err)
+			}
+			mock.printfLine("226 Transfer Complete")
+			mock.closeDataConn()
+			return true
+		},
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			compressed := new(bytes.Buffer)
+			zw := zlib.NewWriter(compressed)
+			_, _ = zw.Write(mock.fileCont.Bytes())
+			_ = zw.Close()
+			mock.sendDataConn(compressed.Bytes())
+			return true
+		},
+	}, DialWithCompression(zlib.BestCompression))
+
+	assert.NoError(t, c.Stor("file", strings.NewReader(testData)))
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(buf))
+		assert.NoError(t, r.Close())
+	}
+
+	// An empty upload is a valid empty stream
+	assert.NoError(t, c.Stor("empty", strings.NewReader("")))
+	assert.Equal(t, 0, mock.fileCont.Len())
+
+	closeConn(t, mock, c, []string{"OPTS", "MODE", "EPSV", "STOR", "EPSV", "RETR", "EPSV", "STOR"})
+}
+
+func TestCompressionUnsupported(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1", DialWithCompression(zlib.DefaultCompression))
+
+	assert.NoError(t, c.Stor("file", strings.NewReader(testData)))
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(buf))
+		assert.NoError(t, r.Close())
+	}
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR", "EPSV", "RETR"})
+}
+
+func TestServiceClosing(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"CWD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("421 Idle timeout, closing control connection")
+			return true
+		},
+	})
+
+	err := c.ChangeDir("dir")
+	assert.ErrorIs(t, err, ErrServiceClosing)
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusNotAvailable, protoErr.Code)
+	}
+
+	// Later calls fail fast without writing to the closed connection
+	_, err = c.CurrentDir()
+	assert.ErrorIs(t, err, ErrServiceClosing)
+	_, err = c.List(".")
+	assert.ErrorIs(t, err, ErrServiceClosing)
+	assert.ErrorIs(t, c.Quit(), ErrServiceClosing)
+
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "PASS", "FEAT", "TYPE", "OPTS", "CWD"}, mock.commands)
+}
+
+func TestDialWithDialFunc(t *testing.T) {
+	dialErr := fmt.Errorf("this is proof that dial function was called")
+
+	f := func(network, address string) (net.Conn, error) {
+		return nil, dialErr
+	}
+
+	_, err := Dial("bogus-address", DialWithDialFunc(f))
+	assert.Equal(t, dialErr, err)
+}
+
+func TestDialWithDataNetwork(t *testing.T) {
+	var networks, addresses []string
+	f := func(network, address string) (net.Conn, error) {
+		networks = append(networks, network)
+		addresses = append(addresses, address)
+		return net.Dial(network, address)
+	}
+
+	mock, c := openConn(t, "127.0.0.1", DialWithDialFunc(f), DialWithDataNetwork("tcp4"))
+
+	_, err := c.List("")
+	assert.NoError(t, err)
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD"})
+
+	// The control connection is always dialed with tcp
+	assert.Equal(t, []string{"tcp", "tcp4"}, networks)
+	host, port, err := net.SplitHostPort(addresses[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+	assert.NotEqual(t, "0", port)
+}
+
+func TestDialWithForcePasvHostFromControl(t *testing.T) {
+	var addresses []string
+	f := func(network, address string) (net.Conn, error) {
+		addresses = append(addresses, address)
+		return net.Dial(network, address)
+	}
+
+	pasvHosts := []string{"10,0,0,1", "127,0,0,2"}
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"PASV": func(mock *ftpMock, cmdParts []string) bool {
+			p, err := mock.listenDataConn()
+			if err != nil {
+				mock.printfLine("451 %s.", err)
+				return true
+			}
+			mock.printfLine("227 Entering Passive Mode (%s,%d,%d).", pasvHosts[0], p/256, p%256)
+			pasvHosts = pasvHosts[1:]
+			return true
+		},
+	}, DialWithDialFunc(f), DialWithDisabledEPSV(true), DialWithForcePasvHostFromControl(true))
+
+	for i := 0; i < 2; i++ {
+		_, err := c.List("")
+		assert.NoError(t, err)
+	}
+
+	closeConn(t, mock, c, []string{"PASV", "MLSD", "PASV", "MLSD"})
+
+	if assert.Len(t, addresses, 3) {
+		for _, address := range addresses[1:] {
+			host, _, err := net.SplitHostPort(address)
+			assert.NoError(t, err)
+			assert.Equal(t, "127.0.0.1", host)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1", DialWithRateLimit(10000))
+
+	data := bytes.Repeat([]byte("x"), 4000)
+
+	start := time.Now()
+	assert.NoError(t, c.Stor("file", bytes.NewReader(data)))
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	start = time.Now()
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, data, buf)
+		assert.NoError(t, r.Close())
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR", "EPSV", "RETR"})
+}
+
+func TestTransferBufferSize(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1", DialWithTransferBufferSize(1024))
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	assert.NoError(t, c.Stor("file", bytes.NewReader(data)))
+	assert.NoError(t, c.Append("file", bytes.NewReader(data)))
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf := new(bytes.Buffer)
+		n, err := io.Copy(buf, r)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2*len(data)), n)
+		assert.Equal(t, append(data, data...), buf.Bytes())
+		assert.NoError(t, r.Close())
+	}
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR", "EPSV", "APPE", "EPSV", "RETR"})
+}
+
+func BenchmarkTransferBufferSize(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 4<<20)
+
+	for _, size := range []int{0, 4 << 10, 256 << 10} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			mock, c := openConn(b, "127.0.0.1", DialWithTransferBufferSize(size))
+			defer mock.Close()
+
+			b.SetBytes(int64(2 * len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Stor("file", bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+				r, err := c.Retr("file")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				if err := r.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			if err := c.Quit(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// tempFile returns a temporary file with the given content.
+func tempFile(t testing.TB, content []byte) *os.File {
+	f, err := os.CreateTemp(t.TempDir(), "stor")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = f.Close() })
+
+	_, err = f.Write(content)
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	return f
+}
+
+func TestStorFile(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+
+	assert.NoError(t, c.StorFile("file", tempFile(t, []byte(testData))))
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(buf))
+		assert.NoError(t, r.Close())
+	}
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR", "EPSV", "RETR"})
+}
+
+func BenchmarkStorFile(b *testing.B) {
+	f := tempFile(b, bytes.Repeat([]byte("x"), 32<<20))
+
+	for _, tC := range []struct {
+		name string
+		stor func(c *ServerConn) error
+	}{
+		{"Stor", func(c *ServerConn) error { return c.Stor("file", f) }},
+		{"StorFile", func(c *ServerConn) error { return c.StorFile("file", f) }},
+	} {
+		b.Run(tC.name, func(b *testing.B) {
+			mock, c := openConn(b, "127.0.0.1")
+			defer mock.Close()
+
+			b.SetBytes(32 << 20)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if err := tC.stor(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			if err := c.Quit(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// scriptedConn is an in-memory control connection replaying canned replies.
+type scriptedConn struct {
+	io.Reader
+	sent bytes.Buffer // commands sent by the client
+}
+
+func (c *scriptedConn) Write(p []byte) (int, error) {
+	return c.sent.Write(p)
+}
+
+func (c *scriptedConn) Close() error {
+	return nil
+}
+
+func TestNewConnWithTranscript(t *testing.T) {
+	conn := &scriptedConn{Reader: strings.NewReader("220 FTP Server ready.\r\n" +
+		"331 Please send your password\r\n" +
+		"230 Access granted\r\n" +
+		"211 End\r\n" +
+		"200 Type set ok\r\n" +
+		"257 \"/home\"\r\n")}
+	transcript := new(bytes.Buffer)
+
+	c, err := NewConn(conn, DialWithTranscript(transcript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, c.Login("anonymous", "secret"))
+	dir, err := c.CurrentDir()
+	assert.NoError(t, err)
+	assert.Equal(t, "/home", dir)
+	assert.NoError(t, c.Quit())
+
+	assert.Equal(t, "USER anonymous\r\nPASS secret\r\nFEAT\r\nTYPE I\r\nPWD\r\nQUIT\r\n", conn.sent.String())
+	assert.Equal(t, "USER anonymous\nPASS ****\nFEAT\nTYPE I\nPWD\nQUIT\n", transcript.String())
+}
+
+func TestUnterminatedReplyAtEOF(t *testing.T) {
+	// Some embedded servers omit the CRLF of their last reply before closing
+	conn := &scriptedConn{Reader: strings.NewReader("220 FTP Server ready.\r\n" +
+		"257 \"/dir\"")}
+
+	c, err := NewConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := c.CurrentDir()
+	assert.NoError(t, err)
+	assert.Equal(t, "/dir", dir)
+	assert.Equal(t, "PWD\r\n", conn.sent.String())
+}
+
+func TestDialWithDialer(t *testing.T) {
+	dialerCalled := false
+	dialer := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			dialerCalled = true
+			return nil
+		},
+	}
+
+	mock, err := newFtpMock(t, "127.0.0.1")
+	assert.NoError(t, err)
+
+	c, err := Dial(mock.Addr(), DialWithDialer(dialer))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Quit())
+
+	assert.Equal(t, true, dialerCalled)
+}
+
+func TestDialWithDataConnTimeout(t *testing.T) {
+	// The data connections are held like by a firewall dropping the packets
+	var dials int32
+	dialer := net.Dialer{
+		Timeout: time.Minute,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if atomic.AddInt32(&dials, 1) > 1 {
+				time.Sleep(200 * time.Millisecond)
+			}
+			return nil
+		},
+	}
+
+	mock, c := openConn(t, "127.0.0.1", DialWithDialer(dialer), DialWithDataConnTimeout(50*time.Millisecond))
+
+	_, err := c.Retr("file")
+	var netErr net.Error
+	if assert.ErrorAs(t, err, &netErr) {
+		assert.True(t, netErr.Timeout())
+	}
+	assert.Contains(t, err.Error(), "data connection")
+
+	closeConn(t, mock, c, []string{"EPSV"})
+}
+
+func TestDialWithDataPortRange(t *testing.T) {
+	// A local port which is free, and one which is not
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	free := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	busy := l.Addr().(*net.TCPAddr).Port
+
+	var remote net.Addr
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			remote = mock.dataConn.conn.RemoteAddr()
+			mock.sendDataConn([]byte(testData))
+			return true
+		},
+	}, DialWithDataPortRange(free, free+9))
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		_, err = io.Copy(io.Discard, r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+
+		port := remote.(*net.TCPAddr).Port
+		assert.GreaterOrEqual(t, port, free)
+		assert.LessOrEqual(t, port, free+9)
+	}
+
+	closeConn(t, mock, c, []string{"EPSV", "RETR"})
+
+	mock, c = openConnHandlers(t, "127.0.0.1", "no-time", nil, DialWithDataPortRange(busy, busy))
+
+	_, err = c.Retr("file")
+	assert.ErrorIs(t, err, ErrNoDataPortAvailable)
+
+	closeConn(t, mock, c, []string{"EPSV"})
+}
+
+// cappedBuffer counts the bytes written up to max, like a full disk.
+type cappedBuffer struct {
+	mu   sync.Mutex
+	size int64
+	max  int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.size += int64(len(p))
+	if b.size > b.max {
+		b.size = b.max
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.size
+}
+
+// testStorWithCheckpoints uploads size bytes to a server persisting at most
+// max bytes.
+func testStorWithCheckpoints(t *testing.T, size, max int64) error {
+	t.Helper()
+
+	received := &cappedBuffer{max: max}
+	handlers := map[string]mockHandler{
+		"STOR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			mock.printfLine("150 please send")
+
+			// Like most servers, no command is read until the data
+			// connection is closed.
+			_, err := io.Copy(received, mock.dataConn.conn)
+			assert.NoError(t, err)
+			mock.printfLine("226 Transfer Complete")
+			mock.closeDataConn()
+			return true
+		},
+		"SIZE": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("213 %d", received.Size())
+			return true
+		},
+	}
+
+	// Every control connection is served by its own mock
+	var mu sync.Mutex
+	var mocks []*ftpMock
+	f := func(network, address string) (net.Conn, error) {
+		if address != "ftp.example.org:21" {
+			return net.Dial(network, address)
+		}
+		mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", handlers)
+		if err != nil {
+			return nil, err
+		}
+		defer mock.Close()
+
+		mu.Lock()
+		mocks = append(mocks, mock)
+		mu.Unlock()
+		return net.Dial(network, mock.Addr())
+	}
+
+	c, err := Dial("ftp.example.org:21", DialWithDialFunc(f), DialWithStoredCredentials())
+	require.NoError(t, err)
+	require.NoError(t, c.Login("anonymous", "anonymous"))
+
+	err = c.StorWithCheckpoints("file", bytes.NewReader(make([]byte, size)), 10)
+
+	require.Len(t, mocks, 2)
+	closeConn(t, mocks[0], c, []string{"PWD", "EPSV", "STOR"})
+
+	// The checkpoints are made on the second connection
+	checker := mocks[1]
+	checker.Wait()
+	assert.Contains(t, checker.commands, "SIZE")
+	assert.Equal(t, "QUIT", checker.commands[len(checker.commands)-1])
+	return err
+}
+
+func TestStorWithCheckpoints(t *testing.T) {
+	err := testStorWithCheckpoints(t, 95, 1000)
+	assert.NoError(t, err)
+}
+
+func TestStorWithCheckpointsNotPersisted(t *testing.T) {
+	err := testStorWithCheckpoints(t, 95, 25)
+	assert.ErrorIs(t, err, ErrUploadNotPersisted)
+}
+
+func TestStorWithCheckpointsInvalidInterval(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+
+	for _, interval := range []int64{0, -1} {
+		assert.Error(t, c.StorWithCheckpoints("file", bytes.NewReader(make([]byte, 95)), interval))
+	}
+
+	// Nothing was sent
+	closeConn(t, mock, c, nil)
+}
+
+func TestSetFacts(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n EPSV\r\n MFF Modify;UNIX.mode;UNIX.owner;\r\n UTF8\r\n211 End")
+			return true
+		},
+		"MFF": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("213 %s %s", cmdParts[1], cmdParts[2])
+			return true
+		},
+	})
+
+	err := c.SetFacts("file", map[string]string{"UNIX.owner": "ftp", "UNIX.mode": "0644"})
+	assert.NoError(t, err)
+	assert.Equal(t, "MFF UNIX.mode=0644;UNIX.owner=ftp; file", mock.lastFull)
+
+	err = c.SetFacts("file", map[string]string{"UNIX.group": "ftp"})
+	assert.ErrorIs(t, err, ErrFactNotSupported)
+
+	// The trailing ";" of the FEAT reply is not an empty fact
+	err = c.SetFacts("file", map[string]string{"": "ftp"})
+	assert.ErrorIs(t, err, ErrFactNotSupported)
+
+	err = c.SetFacts("file", map[string]string{})
+	assert.Error(t, err)
+
+	closeConn(t, mock, c, []string{"MFF"})
+
+	mock, c = openConn(t, "127.0.0.1")
+	err = c.SetFacts("file", map[string]string{"UNIX.mode": "0644"})
+	assert.ErrorIs(t, err, ErrMFFNotSupported)
+	closeConn(t, mock, c, nil)
+}
+
+func TestSetMLSTFacts(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n EPSV\r\n MLST type*;size*;modify*;perm;UNIX.mode;\r\n UTF8\r\n211 End")
+			return true
+		},
+		"OPTS": func(mock *ftpMock, cmdParts []string) bool {
+			if cmdParts[1] != "MLST" {
+				return false
+			}
+			mock.printfLine("200 MLST OPTS %s", cmdParts[2])
+			return true
+		},
+	})
+
+	assert.NoError(t, c.SetMLSTFacts("type", "size", "UNIX.mode"))
+	assert.Equal(t, "OPTS MLST type;size;UNIX.mode;", mock.lastFull)
+
+	err := c.SetMLSTFacts("type", "media-type")
+	assert.ErrorIs(t, err, ErrUnknownFact)
+
+	closeConn(t, mock, c, []string{"OPTS"})
+
+	mock, c = openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n EPSV\r\n UTF8\r\n211 End")
+			return true
+		},
+	})
+	assert.ErrorIs(t, c.SetMLSTFacts("type"), ErrMLSTNotSupported)
+	closeConn(t, mock, c, nil)
+}
+
+func TestRenameStrict(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RNFR": func(mock *ftpMock, cmdParts []string) bool {
+			if cmdParts[1] == "missing" {
+				mock.printfLine("550 missing: No such file or directory")
+				return true
+			}
+			return false
+		},
+		"RNTO": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("450 Requested file action not taken")
+			return true
+		},
+	})
+
+	var protoErr *textproto.Error
+	err := c.Rename("from", "to")
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusFileActionIgnored, protoErr.Code)
+	}
+
+	err = c.Rename("missing", "to")
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusFileUnavailable, protoErr.Code)
+	}
+
+	closeConn(t, mock, c, []string{"RNFR", "RNTO", "RNFR"})
+}
+
+func TestKeepAlive(t *testing.T) {
+	noops := make(chan struct{}, 3)
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"NOOP": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("200 NOOP ok.")
+			select {
+			case noops <- struct{}{}:
+			default:
+			}
+			return true
+		},
+	}, DialWithKeepAlive(10*time.Millisecond))
+
+	for i := 0; i < cap(noops); i++ {
+		select {
+		case <-noops:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for NOOP")
+		}
+	}
+
+	// Commands are serialized with the NOOP commands
+	dir, err := c.CurrentDir()
+	assert.NoError(t, err)
+	assert.Equal(t, "/incoming", dir)
+
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+
+	// Only NOOP commands are sent while idle, around PWD, then QUIT is last
+	commands := mock.commands[5:]
+	pwd := -1
+	for i, cmd := range commands[:len(commands)-1] {
+		if cmd == "PWD" && pwd < 0 {
+			pwd = i
+		} else {
+			assert.Equal(t, "NOOP", cmd)
+		}
+	}
+	assert.GreaterOrEqual(t, pwd, cap(noops), "NOOP commands must be sent before PWD")
+	assert.Equal(t, "QUIT", commands[len(commands)-1])
+}
+
+func TestKeepAliveServiceClosing(t *testing.T) {
+	noop := make(chan struct{})
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"NOOP": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("421 Timeout.")
+			close(noop)
+			return true
+		},
+	}, DialWithKeepAlive(50*time.Millisecond))
+
+	<-noop
+
+	// The 421 reply to the NOOP is not taken for a broken connection
+	_, err := c.CurrentDir()
+	assert.ErrorIs(t, err, ErrServiceClosing)
+	assert.ErrorIs(t, c.Quit(), ErrServiceClosing)
+	mock.Wait()
+}
+
+func TestFileSizeErrors(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SIZE": func(mock *ftpMock, cmdParts []string) bool {
+			if cmdParts[1] == "missing" {
+				mock.printfLine("550 missing: No such file or directory")
+			} else {
+				mock.printfLine("550 secret: Permission denied")
+			}
+			return true
+		},
+	})
+
+	_, err := c.FileSize("missing")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	assert.NotErrorIs(t, err, ErrPermission)
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusFileUnavailable, protoErr.Code)
+	}
+
+	_, err = c.FileSize("secret")
+	assert.ErrorIs(t, err, ErrPermission)
+	assert.NotErrorIs(t, err, ErrFileNotFound)
+	assert.ErrorAs(t, err, &protoErr)
+
+	closeConn(t, mock, c, []string{"SIZE", "SIZE"})
+}
+
+func TestFileSizeInAsciiMode(t *testing.T) {
+	binary := true
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"TYPE": func(mock *ftpMock, cmdParts []string) bool {
+			binary = cmdParts[1] == "I"
+			return false
+		},
+		"SIZE": func(mock *ftpMock, cmdParts []string) bool {
+			if !binary {
+				mock.printfLine("550 SIZE not allowed in ASCII mode")
+				return true
+			}
+			return false
+		},
+	})
+
+	assert.NoError(t, c.Type(TransferTypeASCII))
+
+	size, err := c.FileSize("magic-file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), size)
+	assert.False(t, binary, "the ASCII mode must be restored")
+
+	closeConn(t, mock, c, []string{"TYPE", "TYPE", "SIZE", "TYPE"})
+}
+
+func TestFileSizeTypeUnchanged(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+
+	// Binary, as set by Login
+	_, err := c.FileSize("magic-file")
+	assert.NoError(t, err)
+
+	// Unknown, taken for binary
+	c.transferType = ""
+	_, err = c.FileSize("magic-file")
+	assert.NoError(t, err)
+
+	closeConn(t, mock, c, []string{"SIZE", "SIZE"})
+}
+
+func TestAsciiTransfers(t *testing.T) {
+	var types []string
+	handlers := map[string]mockHandler{
+		"TYPE": func(mock *ftpMock, cmdParts []string) bool {
+			types = append(types, cmdParts[1])
+			return false
+		},
+		"STOR": func(mock *ftpMock, cmdParts []string) bool {
+			if cmdParts[1] != "denied" {
+				return false
+			}
+			mock.dataConn.Wait()
+			mock.closeDataConn()
+			mock.printfLine("550 Permission denied")
+			return true
+		},
+	}
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", handlers)
+
+	assert.NoError(t, c.StorAscii("file", bytes.NewBufferString(testData)))
+
+	r, err := c.RetrAscii("file")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(buf))
+		assert.NoError(t, r.Close())
+	}
+
+	assert.Error(t, c.StorAscii("denied", bytes.NewBufferString(testData)))
+
+	closeConn(t, mock, c, []string{
+		"TYPE", "EPSV", "STOR", "TYPE",
+		"TYPE", "EPSV", "RETR", "TYPE",
+		"TYPE", "EPSV", "STOR", "TYPE",
+	})
+	assert.Equal(t, []string{"I", "A", "I", "A", "I", "A", "I"}, types)
+
+	// No switch is needed when ASCII is the default
+	types = nil
+	mock, c = openConnHandlers(t, "127.0.0.1", "no-time", handlers, DialWithTransferType(TransferTypeASCII))
+
+	assert.NoError(t, c.StorAscii("file", bytes.NewBufferString(testData)))
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR"})
+	assert.Equal(t, []string{"A"}, types)
+}
+
+func TestStats(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+
+	assert.NoError(t, c.Stor("file", strings.NewReader(testData)))
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		_, err = io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+	}
+
+	stats := c.Stats()
+	assert.Equal(t, int64(len(testData)), stats.BytesSent)
+	assert.Equal(t, int64(len(testData)), stats.BytesReceived)
+	// USER, PASS, FEAT, TYPE and OPTS are sent by Dial
+	assert.Equal(t, 9, stats.CommandsSent)
+	assert.Positive(t, stats.Uptime)
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR", "EPSV", "RETR"})
+}
+
+func TestStorText(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+
+	assert.NoError(t, c.StorText("file", strings.NewReader("first\nsecond\r\nthird"), ""))
+	assert.Equal(t, "first\r\nsecond\r\nthird", mock.fileCont.String())
+
+	assert.NoError(t, c.StorText("file", strings.NewReader("first\nsecond\r\n"), "\n"))
+	assert.Equal(t, "first\nsecond\n", mock.fileCont.String())
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR", "EPSV", "STOR"})
+}
+
+func TestAppendVerified(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SIZE": func(mock *ftpMock, cmdParts []string) bool {
+			if mock.fileCont == nil {
+				mock.printfLine("550 Could not get file size.")
+			} else {
+				mock.printfLine("213 %d", mock.fileCont.Len())
+			}
+			return true
+		},
+	})
+
+	size, err := c.AppendVerified("log", bytes.NewBufferString(testData), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(testData)), size)
+
+	size, err = c.AppendVerified("log", bytes.NewBufferString(testData), 0)
+	assert.ErrorIs(t, err, ErrAppendSizeMismatch)
+	assert.Equal(t, int64(len(testData)), size)
+
+	size, err = c.AppendVerified("log", bytes.NewBufferString(testData), int64(len(testData)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*len(testData)), size)
+
+	closeConn(t, mock, c, []string{"SIZE", "EPSV", "APPE", "SIZE", "SIZE", "SIZE", "EPSV", "APPE", "SIZE"})
+}
+
+func TestStorResume(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SIZE": func(mock *ftpMock, cmdParts []string) bool {
+			if mock.fileCont == nil {
+				mock.printfLine("550 Could not get file size.")
+			} else {
+				mock.printfLine("213 %d", mock.fileCont.Len())
+			}
+			return true
+		},
+		"STOR": func(mock *ftpMock, cmdParts []string) bool {
+			if mock.rest == 0 {
+				return false
+			}
+			mock.fileCont.Truncate(mock.rest)
+			mock.rest = 0
+			mock.printfLine("150 please send")
+			mock.recvDataConn(true)
+			return true
+		},
+	})
+
+	// A missing file is uploaded from the start
+	size, err := c.StorResume("file", strings.NewReader(testData))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(testData)), size)
+
+	for _, r := range []io.Reader{
+		strings.NewReader(testData),
+		struct{ io.Reader }{strings.NewReader(testData)}, // not an io.Seeker
+	} {
+		assert.NoError(t, c.Stor("file", strings.NewReader(testData[:10])))
+
+		size, err = c.StorResume("file", r)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(testData)), size)
+
+		resp, err := c.Retr("file")
+		if assert.NoError(t, err) {
+			buf, err := io.ReadAll(resp)
+			assert.NoError(t, err)
+			assert.Equal(t, testData, string(buf))
+			assert.NoError(t, resp.Close())
+		}
+	}
+
+	// The remote file is larger than the content, whatever the io.Reader
+	for _, r := range []io.Reader{
+		strings.NewReader(testData[:10]),
+		struct{ io.Reader }{strings.NewReader(testData[:10])}, // not an io.Seeker
+	} {
+		_, err = c.StorResume("file", r)
+		assert.ErrorIs(t, err, ErrRemoteFileLarger)
+	}
+
+	closeConn(t, mock, c, []string{
+		"SIZE", "EPSV", "STOR", "SIZE",
+		"EPSV", "STOR", "SIZE", "EPSV", "REST", "STOR", "SIZE", "EPSV", "RETR",
+		"EPSV", "STOR", "SIZE", "EPSV", "REST", "STOR", "SIZE", "EPSV", "RETR",
+		"SIZE", "SIZE",
+	})
+}
+
+func TestRetrSegmented(t *testing.T) {
+	content := strings.Repeat(testData, 1000)
+	handlers := map[string]mockHandler{
+		"SIZE": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("213 %d", len(content))
+			return true
+		},
+		"ABOR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("226 Abort successful")
+			return true
+		},
+	}
+
+	// Every control connection is served by its own mock
+	var mu sync.Mutex
+	var mocks []*ftpMock
+	f := func(network, address string) (net.Conn, error) {
+		if address != "ftp.example.org:21" {
+			return net.Dial(network, address)
+		}
+		mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", handlers)
+		if err != nil {
+			return nil, err
+		}
+		defer mock.Close()
+		mock.fileCont = bytes.NewBufferString(content)
+
+		mu.Lock()
+		mocks = append(mocks, mock)
+		mu.Unlock()
+		return net.Dial(network, mock.Addr())
+	}
+
+	c, err := Dial("ftp.example.org:21", DialWithDialFunc(f), DialWithStoredCredentials())
+	require.NoError(t, err)
+	require.NoError(t, c.Login("anonymous", "anonymous"))
+
+	w := tempFile(t, nil)
+	require.NoError(t, c.RetrSegmented("magic-file", w, 4))
+
+	buf, err := os.ReadFile(w.Name())
+	require.NoError(t, err)
+	assert.Equal(t, content, string(buf))
+
+	require.Len(t, mocks, 5)
+	closeConn(t, mocks[0], c, []string{"SIZE", "PWD"})
+	for _, mock := range mocks[1:] {
+		mock.Wait()
+		assert.Contains(t, mock.commands, "CWD")
+		assert.Contains(t, mock.commands, "RETR")
+		assert.Equal(t, "QUIT", mock.commands[len(mock.commands)-1])
+	}
+}
+
+func TestRetrSegmentedFailure(t *testing.T) {
+	content := strings.Repeat(testData, 1000)
+	segSize := (len(content) + 3) / 4
+	handlers := map[string]mockHandler{
+		"SIZE": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("213 %d", len(content))
+			return true
+		},
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			if mock.rest == 2*segSize {
+				mock.printfLine("550 Segment failed")
+				mock.closeDataConn()
+				return true
+			}
+
+			// The other segments hang until they are stopped
+			mock.printfLine("150 Opening data connection")
+			_, _ = io.Copy(io.Discard, mock.dataConn.conn)
+			mock.closeDataConn()
+			return true
+		},
+	}
+
+	// Every control connection is served by its own mock
+	var mu sync.Mutex
+	var mocks []*ftpMock
+	f := func(network, address string) (net.Conn, error) {
+		if address != "ftp.example.org:21" {
+			return net.Dial(network, address)
+		}
+		mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", handlers)
+		if err != nil {
+			return nil, err
+		}
+		defer mock.Close()
+
+		mu.Lock()
+		mocks = append(mocks, mock)
+		mu.Unlock()
+		return net.Dial(network, mock.Addr())
+	}
+
+	c, err := Dial("ftp.example.org:21", DialWithDialFunc(f), DialWithStoredCredentials())
+	require.NoError(t, err)
+	require.NoError(t, c.Login("anonymous", "anonymous"))
+
+	// The error of the failed segment is returned once the others stopped
+	err = c.RetrSegmented("magic-file", tempFile(t, nil), 4)
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusFileUnavailable, protoErr.Code)
+	}
+
+	require.Len(t, mocks, 5)
+	closeConn(t, mocks[0], c, []string{"SIZE", "PWD"})
+
+	// Every cloned connection was quit or closed
+	for _, mock := range mocks[1:] {
+		mock.Wait()
+		if mock.rest == 2*segSize {
+			assert.Equal(t, "QUIT", mock.commands[len(mock.commands)-1])
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	// Every control connection is served by its own mock
+	var mocks []*ftpMock
+	var cwd string
+	handlers := map[string]mockHandler{
+		"PWD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine(`257 "/pub/data" is the current directory`)
+			return true
+		},
+		"CWD": func(mock *ftpMock, cmdParts []string) bool {
+			cwd = mock.lastFull
+			return false
+		},
+	}
+	f := func(network, address string) (net.Conn, error) {
+		mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", handlers)
+		if err != nil {
+			return nil, err
+		}
+		defer mock.Close()
+
+		mocks = append(mocks, mock)
+		return net.Dial(network, mock.Addr())
+	}
+
+	c, err := Dial("ftp.example.org:21", DialWithDialFunc(f), DialWithStoredCredentials())
+	require.NoError(t, err)
+	require.NoError(t, c.Login("anonymous", "secret"))
+
+	clone, err := c.Clone()
+	require.NoError(t, err)
+	require.NoError(t, clone.Quit())
+	require.NoError(t, c.Quit())
+
+	require.Len(t, mocks, 2)
+	mocks[0].Wait()
+	mocks[1].Wait()
+	assert.Equal(t, []string{"USER", "PASS", "FEAT", "TYPE", "OPTS", "PWD", "QUIT"}, mocks[0].commands)
+	assert.Equal(t, []string{"USER", "PASS", "FEAT", "TYPE", "OPTS", "CWD", "QUIT"}, mocks[1].commands)
+	assert.Equal(t, "CWD /pub/data", cwd)
+}
+
+func TestCloneAfterDialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Write([]byte("220 Ready\r\n")); err != nil {
+					return
+				}
+				_, _ = textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+				_, _ = conn.Write([]byte("221 Goodbye\r\n"))
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c, err := Dial(l.Addr().String(), DialWithContext(ctx))
+	require.NoError(t, err)
+
+	// The context is only used to open the first connection
+	<-ctx.Done()
+	clone, err := c.Clone()
+	require.NoError(t, err)
+	assert.NoError(t, clone.Quit())
+	assert.NoError(t, c.Quit())
+}
+
+func TestCloneWithoutStoredCredentials(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+	assert.Empty(t, c.password)
+
+	_, err := c.Clone()
+	assert.ErrorIs(t, err, ErrCredentialsNotStored)
+	assert.ErrorIs(t, c.RetrSegmented("magic-file", nil, 2), ErrCredentialsNotStored)
+
+	closeConn(t, mock, c, nil)
+}
+
+func TestPRET(t *testing.T) {
+	var prets []string
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"PRET": func(mock *ftpMock, cmdParts []string) bool {
+			prets = append(prets, mock.lastFull)
+			mock.printfLine("200 OK, will use master for upcoming transfer")
+			return true
+		},
+	}, DialWithPRET(true))
+
+	assert.NoError(t, c.Stor("file", strings.NewReader(testData)))
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		assert.NoError(t, r.Close())
+	}
+	_, err = c.NameList("/")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"PRET STOR file", "PRET RETR file", "PRET NLST /"}, prets)
+	closeConn(t, mock, c, []string{
+		"PRET", "EPSV", "STOR",
+		"PRET", "EPSV", "RETR",
+		"PRET", "EPSV", "NLST",
+	})
+}
+
+func TestPRETRejected(t *testing.T) {
+	handlers := map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n UTF8\r\n EPSV\r\n PRET\r\n211 End")
+			return true
+		},
+		"PRET": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("500 Unknown command PRET.")
+			return true
+		},
+	}
+
+	// The reply is ignored for servers advertising PRET
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", handlers)
+	_, err := c.NameList("/")
+	assert.NoError(t, err)
+	closeConn(t, mock, c, []string{"PRET", "EPSV", "NLST"})
+
+	mock, c = openConnHandlers(t, "127.0.0.1", "no-time", handlers, DialWithPRET(true))
+	_, err = c.NameList("/")
+	assert.Error(t, err)
+	closeConn(t, mock, c, []string{"PRET"})
+}
+
+func TestResolveSymlink(t *testing.T) {
+	listings := map[string]string{
+		"/pub": "lrwxrwxrwx   1 ftp      ftp             6 Jan 25 00:17 latest -> v2/app\r\n" +
+			"lrwxrwxrwx   1 ftp      ftp             4 Jan 25 00:17 loop -> loop\r\n",
+		"/pub/v2": "lrwxrwxrwx   1 ftp      ftp            13 Jan 25 00:17 app -> /data/app.bin\r\n",
+		"/data":   "-rw-r--r--   1 ftp      ftp            14 Jan 25 00:17 app.bin\r\n",
+	}
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n UTF8\r\n EPSV\r\n211 End")
+			return true
+		},
+		"LIST": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte(listings[cmdParts[1]]))
+			return true
+		},
+	})
+
+	entries, err := c.List("/pub")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// Relative then absolute target
+	entry, err := c.ResolveSymlink(entries[0], "/pub")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "app.bin", entry.Name)
+		assert.Equal(t, uint64(14), entry.Size)
+	}
+
+	_, err = c.ResolveSymlink(entries[1], "/pub")
+	assert.ErrorIs(t, err, ErrSymlinkLoop)
+
+	mock.fileCont = bytes.NewBufferString(testData)
+	r, err := c.RetrFollow("/pub/latest")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(buf))
+		assert.NoError(t, r.Close())
+	}
+	assert.Equal(t, "RETR /data/app.bin", mock.lastFull)
+
+	commands := []string{"EPSV", "LIST", "EPSV", "LIST", "EPSV", "LIST"}
+	for i := 0; i < maxSymlinkDepth; i++ {
+		commands = append(commands, "EPSV", "LIST")
+	}
+	commands = append(commands, "EPSV", "LIST", "EPSV", "LIST", "EPSV", "LIST", "EPSV", "RETR")
+	closeConn(t, mock, c, commands)
+}
+
+func TestWithoutInitialProbe(t *testing.T) {
+	// The server drops the connection on FEAT
+	mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			_ = mock.proto.Close()
+			return true
+		},
+	})
+	require.NoError(t, err)
+	defer mock.Close()
+
+	c, err := Dial(mock.Addr(), DialWithoutInitialProbe())
+	require.NoError(t, err)
+	require.NoError(t, c.Login("anonymous", "anonymous"))
+
+	_, err = c.List("/")
+	assert.NoError(t, err)
+	assert.Equal(t, ListMethodLIST, c.ListedWith())
+
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "PASS", "TYPE", "EPSV", "LIST", "QUIT"}, mock.commands)
+}
+
+func TestFeatures(t *testing.T) {
+	mock, err := newFtpMock(t, "127.0.0.1")
+	require.NoError(t, err)
+	defer mock.Close()
+
+	c, err := Dial(mock.Addr(), DialWithoutInitialProbe())
+	require.NoError(t, err)
+	require.NoError(t, c.Login("anonymous", "anonymous"))
+
+	features, err := c.Features()
+	require.NoError(t, err)
+	assert.Contains(t, features, "MLST")
+
+	_, err = c.List("/")
+	assert.NoError(t, err)
+	assert.Equal(t, ListMethodMLSD, c.ListedWith())
+
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "PASS", "TYPE", "FEAT", "EPSV", "MLSD", "QUIT"}, mock.commands)
+}
+
+func TestReadWriteFile(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"ABOR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("226 Abort successful")
+			return true
+		},
+	}, DialWithMaxReadFileSize(int64(len(testData))))
+
+	assert.NoError(t, c.WriteFile("file", []byte(testData)))
+	data, err := c.ReadFile("file")
+	assert.NoError(t, err)
+	assert.Equal(t, testData, string(data))
+
+	assert.NoError(t, c.WriteFile("file", []byte(testData+"!")))
+	_, err = c.ReadFile("file")
+	assert.ErrorIs(t, err, ErrFileTooLarge)
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR", "EPSV", "RETR", "EPSV", "STOR", "EPSV", "RETR", "ABOR"})
+}
+
+func TestReadFileMaxSize(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1", DialWithMaxReadFileSize(math.MaxInt64))
+
+	assert.NoError(t, c.WriteFile("file", []byte(testData)))
+	data, err := c.ReadFile("file")
+	assert.NoError(t, err)
+	assert.Equal(t, testData, string(data))
+
+	closeConn(t, mock, c, []string{"EPSV", "STOR", "EPSV", "RETR"})
+
+	mock, c = openConn(t, "127.0.0.1", DialWithMaxReadFileSize(-1))
+
+	_, err = c.ReadFile("file")
+	assert.Error(t, err)
+
+	closeConn(t, mock, c, nil)
+}
+
+func TestTransientRetry(t *testing.T) {
+	failures := map[string]int{"RETR": 2, "SIZE": 2, "STOR": 1}
+	fail := func(mock *ftpMock, cmdParts []string) bool {
+		if failures[cmdParts[0]] == 0 {
+			return false
+		}
+		failures[cmdParts[0]]--
+
+		if mock.dataConn != nil {
+			mock.dataConn.Wait()
+			mock.closeDataConn()
+		}
+		if cmdParts[0] == "SIZE" {
+			mock.printfLine("450 Requested file action not taken")
+		} else {
+			mock.printfLine("425 Can't open data connection")
+		}
+		return true
+	}
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"RETR": fail,
+		"SIZE": fail,
+		"STOR": fail,
+	}, DialWithTransientRetry(3, time.Millisecond))
+
+	// Uploads are not retried
+	assert.Error(t, c.Stor("file", strings.NewReader(testData)))
+	assert.NoError(t, c.Stor("file", strings.NewReader(testData)))
+
+	r, err := c.Retr("file")
+	if assert.NoError(t, err) {
+		buf, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, string(buf))
+		assert.NoError(t, r.Close())
+	}
+
+	_, err = c.FileSize("magic-file")
+	assert.NoError(t, err)
+
+	closeConn(t, mock, c, []string{
+		"EPSV", "STOR", "EPSV", "STOR",
+		"EPSV", "RETR", "EPSV", "RETR", "EPSV", "RETR",
+		"SIZE", "SIZE", "SIZE",
+	})
+}
+
+func TestDataProtectionLevel(t *testing.T) {
+	var prots []string
+	handlers := map[string]mockHandler{
+		"PBSZ": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("200 PBSZ=0")
+			return true
+		},
+		"PROT": func(mock *ftpMock, cmdParts []string) bool {
+			prots = append(prots, cmdParts[1])
+			mock.printfLine("200 Protection level set")
+			return true
+		},
+	}
+
+	// The custom dial function keeps the connections in clear
+	for _, level := range []ProtLevel{"", ProtLevelClear} {
+		mock, c := openConnHandlers(t, "127.0.0.1", "no-time", handlers,
+			DialWithDialFunc(net.Dial),
+			DialWithTLS(&tls.Config{}),
+			DialWithDataProtectionLevel(level),
+		)
+		closeConn(t, mock, c, []string{"PBSZ", "PROT"})
+	}
+
+	assert.Equal(t, []string{"P", "C"}, prots)
+}
+
+func TestAbsPath(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"PWD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine(`257 "/pub/""quoted"" dir" is the current directory`)
+			return true
+		},
+	})
+
+	dir, err := c.CurrentDir()
+	assert.NoError(t, err)
+	assert.Equal(t, `/pub/"quoted" dir`, dir)
+
+	p, err := c.AbsPath("../file")
+	assert.NoError(t, err)
+	assert.Equal(t, "/pub/file", p)
+
+	p, err = c.AbsPath("/other/./file")
+	assert.NoError(t, err)
+	assert.Equal(t, "/other/file", p)
+
+	closeConn(t, mock, c, []string{"PWD", "PWD"})
+}
+
+func TestStorWithSize(t *testing.T) {
+	var allocs []string
+	handlers := map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n UTF8\r\n EPSV\r\n ALLO\r\n211 End")
+			return true
+		},
+		"ALLO": func(mock *ftpMock, cmdParts []string) bool {
+			allocs = append(allocs, cmdParts[1])
+			switch cmdParts[1] {
+			case "14":
+				mock.printfLine("202 No storage allocation necessary")
+			default:
+				mock.printfLine("552 Quota exceeded")
+			}
+			return true
+		},
+	}
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", handlers)
+
+	assert.NoError(t, c.StorWithSize("file", strings.NewReader(testData), int64(len(testData))))
+	assert.Equal(t, testData, mock.fileCont.String())
+
+	err := c.StorWithSize("big", strings.NewReader(testData), 1<<40)
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusExceededStorage, protoErr.Code)
+	}
+
+	assert.Equal(t, []string{"14", "1099511627776"}, allocs)
+	closeConn(t, mock, c, []string{"ALLO", "EPSV", "STOR", "ALLO"})
+
+	// ALLO is not sent if not advertised
+	mock, c = openConn(t, "127.0.0.1")
+	assert.NoError(t, c.StorWithSize("file", strings.NewReader(testData), int64(len(testData))))
+	closeConn(t, mock, c, []string{"EPSV", "STOR"})
+}
+
+func TestListFile(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.dataConn.Wait()
+			mock.closeDataConn()
+			mock.printfLine("501 Not a directory")
+			return true
+		},
+	})
+
+	entries, err := c.List("magic-file")
+	if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+		assert.Equal(t, "magic-file", entries[0].Name)
+		assert.Equal(t, uint64(42), entries[0].Size)
+	}
+	closeConn(t, mock, c, []string{"EPSV", "MLSD", "MLST"})
+
+	// Without MLST, LIST describes the file
+	mock, c = openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n UTF8\r\n EPSV\r\n211 End")
+			return true
+		},
+		"LIST": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte("-rw-r--r--   1 ftp      ftp            42 Jan 25 00:17 magic-file\r\n"))
+			return true
+		},
+	})
+
+	entries, err = c.List("magic-file")
+	if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+		assert.Equal(t, "magic-file", entries[0].Name)
+		assert.Equal(t, uint64(42), entries[0].Size)
+	}
+	closeConn(t, mock, c, []string{"EPSV", "LIST"})
+}
+
+func TestClientName(t *testing.T) {
+	var names []string
+	handlers := map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n UTF8\r\n EPSV\r\n CLNT\r\n211 End")
+			return true
+		},
+		"CLNT": func(mock *ftpMock, cmdParts []string) bool {
+			names = append(names, strings.Join(cmdParts[1:], " "))
+			mock.printfLine("500 Unknown command")
+			return true
+		},
+	}
+
+	mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", handlers)
+	require.NoError(t, err)
+	defer mock.Close()
+
+	c, err := Dial(mock.Addr(), DialWithClientName("my client 1.0"))
+	require.NoError(t, err)
+	require.NoError(t, c.Login("anonymous", "anonymous"))
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+	assert.Equal(t, []string{"USER", "PASS", "FEAT", "CLNT", "TYPE", "OPTS", "QUIT"}, mock.commands)
+	assert.Equal(t, []string{"my client 1.0"}, names)
+
+	// CLNT is not sent if not advertised
+	mock, c = openConn(t, "127.0.0.1", DialWithClientName("my client 1.0"))
+	closeConn(t, mock, c, nil)
+}
+
+func TestVerifyDownloadSize(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SIZE": func(mock *ftpMock, cmdParts []string) bool {
+			if cmdParts[1] == "unknown" {
+				return false
+			}
+			mock.printfLine("213 %d", len(testData))
+			return true
+		},
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			// The data connection closes early
+			if cmdParts[1] == "truncated" {
+				mock.sendDataConn([]byte(testData[:5]))
+			} else {
+				mock.sendDataConn([]byte(testData))
+			}
+			return true
+		},
+	}, DialWithVerifyDownloadSize())
+
+	retr := func(path string) error {
+		r, err := c.Retr(path)
+		require.NoError(t, err)
+		_, err = io.ReadAll(r)
+		assert.NoError(t, err)
+		return r.Close()
+	}
+
+	assert.NoError(t, retr("file"))
+	assert.ErrorIs(t, retr("truncated"), ErrTruncatedTransfer)
+	assert.NoError(t, retr("unknown"))
+
+	closeConn(t, mock, c, []string{
+		"SIZE", "EPSV", "RETR",
+		"SIZE", "EPSV", "RETR",
+		"SIZE", "EPSV", "RETR",
+	})
+}
+
+func TestUTF8BeforeLogin(t *testing.T) {
+	for _, tC := range []struct {
+		loggedIn bool // OPTS is refused before login
+		commands []string
+	}{
+		{false, []string{"OPTS", "USER", "PASS", "FEAT", "TYPE", "QUIT"}},
+		{true, []string{"OPTS", "USER", "PASS", "FEAT", "TYPE", "OPTS", "QUIT"}},
+	} {
+		logged := false
+		mock, err := newFtpMockHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+			"PASS": func(mock *ftpMock, cmdParts []string) bool {
+				logged = true
+				return false
+			},
+			"OPTS": func(mock *ftpMock, cmdParts []string) bool {
+				if tC.loggedIn && !logged {
+					mock.printfLine("530 Please login with USER and PASS")
+					return true
+				}
+				return false
+			},
+		})
+		require.NoError(t, err)
+		defer mock.Close()
+
+		c, err := Dial(mock.Addr(), DialWithUTF8BeforeLogin())
+		require.NoError(t, err)
+		require.NoError(t, c.Login("anonymous", "anonymous"))
+		assert.NoError(t, c.Quit())
+		mock.Wait()
+		assert.Equal(t, tC.commands, mock.commands)
+	}
+}
+
+func TestMaxListEntries(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			var listing strings.Builder
+			for i := 0; i < 10; i++ {
+				fmt.Fprintf(&listing, "Type=file;Size=%d; file%d\r\n", i, i)
+			}
+			mock.sendDataConn([]byte(listing.String()))
+			return true
+		},
+		"ABOR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("226 Abort successful")
+			return true
+		},
+	}, DialWithMaxListEntries(5))
+
+	entries, err := c.List("/")
+	assert.ErrorIs(t, err, ErrTooManyEntries)
+	if assert.Len(t, entries, 5) {
+		assert.Equal(t, "file4", entries[4].Name)
+	}
+
+	// The control connection is still usable
+	assert.NoError(t, c.NoOp())
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD", "ABOR", "NOOP"})
+}
+
+func TestMaxListEntriesTotalLine(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			listing := "total 5\r\nType=cdir; .\r\n\r\n"
+			for i := 0; i < 5; i++ {
+				listing += fmt.Sprintf("Type=file;Size=%d; file%d\r\n", i, i)
+			}
+			mock.sendDataConn([]byte(listing))
+			return true
+		},
+	}, DialWithMaxListEntries(5))
+
+	// Only the entries count, not the total, blank and dot lines
+	entries, err := c.List("/")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 6)
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD"})
+}
+
+func TestReinit(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1")
+	assert.True(t, c.mlstSupported)
+
+	assert.NoError(t, c.Reinit())
+	assert.Empty(t, c.features)
+	assert.False(t, c.mlstSupported)
+	assert.Equal(t, TransferType(""), c.transferType)
+	assert.Empty(t, c.user)
+
+	assert.NoError(t, c.Login("anonymous", "anonymous"))
+	assert.True(t, c.mlstSupported)
+	assert.Equal(t, TransferTypeBinary, c.transferType)
+
+	closeConn(t, mock, c, []string{"REIN", "USER", "PASS", "FEAT", "TYPE", "OPTS"})
+
+	mock, c = openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"REIN": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("502 Command not implemented")
+			return true
+		},
+	})
+
+	err := c.Reinit()
+	assert.ErrorIs(t, err, ErrReinitUnsupported)
+	var protoErr *textproto.Error
+	if assert.ErrorAs(t, err, &protoErr) {
+		assert.Equal(t, StatusNotImplemented, protoErr.Code)
+	}
+	assert.True(t, c.mlstSupported, "the state must be kept")
+
+	closeConn(t, mock, c, []string{"REIN"})
+}
+
+func TestMakeDirPath(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MKD": func(mock *ftpMock, cmdParts []string) bool {
+			switch cmdParts[1] {
+			case "quoted":
+				mock.printfLine(`257 "/home/user/say ""hi""" created`)
+			case "existing":
+				mock.printfLine("550 existing: File exists")
+			default:
+				return false
+			}
+			return true
+		},
+	})
+
+	created, err := c.MakeDirPath("quoted")
+	assert.NoError(t, err)
+	assert.Equal(t, `/home/user/say "hi"`, created)
+
+	created, err = c.MakeDirPath("unquoted")
+	assert.NoError(t, err)
+	assert.Equal(t, "unquoted", created, "the given path must be returned")
+
+	_, err = c.MakeDirPath("existing")
+	assert.Error(t, err)
+
+	closeConn(t, mock, c, []string{"MKD", "MKD", "MKD"})
+}
+
+func TestSystem(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"SYST": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("215 Windows_NT")
+			return true
+		},
+	}, DialWithDisabledMLSD(true))
+	assert.Nil(t, c.parserOrder())
+
+	system, err := c.System()
+	assert.NoError(t, err)
+	assert.Equal(t, "Windows_NT", system)
+
+	// The reply is cached
+	system, err = c.System()
+	assert.NoError(t, err)
+	assert.Equal(t, "Windows_NT", system)
+
+	if order := c.parserOrder(); assert.NotEmpty(t, order) {
+		assert.Equal(t, ParserDOS, order[0])
+	}
+
+	closeConn(t, mock, c, []string{"SYST"})
+}
+
+// slowConn delays the reads, like a connection with a high latency.
+type slowConn struct {
+	net.Conn
+	latency time.Duration
+}
+
+func (c *slowConn) Read(p []byte) (int, error) {
+	time.Sleep(c.latency)
+	return c.Conn.Read(p)
+}
+
+func TestDeleteAll(t *testing.T) {
+	dialFunc := func(network, address string) (net.Conn, error) {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &slowConn{Conn: conn, latency: 5 * time.Millisecond}, nil
+	}
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"DELE": func(mock *ftpMock, cmdParts []string) bool {
+			if strings.HasPrefix(cmdParts[1], "missing") {
+				mock.printfLine("550 %s: No such file or directory", cmdParts[1])
+				return true
+			}
+			return false
+		},
+	}, DialWithDialFunc(dialFunc))
+
+	var paths []string
+	for i := 0; i < 40; i++ {
+		if i%10 == 3 {
+			paths = append(paths, fmt.Sprintf("missing-%d", i))
+		} else {
+			paths = append(paths, fmt.Sprintf("file-%d", i))
+		}
+	}
+
+	start := time.Now()
+	for _, path := range paths {
+		if err := c.Delete(path); err != nil {
+			assert.True(t, strings.HasPrefix(path, "missing"))
+		}
+	}
+	serial := time.Since(start)
+
+	start = time.Now()
+	err := c.DeleteAll(paths)
+	pipelined := time.Since(start)
+	assert.Less(t, int64(pipelined), int64(serial/2), "pipelined in %s, serial in %s", pipelined, serial)
+
+	var merr *multierror.Error
+	if assert.ErrorAs(t, err, &merr) && assert.Len(t, merr.Errors, 4) {
+		for i, err := range merr.Errors {
+			var pathErr *fs.PathError
+			if assert.ErrorAs(t, err, &pathErr) {
+				assert.Equal(t, fmt.Sprintf("missing-%d", i*10+3), pathErr.Path)
+			}
+			assert.ErrorIs(t, err, ErrFileNotFound)
+		}
+	}
+
+	// The control connection must be in sync
+	assert.NoError(t, c.NoOp())
+
+	cmds := make([]string, 0, 2*len(paths)+1)
+	for i := 0; i < 2*len(paths); i++ {
+		cmds = append(cmds, "DELE")
+	}
+	closeConn(t, mock, c, append(cmds, "NOOP"))
+}
+
+func TestDialWithCWDCache(t *testing.T) {
+	mock, c := openConn(t, "127.0.0.1", DialWithCWDCache())
+
+	assert.NoError(t, c.ChangeDir("/pub"))
+	assert.NoError(t, c.ChangeDir("/pub/"))
+	assert.NoError(t, c.ChangeDir("data"))
+	assert.NoError(t, c.ChangeDir("/pub/data"))
+
+	// The directory is forgotten on error
+	assert.Error(t, c.ChangeDir("missing-dir"))
+	assert.NoError(t, c.ChangeDir("/pub/data"))
+	assert.Equal(t, "CWD /pub/data", mock.lastFull)
+
+	// After "..", the server may not be in the lexical parent, eg. if data
+	// is a symbolic link
+	assert.NoError(t, c.ChangeDir(".."))
+	assert.NoError(t, c.ChangeDir("/pub"))
+	assert.Equal(t, "CWD /pub", mock.lastFull)
+	assert.NoError(t, c.ChangeDir("/pub/data/../data"))
+	assert.NoError(t, c.ChangeDir("/pub/data"))
+	assert.Equal(t, "CWD /pub/data", mock.lastFull)
+
+	closeConn(t, mock, c, []string{"CWD", "CWD", "CWD", "CWD", "CWD", "CWD", "CWD", "CWD"})
+}
+
+func TestFS(t *testing.T) {
+	listings := map[string]string{
+		"/":    "type=cdir; /\r\ntype=dir;modify=20201213202400; pub\r\ntype=file;size=5;modify=20201213202400; readme\r\n",
+		"/pub": "type=cdir; /pub\r\ntype=pdir; /\r\ntype=file;size=4;modify=20201213202400; data.bin\r\n",
+	}
+	facts := map[string]string{
+		"/pub":          "type=dir;modify=20201213202400;",
+		"/readme":       "type=file;size=5;modify=20201213202400;",
+		"/pub/data.bin": "type=file;size=4;modify=20201213202400;",
+	}
+	contents := map[string]string{
+		"/readme":       "hello",
+		"/pub/data.bin": "data",
+	}
+
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte(listings[cmdParts[1]]))
+			return true
+		},
+		"MLST": func(mock *ftpMock, cmdParts []string) bool {
+			if f, ok := facts[cmdParts[1]]; ok {
+				mock.printfLine("250-File data\r\n %s %s\r\n250 End", f, cmdParts[1])
+			} else {
+				mock.printfLine("550 No such file or directory")
+			}
+			return true
+		},
+		"RETR": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte(contents[cmdParts[1]]))
+			return true
+		},
+	})
+
+	fsys := c.FS()
+
+	var walked []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{".", "pub", "pub/data.bin", "readme"}, walked)
+
+	data, err := fs.ReadFile(fsys, "pub/data.bin")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "data", string(data))
+	}
+
+	info, err := fs.Stat(fsys, "readme")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "readme", info.Name())
+		assert.Equal(t, int64(5), info.Size())
+		assert.False(t, info.IsDir())
+	}
+
+	_, err = fsys.Open("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	var pathErr *fs.PathError
+	if assert.ErrorAs(t, err, &pathErr) {
+		assert.Equal(t, "missing", pathErr.Path)
+	}
+
+	_, err = fsys.Open("../etc")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	assert.NoError(t, c.Quit())
+	mock.Wait()
+}
+
+func TestFeatEmbeddedCode(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"FEAT": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("211-Features:\r\n EPSV\r\n  211 custom feature\r\n SIZE\r\n UTF8\r\n211 End")
+			return true
+		},
+	})
+
+	for _, feature := range []string{"EPSV", "211", "SIZE", "UTF8"} {
+		assert.Contains(t, c.features, feature)
+	}
+	assert.Equal(t, "custom feature", c.features["211"])
+
+	closeConn(t, mock, c, nil)
+}
+
+func TestVerifyChdir(t *testing.T) {
+	var cwd atomic.Value
+	cwd.Store("/incoming")
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"CWD": func(mock *ftpMock, cmdParts []string) bool {
+			switch cmdParts[1] {
+			case "lie":
+			case "/link":
+				cwd.Store("/real/target")
+			default:
+				cwd.Store(path.Join(cwd.Load().(string), cmdParts[1]))
+			}
+			mock.printfLine("250 Directory successfully changed.")
+			return true
+		},
+		"PWD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("257 \"%s\"", cwd.Load())
+			return true
+		},
+	}, DialWithVerifyChdir())
+
+	assert.NoError(t, c.ChangeDir("sub"))
+	assert.ErrorIs(t, c.ChangeDir("lie"), ErrChangeDirNotApplied)
+	assert.NoError(t, c.ChangeDir("."))
+	assert.NoError(t, c.ChangeDir("/link"), "a resolved symbolic link must be accepted")
+
+	closeConn(t, mock, c, []string{
+		"PWD", "CWD", "PWD",
+		"PWD", "CWD", "PWD",
+		"PWD", "CWD", "PWD",
+		"PWD", "CWD", "PWD",
+	})
+}
+
+func TestChangeDirToParentCDUPMissing(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"CDUP": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("502 Command not implemented.")
+			return true
+		},
+		"CWD": func(mock *ftpMock, cmdParts []string) bool {
+			assert.Equal(t, []string{"CWD", ".."}, cmdParts)
+			mock.printfLine("250 Directory successfully changed.")
+			return true
+		},
+		"PWD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("257 \"/\"")
+			return true
+		},
+	})
+
+	dir, err := c.ChangeDirToParent()
+	assert.NoError(t, err)
+	assert.Equal(t, "/", dir)
+
+	closeConn(t, mock, c, []string{"CDUP", "CWD", "PWD"})
+}
+
+func TestChangeDirToParentAtRoot(t *testing.T) {
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"CDUP": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("550 Already at root.")
+			return true
+		},
+		"CWD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("550 No such file or directory")
+			return true
+		},
+		"PWD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("257 \"/\"")
+			return true
+		},
+	})
+
+	_, err := c.ChangeDirToParent()
+	assert.ErrorIs(t, err, ErrAlreadyAtRoot)
+
+	closeConn(t, mock, c, []string{"CDUP", "CWD", "PWD"})
 }
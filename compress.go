@@ -0,0 +1,80 @@
+package ftp
+
+import (
+	"compress/zlib"
+	"io"
+	"net"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// deflateConn is a data connection in MODE Z: the data is compressed with zlib
+// on the wire. The zlib streams are started on the first Read or Write.
+type deflateConn struct {
+	net.Conn
+	level int
+
+	zr io.ReadCloser
+	zw *zlib.Writer
+}
+
+func (c *deflateConn) Read(buf []byte) (int, error) {
+	if c.zr == nil {
+		zr, err := zlib.NewReader(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.zr = zr
+	}
+	return c.zr.Read(buf)
+}
+
+func (c *deflateConn) Write(buf []byte) (int, error) {
+	if err := c.startWriter(); err != nil {
+		return 0, err
+	}
+	return c.zw.Write(buf)
+}
+
+// Handshake is called by sendData for an empty upload. It completes the TLS
+// handshake of the connection, if any, and starts the zlib stream, so that
+// Close sends a valid empty stream rather than no data.
+func (c *deflateConn) Handshake() error {
+	if do, ok := c.Conn.(interface{ Handshake() error }); ok {
+		if err := do.Handshake(); err != nil {
+			return err
+		}
+	}
+	return c.startWriter()
+}
+
+// startWriter starts the zlib stream written to the connection.
+func (c *deflateConn) startWriter() error {
+	if c.zw != nil {
+		return nil
+	}
+	zw, err := zlib.NewWriterLevel(c.Conn, c.level)
+	if err != nil {
+		return err
+	}
+	c.zw = zw
+	return nil
+}
+
+// Close flushes the compressed data written, if any, then closes the
+// connection.
+func (c *deflateConn) Close() error {
+	var errs *multierror.Error
+
+	if c.zw != nil {
+		if err := c.zw.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	if err := c.Conn.Close(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return errs.ErrorOrNil()
+}
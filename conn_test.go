@@ -17,7 +17,7 @@ import (
 )
 
 type ftpMock struct {
-	t        *testing.T
+	t        testing.TB
 	address  string
 	modtime  string // no-time, std-time, vsftpd
 	listener *net.TCPListener
@@ -27,21 +27,31 @@ type ftpMock struct {
 	rest     int
 	fileCont *bytes.Buffer
 	dataConn *mockDataConn
+	handlers map[string]mockHandler
 	sync.WaitGroup
 }
 
+// mockHandler overrides the default behavior of the mock for a command.
+// It returns false to fall back to the default behavior.
+type mockHandler func(mock *ftpMock, cmdParts []string) bool
+
 // newFtpMock returns a mock implementation of a FTP server
 // For simplication, a mock instance only accepts a signle connection and terminates afer
-func newFtpMock(t *testing.T, address string) (*ftpMock, error) {
+func newFtpMock(t testing.TB, address string) (*ftpMock, error) {
 	return newFtpMockExt(t, address, "no-time")
 }
 
-func newFtpMockExt(t *testing.T, address, modtime string) (*ftpMock, error) {
+func newFtpMockExt(t testing.TB, address, modtime string) (*ftpMock, error) {
+	return newFtpMockHandlers(t, address, modtime, nil)
+}
+
+func newFtpMockHandlers(t testing.TB, address, modtime string, handlers map[string]mockHandler) (*ftpMock, error) {
 	var err error
 	mock := &ftpMock{
-		t:       t,
-		address: address,
-		modtime: modtime,
+		t:        t,
+		address:  address,
+		modtime:  modtime,
+		handlers: handlers,
 	}
 
 	l, err := net.Listen("tcp", address+":0")
@@ -79,7 +89,11 @@ func (mock *ftpMock) listen() {
 	mock.printfLine("220 FTP Server ready.")
 
 	for {
-		fullCommand, _ := mock.proto.ReadLine()
+		fullCommand, err := mock.proto.ReadLine()
+		if err != nil {
+			// The client closed the connection
+			return
+		}
 		mock.lastFull = fullCommand
 
 		cmdParts := strings.Split(fullCommand, " ")
@@ -87,6 +101,10 @@ func (mock *ftpMock) listen() {
 		// Append to list of received commands
 		mock.commands = append(mock.commands, cmdParts[0])
 
+		if handler, ok := mock.handlers[cmdParts[0]]; ok && handler(mock, cmdParts) {
+			continue
+		}
+
 		// At least one command must have a multiline response
 		switch cmdParts[0] {
 		case "FEAT":
@@ -301,7 +319,7 @@ func (mock *ftpMock) closeDataConn() {
 }
 
 type mockDataConn struct {
-	t        *testing.T
+	t        testing.TB
 	listener *net.TCPListener
 	conn     net.Conn
 	// WaitGroup is done when conn is accepted and stored
@@ -375,9 +393,24 @@ func (mock *ftpMock) listenDataConn() (int64, error) {
 	return p, nil
 }
 
+// sendDataConn writes data on the data connection, surrounded by the
+// preliminary and completion replies.
+func (mock *ftpMock) sendDataConn(data []byte) {
+	if mock.dataConn == nil {
+		mock.printfLine("425 Unable to build data connection: Connection refused")
+		return
+	}
+
+	mock.dataConn.Wait()
+	mock.printfLine("150 Opening data connection")
+	mock.dataConn.write(data)
+	mock.printfLine("226 Transfer complete")
+	mock.closeDataConn()
+}
+
 func (mock *ftpMock) recvDataConn(append bool) {
 	mock.dataConn.Wait()
-	if !append {
+	if !append || mock.fileCont == nil {
 		mock.fileCont = new(bytes.Buffer)
 	}
 
@@ -399,12 +432,16 @@ func (mock *ftpMock) Close() {
 }
 
 // Helper to return a client connected to a mock server
-func openConn(t *testing.T, addr string, options ...DialOption) (*ftpMock, *ServerConn) {
+func openConn(t testing.TB, addr string, options ...DialOption) (*ftpMock, *ServerConn) {
 	return openConnExt(t, addr, "no-time", options...)
 }
 
-func openConnExt(t *testing.T, addr, modtime string, options ...DialOption) (*ftpMock, *ServerConn) {
-	mock, err := newFtpMockExt(t, addr, modtime)
+func openConnExt(t testing.TB, addr, modtime string, options ...DialOption) (*ftpMock, *ServerConn) {
+	return openConnHandlers(t, addr, modtime, nil, options...)
+}
+
+func openConnHandlers(t testing.TB, addr, modtime string, handlers map[string]mockHandler, options ...DialOption) (*ftpMock, *ServerConn) {
+	mock, err := newFtpMockHandlers(t, addr, modtime, handlers)
 	require.NoError(t, err)
 	defer mock.Close()
 
@@ -418,7 +455,7 @@ func openConnExt(t *testing.T, addr, modtime string, options ...DialOption) (*ft
 }
 
 // Helper to close a client connected to a mock server
-func closeConn(t *testing.T, mock *ftpMock, c *ServerConn, commands []string) {
+func closeConn(t testing.TB, mock *ftpMock, c *ServerConn, commands []string) {
 	expected := []string{"USER", "PASS", "FEAT", "TYPE", "OPTS"}
 	expected = append(expected, commands...)
 	expected = append(expected, "QUIT")
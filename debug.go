@@ -1,6 +1,11 @@
 package ftp
 
-import "io"
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
 
 type debugWrapper struct {
 	conn io.ReadWriteCloser
@@ -35,3 +40,39 @@ func newStreamDebugWrapper(rd io.ReadCloser, w io.Writer) io.ReadCloser {
 func (w *streamDebugWrapper) Close() error {
 	return w.closer.Close()
 }
+
+// transcriptWrapper writes the commands sent on a connection to a Writer,
+// one per line.
+type transcriptWrapper struct {
+	io.ReadWriteCloser
+	w    io.Writer
+	line []byte // incomplete command line
+}
+
+func newTranscriptWrapper(conn io.ReadWriteCloser, w io.Writer) io.ReadWriteCloser {
+	return &transcriptWrapper{
+		ReadWriteCloser: conn,
+		w:               w,
+	}
+}
+
+func (t *transcriptWrapper) Write(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(p)
+
+	t.line = append(t.line, p[:n]...)
+	for {
+		i := bytes.IndexByte(t.line, '\n')
+		if i < 0 {
+			break
+		}
+		cmd := strings.TrimRight(string(t.line[:i]), "\r")
+		t.line = t.line[i+1:]
+
+		if strings.HasPrefix(cmd, "PASS ") {
+			cmd = "PASS ****"
+		}
+		fmt.Fprintln(t.w, cmd)
+	}
+
+	return n, err
+}
@@ -0,0 +1,27 @@
+package ftp
+
+import (
+	"io/fs"
+	"path"
+	"time"
+)
+
+// FileInfo returns the entry as a fs.FileInfo, to use it with the standard
+// library. The base name of the entry is returned by Name, and the Entry
+// itself by Sys.
+func (e *Entry) FileInfo() fs.FileInfo {
+	return entryInfo{e}
+}
+
+// entryInfo adapts an Entry to fs.FileInfo. Entry cannot implement it
+// directly since its fields are named like the methods.
+type entryInfo struct {
+	e *Entry
+}
+
+func (i entryInfo) Name() string       { return path.Base(i.e.Name) }
+func (i entryInfo) Size() int64        { return int64(i.e.Size) }
+func (i entryInfo) Mode() fs.FileMode  { return i.e.FileMode }
+func (i entryInfo) ModTime() time.Time { return i.e.Time }
+func (i entryInfo) IsDir() bool        { return i.e.FileMode.IsDir() }
+func (i entryInfo) Sys() interface{}   { return i.e }
@@ -0,0 +1,206 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+)
+
+// FS returns the files of the server as a read-only fs.FS, rooted at the root
+// directory of the server. Use fs.Sub for a subdirectory.
+//
+// The files are looked up with MLST, or in the listing of their directory if
+// the server does not support it, the directories are listed with List and
+// the files are downloaded with Retr. As the transfers go through the
+// ServerConn, a single file can be read at a time, and it must be closed
+// before any other use of the ServerConn.
+//
+// The returned fs.FS also implements fs.StatFS and fs.ReadDirFS.
+func (c *ServerConn) FS() fs.FS {
+	return &serverFS{c: c}
+}
+
+// serverFS is the fs.FS of a ServerConn.
+type serverFS struct {
+	c *ServerConn
+}
+
+// remotePath returns the path on the server of the file named name in the
+// fs.FS, or an error if the name is not valid.
+func remotePath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join("/", name), nil
+}
+
+// fsError returns the error of the operation on the named file, matching
+// fs.ErrNotExist or fs.ErrPermission with errors.Is if the server tells so.
+func fsError(op, name string, err error) error {
+	err = classifyFileError(err)
+	switch {
+	case errors.Is(err, ErrFileNotFound):
+		err = &classifiedError{err: err, kind: fs.ErrNotExist}
+	case errors.Is(err, ErrPermission):
+		err = &classifiedError{err: err, kind: fs.ErrPermission}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// entry returns the entry of the named file, named after its base name.
+func (f *serverFS) entry(op, name string) (*Entry, error) {
+	p, err := remotePath(op, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var e *Entry
+	switch {
+	case p == "/":
+		e = &Entry{FileMode: os.ModeDir}
+	case f.c.mlstSupported:
+		e, err = f.c.GetEntry(p)
+	default:
+		e, err = f.c.stat(p)
+	}
+	if err != nil {
+		return nil, fsError(op, name, err)
+	}
+
+	named := *e
+	named.Name = name
+	return &named, nil
+}
+
+// Open implements fs.FS.
+func (f *serverFS) Open(name string) (fs.File, error) {
+	e, err := f.entry("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.FileMode.IsDir() {
+		return &serverDir{fsys: f, entry: e}, nil
+	}
+	return &serverFile{fsys: f, entry: e}, nil
+}
+
+// Stat implements fs.StatFS.
+func (f *serverFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := f.entry("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.FileInfo(), nil
+}
+
+// ReadDir implements fs.ReadDirFS. The current and parent directories are
+// left out, and the entries are sorted by name.
+func (f *serverFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := remotePath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := f.c.List(p)
+	if err != nil {
+		return nil, fsError("readdir", name, err)
+	}
+
+	dirEntries := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		if !isDotEntry(e) {
+			dirEntries = append(dirEntries, fs.FileInfoToDirEntry(e.FileInfo()))
+		}
+	}
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
+	return dirEntries, nil
+}
+
+// serverFile is a regular file opened with serverFS. It is downloaded on the
+// first read.
+type serverFile struct {
+	fsys  *serverFS
+	entry *Entry
+	r     *Response
+}
+
+func (f *serverFile) Stat() (fs.FileInfo, error) {
+	return f.entry.FileInfo(), nil
+}
+
+func (f *serverFile) Read(b []byte) (int, error) {
+	if f.r == nil {
+		r, err := f.fsys.c.Retr(path.Join("/", f.entry.Name))
+		if err != nil {
+			return 0, fsError("read", f.entry.Name, err)
+		}
+		f.r = r
+	}
+	return f.r.Read(b)
+}
+
+// Close closes the transfer, which is aborted if the file was not read to
+// the end.
+func (f *serverFile) Close() error {
+	if f.r == nil {
+		return nil
+	}
+	r := f.r
+	f.r = nil
+	if !r.eof {
+		return r.Abort()
+	}
+	return r.Close()
+}
+
+// serverDir is a directory opened with serverFS. It is listed on the first
+// call to ReadDir.
+type serverDir struct {
+	fsys    *serverFS
+	entry   *Entry
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (d *serverDir) Stat() (fs.FileInfo, error) {
+	return d.entry.FileInfo(), nil
+}
+
+func (d *serverDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.Name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *serverDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.fsys.ReadDir(d.entry.Name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *serverDir) Close() error {
+	return nil
+}
@@ -5,24 +5,38 @@ package ftp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"net"
 	"net/textproto"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
+	"golang.org/x/text/encoding"
 )
 
 const (
 	// 30 seconds was chosen as it's the
 	// same duration as http.DefaultTransport's timeout.
 	DefaultDialTimeout = 30 * time.Second
+
+	// DefaultMaxReadFileSize is the largest file read by ReadFile, unless
+	// configured with DialWithMaxReadFileSize.
+	DefaultMaxReadFileSize = 64 << 20
 )
 
 // TransferType denotes the formats for transferring Entries.
@@ -34,17 +48,213 @@ const (
 	TransferTypeASCII  = TransferType("A")
 )
 
+// ProtLevel denotes the protection level of the data connections, set with
+// the PROT FTP command when TLS is used.
+type ProtLevel string
+
+// The different protection levels
+const (
+	ProtLevelClear   = ProtLevel("C")
+	ProtLevelPrivate = ProtLevel("P")
+)
+
+// ListMethod denotes the FTP command used to list a directory.
+type ListMethod string
+
+// The different list methods
+const (
+	ListMethodMLSD = ListMethod("MLSD")
+	ListMethodLIST = ListMethod("LIST")
+	ListMethodNLST = ListMethod("NLST") // names only, if LIST is not implemented
+)
+
+// Perm holds the permissions of an entry given by the perm fact of MLSD and
+// MLST, as defined in RFC 3659.
+type Perm uint16
+
+// The permissions of the perm fact
+const (
+	PermAppend   Perm = 1 << iota // 'a': data can be appended to the file
+	PermCreate                    // 'c': files can be created in the directory
+	PermDelete                    // 'd': the entry can be deleted
+	PermEnter                     // 'e': the directory can be entered
+	PermRename                    // 'f': the entry can be renamed
+	PermList                      // 'l': the directory can be listed
+	PermMakeDir                   // 'm': directories can be created in the directory
+	PermPurge                     // 'p': the content of the directory can be deleted
+	PermRetrieve                  // 'r': the file can be retrieved
+	PermWrite                     // 'w': the file can be stored
+)
+
+// IsWritable reports whether the file can be stored, or files can be created
+// in the directory.
+func (p Perm) IsWritable() bool {
+	return p&(PermWrite|PermCreate) != 0
+}
+
+// CanList reports whether the directory can be listed.
+func (p Perm) CanList() bool {
+	return p&PermList != 0
+}
+
+// CanDelete reports whether the entry can be deleted.
+func (p Perm) CanDelete() bool {
+	return p&PermDelete != 0
+}
+
 // Time format used by the MDTM and MFMT commands
 const timeFormat = "20060102150405"
 
+// ErrAlreadyAtRoot is returned by ChangeDirToParent when the current directory
+// is the root directory and the server refuses to go up.
+var ErrAlreadyAtRoot = errors.New("already at the root directory")
+
+// ErrTLSRequired is returned by Login when the DialWithRequireTLS option is set
+// and the control connection is not protected by TLS.
+var ErrTLSRequired = errors.New("TLS is required to send credentials")
+
+// ErrListTruncated is returned by List when the DialWithListTruncationCheck
+// option is set and the listing looks like it was truncated by the server.
+var ErrListTruncated = errors.New("directory listing looks truncated")
+
+// ErrChangeDirNotApplied is returned by ChangeDir when the DialWithVerifyChdir
+// option is set and the server reported success while remaining in the
+// previous directory.
+var ErrChangeDirNotApplied = errors.New("server did not change the current directory")
+
+// ErrAppendSizeMismatch is returned by AppendVerified when the size of the
+// remote file is not the expected one before appending.
+var ErrAppendSizeMismatch = errors.New("remote file size does not match the expected size")
+
+// ErrUploadNotPersisted is returned by StorWithCheckpoints when the size of
+// the remote file does not follow the uploaded data.
+var ErrUploadNotPersisted = errors.New("remote file size does not follow the upload")
+
+// ErrRemoteFileLarger is returned by StorResume when the remote file is larger
+// than the content to upload.
+var ErrRemoteFileLarger = errors.New("remote file is larger than the content")
+
+// ErrMFFNotSupported is returned by SetFacts when the server does not
+// advertise the MFF command.
+var ErrMFFNotSupported = errors.New("MFF is not supported")
+
+// ErrFactNotSupported is returned by SetFacts when the server does not
+// advertise a fact as modifiable by MFF.
+var ErrFactNotSupported = errors.New("fact cannot be modified")
+
+// ErrMLSTNotSupported is returned by SetMLSTFacts when the server does not
+// advertise the MLST command.
+var ErrMLSTNotSupported = errors.New("MLST is not supported")
+
+// ErrUnknownFact is returned by SetMLSTFacts when the server does not list a
+// fact among the MLST facts it supports.
+var ErrUnknownFact = errors.New("fact not supported by the server")
+
+// ErrFileNotFound is matched by errors.Is for the errors of FileSize telling
+// that the file does not exist.
+var ErrFileNotFound = errors.New("file not found")
+
+// ErrPermission is matched by errors.Is for the errors of FileSize telling that
+// the file is not accessible for other reasons than its absence.
+var ErrPermission = errors.New("permission denied")
+
+// ErrAccountRequired is returned by Login when the server requires an account
+// with the ACCT FTP command. Use LoginWithAccount.
+var ErrAccountRequired = errors.New("account required for login")
+
+// ErrServerSideCopyUnsupported is returned by Copy when the server does not
+// support copying files. The file can be downloaded and uploaded instead.
+var ErrServerSideCopyUnsupported = errors.New("server-side copy is not supported")
+
+// ErrRestartOffsetMismatch is returned when the server accepts a REST FTP
+// command with an offset other than the requested one.
+var ErrRestartOffsetMismatch = errors.New("restart offset not accepted by the server")
+
+// ErrServiceClosing is returned when the server replies 421 to close the
+// connection, and by every later call. The error wraps the reply as a
+// *textproto.Error.
+var ErrServiceClosing = errors.New("service not available, closing control connection")
+
+// ErrConcurrentTransfer is returned when a command is issued while another
+// command is in progress, like a data transfer whose Response is still open.
+var ErrConcurrentTransfer = errors.New("a command or data transfer is in progress")
+
+// ErrNoTransfer is returned by TransferStatus when no data transfer is in
+// progress.
+var ErrNoTransfer = errors.New("no data transfer in progress")
+
+// ErrFileTooLarge is returned by ReadFile when the file is larger than the
+// limit set with DialWithMaxReadFileSize.
+var ErrFileTooLarge = errors.New("file too large")
+
+// ErrTruncatedTransfer is returned by Response.Close when the size of a
+// downloaded file differs from the size given by SIZE before the transfer.
+// See DialWithVerifyDownloadSize.
+var ErrTruncatedTransfer = errors.New("transfer truncated")
+
+// ErrTooManyEntries is returned by the listings of more entries than the
+// limit set with DialWithMaxListEntries.
+var ErrTooManyEntries = errors.New("too many entries in the listing")
+
+// ErrSiteCommandUnsupported is returned when a SITE FTP command is not listed
+// by the server in reply to SITE HELP.
+var ErrSiteCommandUnsupported = errors.New("SITE command not supported")
+
+// ErrTransferIdleTimeout is returned by the reads of a Response when no data
+// was received during the timeout set with DialWithTransferIdleTimeout.
+var ErrTransferIdleTimeout = errors.New("transfer idle timeout")
+
+// ErrReinitUnsupported is returned by Reinit when the server refuses the REIN
+// FTP command. A new connection must be dialed instead.
+var ErrReinitUnsupported = errors.New("REIN not supported")
+
+// ErrCertPinMismatch is returned when the certificate of the server does not
+// match the fingerprint set with DialWithTLSPin.
+var ErrCertPinMismatch = errors.New("certificate does not match the pinned fingerprint")
+
+// ErrNoDataPortAvailable is returned when no local port of the range set with
+// DialWithDataPortRange is free for a data connection.
+var ErrNoDataPortAvailable = errors.New("no data port available")
+
+// ErrCredentialsNotStored is returned by Clone and RetrSegmented when the
+// connection is logged in, but DialWithStoredCredentials was not used.
+var ErrCredentialsNotStored = errors.New("credentials not stored")
+
+// ErrSymlinkLoop is returned by ResolveSymlink when too many symbolic links
+// are followed, which usually means that they form a cycle.
+var ErrSymlinkLoop = errors.New("too many levels of symbolic links")
+
+// DataTLSError is returned when the TLS handshake of a data connection fails,
+// eg. because of an invalid certificate. It is returned by the first read or
+// write on the data connection, before any data is transferred.
+type DataTLSError struct {
+	Err error // error of the handshake
+}
+
+func (e *DataTLSError) Error() string {
+	return "TLS handshake of the data connection failed: " + e.Err.Error()
+}
+
+// Unwrap returns the error of the handshake.
+func (e *DataTLSError) Unwrap() error {
+	return e.Err
+}
+
 // ServerConn represents the connection to a remote FTP server.
 // A single connection only supports one in-flight data connection.
-// It is not safe to be called concurrently.
+// It is not safe to be called concurrently: all the commands share the control
+// connection. While a command is in progress, including a data transfer until
+// its Response is closed, other commands fail with ErrConcurrentTransfer,
+// except TransferStatus. Use a ServerConn per goroutine for simultaneous
+// transfers.
 type ServerConn struct {
-	options *dialOptions
-	conn    *textproto.Conn // connection wrapper for text protocol
-	netConn net.Conn        // underlying network connection
-	host    string
+	options  *dialOptions
+	conn     *textproto.Conn // connection wrapper for text protocol
+	netConn  net.Conn        // underlying network connection, if any
+	host     string
+	hostname string    // host as given to Dial, which may be a domain name
+	addr     string    // address given to Dial, empty with NewConn
+	tlsConn  *tls.Conn // control connection, if protected by TLS
 
 	// Server capabilities discovered at runtime
 	features      map[string]string
@@ -54,6 +264,50 @@ type ServerConn struct {
 	mdtmSupported bool
 	mdtmCanWrite  bool
 	usePRET       bool
+	siteCommands  map[string]bool // commands listed by SITE HELP, once queried
+	system        string          // system type given by SYST, once queried
+	compressed    bool            // transfers are in MODE Z
+
+	unparsedLines []string   // lines of the last List which could not be parsed
+	listedWith    ListMethod // command used by the last List
+
+	transferType TransferType // current transfer type, set by Type
+
+	// shutMu serializes the replies read during a data transfer, by
+	// TransferStatus and by the end of the transfer
+	shutMu sync.Mutex
+	// data connection closing status read ahead by TransferStatus
+	pendingShut *textproto.Error
+
+	// most recent reply of the server
+	lastCode int
+	lastMsg  string
+
+	gate      transferGate // pauses the data transfers
+	limiter   *rateLimiter // limits the bandwidth of the data transfers
+	keepAlive keepAlive    // sends NOOP while idle
+
+	busyMu   sync.Mutex
+	busy     bool // a command or a data transfer holds the control connection
+	transfer bool // the holder of busy is a data transfer
+
+	closing error // the server closed the connection with a 421 reply
+
+	utf8Enabled bool // UTF-8 was enabled before login
+
+	dataPort int // next local port tried for a data connection, see DialWithDataPortRange
+
+	cwd string // current directory known with DialWithCWDCache, empty if unknown
+
+	loggedIn bool // Login succeeded
+
+	statsMu   sync.Mutex
+	stats     Stats     // counters returned by Stats, without Uptime
+	connected time.Time // creation of the ServerConn
+
+	// credentials of the last Login, to open other connections, only stored
+	// with DialWithStoredCredentials
+	user, password, account string
 }
 
 // DialOption represents an option to start a new connection with Dial
@@ -69,13 +323,48 @@ type dialOptions struct {
 	explicitTLS     bool
 	disableEPSV     bool
 	disableUTF8     bool
+	charsetDecoder  *encoding.Decoder
 	disableMLSD     bool
 	writingMDTM     bool
 	forceListHidden bool
+	lenientList     bool
+	parserOrder     []ParserKind
 	location        *time.Location
 	debugOutput     io.Writer
+	transcript      io.Writer
 	dialFunc        func(network, address string) (net.Conn, error)
 	shutTimeout     time.Duration // time to wait for data connection closing status
+	dataConnRetries int           // number of retries of a transfer refused with 425
+	dataNetwork     string        // network of the EPSV data connections
+	requireTLS      bool
+	truncationCheck bool
+	verifyChdir     bool
+	keepAlive       time.Duration // interval of the NOOP commands sent while idle
+	transferType    TransferType  // transfer type set by Login
+	tlsReuse        *bool         // resume the control TLS session on data connections, see reuseTLSSession
+	forcePasvHost   bool          // ignore the host of the PASV replies
+	rateLimit       int64         // bytes per second of the data transfers
+	bufferSize      int           // size of the transfer buffers and data socket buffers
+	compression     bool
+	compressLevel   int           // zlib compression level of MODE Z
+	dataConnTimeout time.Duration // timeout of the dials of the data connections
+	pret            bool          // send PRET even if not advertised
+	postConnect     []string      // raw commands sent after the greeting
+	noProbe         bool          // do not send FEAT in Login
+	maxReadFileSize int64         // largest file read by ReadFile
+	retryAttempts   int           // attempts of the commands failing with transient errors
+	retryBackoff    time.Duration // delay before the first retry, doubled at each attempt
+	dataProtection  ProtLevel     // PROT level when TLS is used, private if empty
+	clientName      string        // sent with CLNT by Login
+	utf8BeforeLogin bool          // send OPTS UTF8 ON before USER
+	maxListEntries  int           // largest number of entries of a listing, if positive
+	verifySize      bool          // check the size of the downloads, see DialWithVerifyDownloadSize
+	idleTimeout     time.Duration // longest wait for data on a Response, if positive
+	tlsPin          []byte        // SHA-256 fingerprint of the certificate of the server
+	dataPortMin     int           // first local port of the data connections, if positive
+	dataPortMax     int           // last local port of the data connections
+	storeCreds      bool          // keep the credentials of Login for Clone
+	cwdCache        bool          // skip the CWD commands to the current directory
 }
 
 // Entry describes a file and is returned by List().
@@ -85,6 +374,18 @@ type Entry struct {
 	Target   string // target of symbolic link
 	Size     uint64
 	Time     time.Time
+	Perm     Perm   // permissions given by MLSD and MLST, zero if unknown
+	Unique   string // identifier of the file given by MLSD and MLST, empty if unknown
+
+	pseudoDir bool // current or parent directory listed by MLSD
+}
+
+// Stats holds the counters of a ServerConn, returned by Stats.
+type Stats struct {
+	BytesSent     int64         // bytes sent on the data connections
+	BytesReceived int64         // bytes received on the data connections
+	CommandsSent  int           // commands sent on the control connection
+	Uptime        time.Duration // time since the connection was opened
 }
 
 // Response represents a data-connection
@@ -92,17 +393,34 @@ type Response struct {
 	conn   net.Conn
 	c      *ServerConn
 	closed bool
+
+	restoreType TransferType // transfer type to switch back to once closed
+
+	verify   bool  // check that expected bytes were received, set by DialWithVerifyDownloadSize
+	expected int64 // size of the file minus the offset of the transfer
+	received int64 // bytes read
+	eof      bool  // the end of the data was read
 }
 
-// Dial connects to the specified address with optional options
+// Dial connects to the specified address with optional options.
+//
+// Once the server is ready, the control connection is upgraded with AUTH TLS
+// if DialWithExplicitTLS is used, then "OPTS UTF8 ON" is sent with
+// DialWithUTF8BeforeLogin, and the commands of DialWithPostConnectCommands.
+// Login then sends USER, PASS and ACCT if needed, probes the features with
+// FEAT, sends CLNT, TYPE, "OPTS UTF8 ON", MODE Z, and PBSZ and PROT with TLS.
 func Dial(addr string, options ...DialOption) (*ServerConn, error) {
-	do := &dialOptions{}
-	for _, option := range options {
-		option.setup(do)
-	}
+	return dial(addr, newDialOptions(options))
+}
 
-	if do.location == nil {
-		do.location = time.UTC
+// dial connects to the specified address with the given options.
+func dial(addr string, do *dialOptions) (*ServerConn, error) {
+	hostname, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		hostname = addr
+	}
+	if do.reuseTLSSession() {
+		do.tlsConfig = sessionReuseConfig(do.tlsConfig, hostname)
 	}
 
 	dialFunc := do.dialFunc
@@ -140,31 +458,149 @@ func Dial(addr string, options ...DialOption) (*ServerConn, error) {
 		return nil, err
 	}
 
-	// Use the resolved IP address in case addr contains a domain name
-	// If we use the domain name, we might not resolve to the same IP.
-	remoteAddr := tconn.RemoteAddr().(*net.TCPAddr)
+	c, err := newConn(tconn, hostname, do)
+	if err != nil {
+		return nil, err
+	}
+	c.addr = addr
+	return c, nil
+}
+
+// NewConn returns a ServerConn using the given connection to the server as
+// control connection, which is useful to run the protocol over a connection
+// established by other means, or against a scripted in-memory server.
+//
+// When conn is not a net.Conn, the deadlines of the options are not enforced
+// on the control connection and explicit TLS is not available. Data
+// connections are opened with the DialWithDialFunc function, if any.
+func NewConn(conn io.ReadWriteCloser, options ...DialOption) (*ServerConn, error) {
+	do := newDialOptions(options)
+
+	var hostname string
+	if netConn, ok := conn.(net.Conn); ok {
+		if remoteAddr, ok := netConn.RemoteAddr().(*net.TCPAddr); ok {
+			hostname = remoteAddr.IP.String()
+		}
+	}
+	if do.reuseTLSSession() {
+		do.tlsConfig = sessionReuseConfig(do.tlsConfig, hostname)
+	}
+
+	return newConn(conn, hostname, do)
+}
+
+// reuseTLSSession reports whether the data connections resume the TLS session
+// of the control connection: by default, only with explicit TLS.
+func (do *dialOptions) reuseTLSSession() bool {
+	if do.tlsConfig == nil {
+		return false
+	}
+	if do.tlsReuse != nil {
+		return *do.tlsReuse
+	}
+	return do.explicitTLS
+}
+
+// dataProtectionLevel returns the protection level of the data connections.
+func (do *dialOptions) dataProtectionLevel() ProtLevel {
+	if do.dataProtection == "" {
+		return ProtLevelPrivate
+	}
+	return do.dataProtection
+}
+
+// newDialOptions returns the dialOptions set up by the given options.
+func newDialOptions(options []DialOption) *dialOptions {
+	do := &dialOptions{}
+	for _, option := range options {
+		option.setup(do)
+	}
+
+	if do.location == nil {
+		do.location = time.UTC
+	}
+	if do.maxReadFileSize == 0 {
+		do.maxReadFileSize = DefaultMaxReadFileSize
+	}
+	if do.tlsConfig != nil && do.tlsPin != nil {
+		do.tlsConfig = pinnedConfig(do.tlsConfig, do.tlsPin)
+	}
+
+	return do
+}
 
+// newConn returns a ServerConn using the given control connection to the
+// server at hostname, once the server is ready.
+func newConn(conn io.ReadWriteCloser, hostname string, do *dialOptions) (*ServerConn, error) {
 	c := &ServerConn{
-		options:  do,
-		features: make(map[string]string),
-		conn:     textproto.NewConn(do.wrapConn(tconn)),
-		netConn:  tconn,
-		host:     remoteAddr.IP.String(),
+		options:   do,
+		features:  make(map[string]string),
+		conn:      textproto.NewConn(do.wrapConn(conn)),
+		hostname:  hostname,
+		connected: time.Now(),
+	}
+	if netConn, ok := conn.(net.Conn); ok {
+		c.netConn = netConn
+		// Use the resolved IP address in case addr contains a domain name
+		// If we use the domain name, we might not resolve to the same IP.
+		if remoteAddr, ok := netConn.RemoteAddr().(*net.TCPAddr); ok {
+			c.host = remoteAddr.IP.String()
+		}
+	}
+	if c.hostname == "" {
+		c.hostname = c.host
+	}
+	c.tlsConn, _ = conn.(*tls.Conn)
+	if do.rateLimit > 0 {
+		c.limiter = newRateLimiter(do.rateLimit)
 	}
 
-	_, _, err = c.conn.ReadResponse(StatusReady)
+	_, _, err := c.readResponse(StatusReady)
 	if err != nil {
 		_ = c.Quit()
 		return nil, err
 	}
 
 	if do.explicitTLS {
+		if c.netConn == nil {
+			_ = c.Quit()
+			return nil, errors.New("explicit TLS requires a net.Conn")
+		}
 		if err := c.authTLS(); err != nil {
 			_ = c.Quit()
 			return nil, err
 		}
-		tconn = tls.Client(tconn, do.tlsConfig)
-		c.conn = textproto.NewConn(do.wrapConn(tconn))
+		c.tlsConn = tls.Client(c.netConn, do.tlsConfig)
+		c.conn = textproto.NewConn(do.wrapConn(c.tlsConn))
+		// Check the pinned certificate before anything is sent
+		if do.tlsPin != nil {
+			if err := c.tlsConn.Handshake(); err != nil {
+				_ = c.Close()
+				return nil, err
+			}
+		}
+	}
+
+	// Some servers want UTF-8 before USER. As the features are not known
+	// yet, the command is always sent: if refused, Login tries again.
+	if do.utf8BeforeLogin && !do.disableUTF8 {
+		code, _, err := c.cmd(-1, "OPTS UTF8 ON")
+		if err != nil {
+			_ = c.Quit()
+			return nil, err
+		}
+		c.utf8Enabled = code == StatusCommandOK || code == StatusCommandNotImplemented
+	}
+
+	for _, cmd := range do.postConnect {
+		if _, _, err := c.cmd(2, "%s", cmd); err != nil {
+			_ = c.Quit()
+			return nil, err
+		}
+	}
+
+	if do.keepAlive > 0 {
+		c.keepAlive.start(c, do.keepAlive)
 	}
 
 	return c, nil
@@ -177,6 +613,63 @@ func DialWithTimeout(timeout time.Duration) DialOption {
 	}}
 }
 
+// DialWithDataConnTimeout returns a DialOption that bounds the time to establish
+// a data connection, independently of the timeout of the control connection
+// set by DialWithTimeout. A firewalled data port then fails fast instead of
+// hanging until the TCP timeout of the system.
+func DialWithDataConnTimeout(timeout time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dataConnTimeout = timeout
+	}}
+}
+
+// DialWithTransferIdleTimeout returns a DialOption that bounds the time to wait
+// for data when reading a Response. The deadline is pushed back before every
+// read, so slow but steady transfers are not interrupted, while a stalled or
+// half-open data connection fails with ErrTransferIdleTimeout. The transfer
+// should then be cancelled with Response.Abort.
+//
+// The timeout replaces the read deadline set with Response.SetDeadline.
+func DialWithTransferIdleTimeout(timeout time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.idleTimeout = timeout
+	}}
+}
+
+// DialWithDataPortRange returns a DialOption that binds the local side of the
+// data connections to a free port between min and max, inclusive, for the
+// egress firewalls only allowing some source ports. ErrNoDataPortAvailable is
+// returned when all the ports are in use.
+//
+// The range is ignored when the data connections are dialed by the function
+// of DialWithDialFunc.
+func DialWithDataPortRange(min, max int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dataPortMin = min
+		do.dataPortMax = max
+	}}
+}
+
+// DialWithStoredCredentials returns a DialOption keeping the credentials given
+// to Login in memory, so that Clone and RetrSegmented can log in other
+// connections. They are not kept by default.
+func DialWithStoredCredentials() DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.storeCreds = true
+	}}
+}
+
+// DialWithCWDCache returns a DialOption making ChangeDir remember the current
+// directory, so that no CWD FTP command is sent to change to the directory
+// the connection is already in. The directory is forgotten on error, on
+// Login and Reinit, when a command is sent with Raw, and after changing to a
+// path with "..", until CurrentDir is called.
+func DialWithCWDCache() DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.cwdCache = true
+	}}
+}
+
 // DialWithShutTimeout returns a DialOption that configures the ServerConn with
 // maximum time to wait for the data closing status on control connection
 // and nudging the control connection deadline before reading status.
@@ -186,6 +679,100 @@ func DialWithShutTimeout(shutTimeout time.Duration) DialOption {
 	}}
 }
 
+// DialWithKeepAlive returns a DialOption that configures the ServerConn to send
+// a NOOP command every interval while the connection is idle, so that the
+// server does not close it between bursts of commands.
+//
+// The NOOP commands are sent from a background goroutine and never interleave
+// with other commands or transfers. It is stopped by Quit and Close.
+func DialWithKeepAlive(interval time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.keepAlive = interval
+	}}
+}
+
+// DialWithForcePasvHostFromControl returns a DialOption that configures the
+// ServerConn to always dial the data connections opened with PASV on the host
+// of the control connection, keeping only the port of the PASV reply.
+//
+// By default the host of the PASV reply is only replaced when it looks
+// unroutable from the client, which some NAT'd servers defeat.
+func DialWithForcePasvHostFromControl(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.forcePasvHost = enabled
+	}}
+}
+
+// DialWithRateLimit returns a DialOption that limits the bandwidth of the
+// uploads and downloads of the ServerConn to the given number of bytes per
+// second. The limit is shared by all the transfers of the connection. Zero
+// means unlimited.
+func DialWithRateLimit(bytesPerSec int64) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.rateLimit = bytesPerSec
+	}}
+}
+
+// DialWithTransferBufferSize returns a DialOption that sets the size of the
+// buffer used to copy the data of the transfers, and the size of the send and
+// receive socket buffers of the data connections. Larger buffers can improve
+// the throughput on links with a high latency. Zero keeps the defaults. The
+// socket buffers of connections from DialWithDialFunc are left untouched.
+func DialWithTransferBufferSize(n int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.bufferSize = n
+	}}
+}
+
+// DialWithCompression returns a DialOption that makes Login switch to the
+// compressed transfer mode MODE Z, when advertised by the server with FEAT.
+// The data of the transfers and listings is then compressed with zlib at the
+// given level, from zlib.NoCompression to zlib.BestCompression, or
+// zlib.DefaultCompression. The level is also requested for the data sent by
+// the server with OPTS MODE Z LEVEL. Transfers stay in stream mode if the
+// server does not support MODE Z.
+func DialWithCompression(level int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.compression = true
+		do.compressLevel = level
+	}}
+}
+
+// DialWithTransferType returns a DialOption that configures the transfer type
+// set by Login: TransferTypeBinary, the default, or TransferTypeASCII.
+func DialWithTransferType(transferType TransferType) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.transferType = transferType
+	}}
+}
+
+// DialWithDataConnRetries returns a DialOption that configures the ServerConn to
+// retry up to the given number of times a transfer command failing with a
+// "425 Can't open data connection" reply.
+//
+// Each retry opens a new data connection with PASV or EPSV. This is safe as no
+// data has moved when the server refuses to open the data connection, and it
+// frequently succeeds as such failures are usually transient.
+func DialWithDataConnRetries(retries int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dataConnRetries = retries
+	}}
+}
+
+// DialWithDataNetwork returns a DialOption that configures the network used to
+// dial the data connections opened with EPSV: "tcp4", "tcp6" or "tcp".
+//
+// By default the data connections use the address of the control connection.
+// When it does not belong to the given network, the host given to Dial is
+// resolved again in that network, eg. to transfer data over IPv6 while the
+// control connection uses IPv4. Data connections opened with PASV are not
+// affected as the server tells an IPv4 address.
+func DialWithDataNetwork(network string) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dataNetwork = network
+	}}
+}
+
 // DialWithDialer returns a DialOption that configures the ServerConn with specified net.Dialer
 func DialWithDialer(dialer net.Dialer) DialOption {
 	return DialOption{func(do *dialOptions) {
@@ -217,6 +804,39 @@ func DialWithDisabledUTF8(disabled bool) DialOption {
 	}}
 }
 
+// DialWithUTF8BeforeLogin returns a DialOption that sends "OPTS UTF8 ON" right
+// after the greeting of the server, before USER, for the servers requiring it.
+// By default, it is sent by Login once the server advertised UTF8 with FEAT.
+func DialWithUTF8BeforeLogin() DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.utf8BeforeLogin = true
+	}}
+}
+
+// DialWithMaxListEntries returns a DialOption that limits the number of
+// entries read from a listing, to protect against servers sending endless
+// listings. Beyond n entries, the transfer is aborted and ErrTooManyEntries is
+// returned along with the first n entries. The lines which are ignored or
+// cannot be parsed, and the "." and ".." entries, are not counted. Zero means
+// no limit.
+func DialWithMaxListEntries(n int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.maxListEntries = n
+	}}
+}
+
+// DialWithCharsetDecoder returns a DialOption that configures the ServerConn to
+// convert the names sent by the server to UTF-8 with the given decoder.
+//
+// This is useful together with DialWithDisabledUTF8 for servers using a legacy
+// charset such as latin1 or Shift-JIS. The decoder applies to the entries
+// returned by List, GetEntry and Walk and to the names returned by NameList.
+func DialWithCharsetDecoder(dec *encoding.Decoder) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.charsetDecoder = dec
+	}}
+}
+
 // DialWithDisabledMLSD returns a DialOption that configures the ServerConn with MLSD option disabled
 //
 // This is useful for servers which advertise MLSD (eg some versions
@@ -227,6 +847,92 @@ func DialWithDisabledMLSD(disabled bool) DialOption {
 	}}
 }
 
+// DialWithPRET returns a DialOption that makes ServerConn send a PRET command
+// before opening each data connection, even if the server does not advertise
+// it. Clustered servers such as distributed ProFTPD need it to route the data
+// connection to the right node. A PRET rejected by the server fails the
+// transfer.
+//
+// Without this option, PRET is only sent to servers advertising it and its
+// reply is ignored.
+func DialWithPRET(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.pret = enabled
+	}}
+}
+
+// DialWithPostConnectCommands returns a DialOption that sends the given raw
+// commands, eg. "CLNT myclient", right after the greeting of the server (and
+// the TLS negotiation with DialWithExplicitTLS). Each command must be
+// accepted with a 2xx reply, otherwise the dial fails.
+func DialWithPostConnectCommands(cmds ...string) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.postConnect = append(do.postConnect, cmds...)
+	}}
+}
+
+// DialWithoutInitialProbe returns a DialOption that makes Login skip the FEAT
+// FTP command, for minimal servers which fail or hang on it. No feature is
+// known until Features is called: LIST is used instead of MLSD, and UTF-8 is
+// not enabled.
+func DialWithoutInitialProbe() DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.noProbe = true
+	}}
+}
+
+// DialWithMaxReadFileSize returns a DialOption that sets the largest file
+// read by ReadFile, in bytes. The default is DefaultMaxReadFileSize. ReadFile
+// fails if n is negative.
+func DialWithMaxReadFileSize(n int64) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.maxReadFileSize = n
+	}}
+}
+
+// DialWithTransientRetry returns a DialOption that makes ServerConn retry the
+// commands failing with a transient reply: 425 (can't open data connection),
+// 450 or 451. Up to maxAttempts attempts are made, waiting backoff before the
+// first retry and twice as long before each next one.
+//
+// Only the commands which are safe to repeat are retried: the listings, RETR,
+// SIZE and MDTM. Uploads are never retried. A listing or a download failing
+// once its data started to flow is not retried either.
+func DialWithTransientRetry(maxAttempts int, backoff time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.retryAttempts = maxAttempts
+		do.retryBackoff = backoff
+	}}
+}
+
+// DialWithDataProtectionLevel returns a DialOption that sets the protection
+// level of the data connections when TLS is used: ProtLevelPrivate, the
+// default, protects them with TLS while ProtLevelClear leaves them in clear.
+func DialWithDataProtectionLevel(level ProtLevel) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dataProtection = level
+	}}
+}
+
+// DialWithClientName returns a DialOption that makes Login identify the client
+// with the given name, with a CLNT FTP command, if the server advertises it.
+func DialWithClientName(name string) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.clientName = name
+	}}
+}
+
+// DialWithVerifyDownloadSize returns a DialOption that makes RetrFrom query the
+// size of the file with a SIZE FTP command before the transfer. Once all the
+// data is read, Response.Close returns ErrTruncatedTransfer if its size is
+// different, which catches data connections closed early. The check is
+// skipped if SIZE fails, and for the transfers in ASCII mode.
+func DialWithVerifyDownloadSize() DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.verifySize = true
+	}}
+}
+
 // DialWithWritingMDTM returns a DialOption making ServerConn use MDTM to set file time
 //
 // This option addresses a quirk in the VsFtpd server which doesn't support
@@ -243,12 +949,59 @@ func DialWithWritingMDTM(enabled bool) DialOption {
 //
 // This is useful for servers that do not do this by default, but it forces the use of the LIST command
 // even if the server supports MLST.
+//
+// NameList also sends NLST -a, see NameList.
 func DialWithForceListHidden(enabled bool) DialOption {
 	return DialOption{func(do *dialOptions) {
 		do.forceListHidden = enabled
 	}}
 }
 
+// DialWithLenientListParsing returns a DialOption making List collect the lines
+// which could not be parsed, so they can be inspected with UnparsedListLines.
+func DialWithLenientListParsing() DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.lenientList = true
+	}}
+}
+
+// DialWithVerifyChdir returns a DialOption making ChangeDir verify with PWD
+// that the current directory actually changed.
+//
+// This costs two extra round-trips for each ChangeDir, and is useful with
+// servers which acknowledge CWD while remaining in the previous directory.
+func DialWithVerifyChdir() DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.verifyChdir = true
+	}}
+}
+
+// DialWithListTruncationCheck returns a DialOption making List check whether
+// the server silently truncated a listing.
+//
+// Some servers cap the number of entries of a listing without reporting an
+// error. When a listing stops at a round number of entries, it is
+// cross-checked with the entries reported by STAT on the same path, and
+// ErrListTruncated is returned when STAT reports more entries. A round-numbered
+// listing which is not followed by a proper completion status is reported as
+// truncated too.
+func DialWithListTruncationCheck() DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.truncationCheck = true
+	}}
+}
+
+// DialWithParserOrder returns a DialOption that configures the order in which
+// the LIST line parsers are tried. Parsers missing from the order are not used.
+//
+// This is useful to avoid false-positive matches of ambiguous lines with
+// servers using a known listing format, eg. DOS-first or RFC3659-only.
+func DialWithParserOrder(order []ParserKind) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.parserOrder = order
+	}}
+}
+
 // DialWithLocation returns a DialOption that configures the ServerConn with specified time.Location
 // The location is used to parse the dates sent by the server which are in server's timezone
 func DialWithLocation(location *time.Location) DialOption {
@@ -276,26 +1029,116 @@ func DialWithTLS(tlsConfig *tls.Config) DialOption {
 	}}
 }
 
-// DialWithExplicitTLS returns a DialOption that configures the ServerConn to be upgraded to TLS
-// See DialWithTLS for general TLS documentation
-func DialWithExplicitTLS(tlsConfig *tls.Config) DialOption {
+// DialWithTLSSessionReuse returns a DialOption that configures whether the data
+// connections resume the TLS session of the control connection, which is
+// enabled by default with explicit TLS.
+//
+// Strict servers, like vsftpd with require_ssl_reuse, refuse data connections
+// which do not resume the session of the control connection.
+//
+// The sessions are resumed with session tickets: Go does not resume TLS 1.2
+// sessions by session ID, so a server which does not issue tickets in TLS 1.2
+// still refuses the data connections.
+func DialWithTLSSessionReuse(enabled bool) DialOption {
 	return DialOption{func(do *dialOptions) {
-		do.explicitTLS = true
-		do.tlsConfig = tlsConfig
+		do.tlsReuse = &enabled
 	}}
 }
 
-// DialWithDebugOutput returns a DialOption that configures the ServerConn to write to the Writer
-// everything it reads from the server
-func DialWithDebugOutput(w io.Writer) DialOption {
+// sessionReuseConfig returns a copy of the TLS config sharing a session cache
+// between the control and data connections.
+//
+// Sessions are cached by server name, or by address when there is none, which
+// would differ for each data connection: the server name defaults to host.
+func sessionReuseConfig(config *tls.Config, host string) *tls.Config {
+	config = config.Clone()
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+// DialWithTLSPin returns a DialOption that checks that the SHA-256 fingerprint
+// of the leaf certificate of the server, for the control and the data
+// connections, is the given one. The connection is refused with
+// ErrCertPinMismatch otherwise.
+//
+// The pin is checked in addition to the verification of the chain, which can
+// be disabled with the InsecureSkipVerify field of the TLS config, eg. for a
+// self-signed certificate. The option has no effect without TLS.
+func DialWithTLSPin(sha256Fingerprint []byte) DialOption {
 	return DialOption{func(do *dialOptions) {
-		do.debugOutput = w
+		do.tlsPin = sha256Fingerprint
 	}}
 }
 
-// DialWithDialFunc returns a DialOption that configures the ServerConn to use the
-// specified function to establish both control and data connections
-//
+// pinnedConfig returns a copy of the TLS config checking the fingerprint of the
+// leaf certificate of the server, after its own checks.
+func pinnedConfig(config *tls.Config, pin []byte) *tls.Config {
+	config = config.Clone()
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return ErrCertPinMismatch
+		}
+		fingerprint := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if !bytes.Equal(fingerprint[:], pin) {
+			return ErrCertPinMismatch
+		}
+		return nil
+	}
+	return config
+}
+
+// DialWithExplicitTLS returns a DialOption that configures the ServerConn to be upgraded to TLS
+// See DialWithTLS for general TLS documentation
+func DialWithExplicitTLS(tlsConfig *tls.Config) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.explicitTLS = true
+		do.tlsConfig = tlsConfig
+	}}
+}
+
+// DialWithRequireTLS returns a DialOption making Login refuse to send the
+// credentials over a control connection which is not protected by TLS.
+//
+// This prevents credentials leaks when a misconfiguration disables TLS, with
+// either implicit or explicit TLS. On refusal, the connection is closed and
+// ErrTLSRequired is returned.
+func DialWithRequireTLS() DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.requireTLS = true
+	}}
+}
+
+// DialWithDebugOutput returns a DialOption that configures the ServerConn to write to the Writer
+// everything it reads from the server
+func DialWithDebugOutput(w io.Writer) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.debugOutput = w
+	}}
+}
+
+// DialWithTranscript returns a DialOption that configures the ServerConn to
+// write to the Writer every command it sends to the server, one per line.
+// The password sent by Login is masked.
+func DialWithTranscript(w io.Writer) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.transcript = w
+	}}
+}
+
+// DialWithDialFunc returns a DialOption that configures the ServerConn to use the
+// specified function to establish both control and data connections
+//
 // If used together with the DialWithNetConn option, the DialWithNetConn
 // takes precedence for the control connection, while data connections will
 // be established using function specified with the DialWithDialFunc option
@@ -305,12 +1148,35 @@ func DialWithDialFunc(f func(network, address string) (net.Conn, error)) DialOpt
 	}}
 }
 
-func (o *dialOptions) wrapConn(netConn net.Conn) io.ReadWriteCloser {
-	if o.debugOutput == nil {
-		return netConn
+func (o *dialOptions) wrapConn(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	if o.debugOutput != nil {
+		conn = newDebugWrapper(conn, o.debugOutput)
+	}
+	if o.transcript != nil {
+		conn = newTranscriptWrapper(conn, o.transcript)
+	}
+
+	return conn
+}
+
+// decodeName converts a name sent by the server to UTF-8 with the charset
+// decoder, if any.
+func (o *dialOptions) decodeName(name string) (string, error) {
+	if o.charsetDecoder == nil {
+		return name, nil
 	}
 
-	return newDebugWrapper(netConn, o.debugOutput)
+	return o.charsetDecoder.String(name)
+}
+
+// decodeEntry converts the names of an entry sent by the server to UTF-8 with
+// the charset decoder, if any.
+func (o *dialOptions) decodeEntry(e *Entry) (err error) {
+	if e.Name, err = o.decodeName(e.Name); err != nil {
+		return err
+	}
+	e.Target, err = o.decodeName(e.Target)
+	return err
 }
 
 func (o *dialOptions) wrapStream(rd io.ReadCloser) io.ReadCloser {
@@ -340,52 +1206,123 @@ func DialTimeout(addr string, timeout time.Duration) (*ServerConn, error) {
 // "anonymous"/"anonymous" is a common user/password scheme for FTP servers
 // that allows anonymous read-only accounts.
 func (c *ServerConn) Login(user, password string) error {
+	return c.LoginWithAccount(user, password, "")
+}
+
+// anonymousEmail is the password sent by LoginAnonymous to servers which want
+// an email address.
+const anonymousEmail = "anonymous@example.com"
+
+// LoginAnonymous authenticates the client as "anonymous" with "anonymous@" as
+// password. If the server rejects the password because it wants an email
+// address, as some public archives do, the login is retried with a valid
+// throwaway address.
+func (c *ServerConn) LoginAnonymous() error {
+	err := c.Login("anonymous", "anonymous@")
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && isEmailDemanded(protoErr) {
+		err = c.Login("anonymous", anonymousEmail)
+	}
+	return err
+}
+
+// isEmailDemanded reports whether a rejected PASS asks for an email address.
+func isEmailDemanded(err *textproto.Error) bool {
+	if err.Code != StatusNotLoggedIn && err.Code != StatusBadArguments {
+		return false
+	}
+	msg := strings.ToLower(err.Msg)
+	return strings.Contains(msg, "email") || strings.Contains(msg, "e-mail")
+}
+
+// LoginWithAccount is like Login but sends the account with an ACCT FTP command
+// when the server asks for it with a 332 reply, as some legacy hosts do. If the
+// account is empty, ErrAccountRequired is returned instead.
+func (c *ServerConn) LoginWithAccount(user, password, account string) error {
+	if c.options.requireTLS {
+		if err := c.checkTLS(); err != nil {
+			_ = c.Close()
+			return err
+		}
+	}
+
 	code, message, err := c.cmd(-1, "USER %s", user)
 	if err != nil {
 		return err
 	}
 
-	switch code {
-	case StatusLoggedIn:
-	case StatusUserOK:
-		_, _, err = c.cmd(StatusLoggedIn, "PASS %s", password)
+	if code == StatusUserOK {
+		code, message, err = c.cmd(-1, "PASS %s", password)
 		if err != nil {
 			return err
 		}
-	default:
+		if code != StatusLoggedIn && code != StatusLoginNeedAccount {
+			return &textproto.Error{Code: code, Msg: message}
+		}
+	}
+
+	if code == StatusLoginNeedAccount {
+		if account == "" {
+			return ErrAccountRequired
+		}
+		code, message, err = c.cmd(StatusLoggedIn, "ACCT %s", account)
+		if err != nil {
+			return err
+		}
+	}
+
+	if code != StatusLoggedIn {
 		return errors.New(message)
 	}
+	c.loggedIn = true
+	c.cwd = ""
+	if c.options.storeCreds {
+		c.user, c.password, c.account = user, password, account
+	}
 
 	// Probe features
-	err = c.feat()
-	if err != nil {
-		return err
-	}
-	if _, mlstSupported := c.features["MLST"]; mlstSupported && !c.options.disableMLSD {
-		c.mlstSupported = true
+	if !c.options.noProbe {
+		if err = c.feat(); err != nil {
+			return err
+		}
 	}
-	_, c.usePRET = c.features["PRET"]
+	c.applyFeatures()
 
-	_, c.mfmtSupported = c.features["MFMT"]
-	_, c.mdtmSupported = c.features["MDTM"]
-	c.mdtmCanWrite = c.mdtmSupported && c.options.writingMDTM
+	// Identify the client before UTF-8 is enabled, as some servers only
+	// enable it for known clients. The reply is informational.
+	if _, ok := c.features["CLNT"]; ok && c.options.clientName != "" {
+		if _, _, err = c.cmd(-1, "CLNT %s", c.options.clientName); err != nil {
+			return err
+		}
+	}
 
-	// Switch to binary mode
-	if err = c.Type(TransferTypeBinary); err != nil {
+	// Switch to the default transfer type, binary unless configured
+	transferType := c.options.transferType
+	if transferType == "" {
+		transferType = TransferTypeBinary
+	}
+	if err = c.Type(transferType); err != nil {
 		return err
 	}
 
-	// Switch to UTF-8
-	if !c.options.disableUTF8 {
+	// Switch to UTF-8, unless done before login
+	if !c.options.disableUTF8 && !c.utf8Enabled {
 		err = c.setUTF8()
 	}
 
+	if c.options.compression {
+		if err := c.setCompression(); err != nil {
+			return err
+		}
+	}
+
 	// If using implicit TLS, make data connections also use TLS
 	if c.options.tlsConfig != nil {
 		if _, _, err = c.cmd(StatusCommandOK, "PBSZ 0"); err != nil {
 			return err
 		}
-		if _, _, err = c.cmd(StatusCommandOK, "PROT P"); err != nil {
+		if _, _, err = c.cmd(StatusCommandOK, "PROT %s", c.options.dataProtectionLevel()); err != nil {
 			return err
 		}
 	}
@@ -393,12 +1330,171 @@ func (c *ServerConn) Login(user, password string) error {
 	return err
 }
 
+// Clone opens a new connection to the server with the same options. If the
+// ServerConn is logged in, the new connection is logged in with the same
+// credentials, which must have been stored with DialWithStoredCredentials,
+// and its current directory is changed to the one of the ServerConn.
+//
+// The ServerConn must have been opened with Dial. The context given with
+// DialWithContext is not used, as it may have expired since.
+func (c *ServerConn) Clone() (*ServerConn, error) {
+	if err := c.checkClone(); err != nil {
+		return nil, err
+	}
+
+	var dir string
+	if c.loggedIn {
+		var err error
+		if dir, err = c.CurrentDir(); err != nil {
+			return nil, err
+		}
+	}
+	return c.clone(dir)
+}
+
+// checkClone returns an error if the ServerConn cannot be cloned.
+func (c *ServerConn) checkClone() error {
+	if c.addr == "" {
+		return errors.New("a connection opened with Dial is required")
+	}
+	if c.loggedIn && !c.options.storeCreds {
+		return ErrCredentialsNotStored
+	}
+	return nil
+}
+
+// clone opens a new connection like Clone, in the given directory. It does
+// not use the control connection of c, so it can be called concurrently.
+func (c *ServerConn) clone(dir string) (*ServerConn, error) {
+	do := *c.options
+	do.context = nil
+	sc, err := dial(c.addr, &do)
+	if err != nil {
+		return nil, err
+	}
+	if !c.loggedIn {
+		return sc, nil
+	}
+
+	if err := sc.LoginWithAccount(c.user, c.password, c.account); err != nil {
+		_ = sc.Quit()
+		return nil, err
+	}
+	if err := sc.ChangeDir(dir); err != nil {
+		_ = sc.Quit()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// setCompression issues a "MODE Z" command if the server supports it. The
+// compression level is requested beforehand, but its rejection is ignored as
+// the option is not mandatory.
+func (c *ServerConn) setCompression() error {
+	if !hasFeatureParam(c.features["MODE"], "Z") {
+		return nil
+	}
+
+	if c.options.compressLevel >= 0 {
+		if _, _, err := c.cmd(-1, "OPTS MODE Z LEVEL %d", c.options.compressLevel); err != nil {
+			return err
+		}
+	}
+
+	code, _, err := c.cmd(-1, "MODE Z")
+	if err != nil {
+		return err
+	}
+	c.compressed = code == StatusCommandOK
+	return nil
+}
+
+// hasFeatureParam reports whether the parameters of a feature listed by FEAT
+// include the given one.
+func hasFeatureParam(params, param string) bool {
+	for _, p := range strings.Fields(params) {
+		if strings.EqualFold(p, param) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTLS ensures that the control connection is protected by TLS, completing
+// the handshake if needed.
+func (c *ServerConn) checkTLS() error {
+	if c.tlsConn == nil {
+		return ErrTLSRequired
+	}
+	return c.tlsConn.Handshake()
+}
+
 // authTLS upgrades the connection to use TLS
 func (c *ServerConn) authTLS() error {
 	_, _, err := c.cmd(StatusAuthOK, "AUTH TLS")
 	return err
 }
 
+// System issues a SYST FTP command and returns the system type of the server,
+// eg. "UNIX Type: L8". The reply is cached, so the command is only sent once.
+//
+// Once known, the system type is used to choose the order of the LIST line
+// parsers, unless DialWithParserOrder is used: the DOS format is tried first
+// with Windows servers.
+func (c *ServerConn) System() (string, error) {
+	if c.system != "" {
+		return c.system, nil
+	}
+
+	_, msg, err := c.cmd(StatusName, "SYST")
+	if err != nil {
+		return "", err
+	}
+	c.system = msg
+	return msg, nil
+}
+
+// parserOrder returns the order of the LIST line parsers set with
+// DialWithParserOrder, or suited to the system type, or nil for the default
+// order.
+func (c *ServerConn) parserOrder() []ParserKind {
+	if c.options.parserOrder != nil {
+		return c.options.parserOrder
+	}
+	return systemParserOrder(c.system)
+}
+
+// Features sends a FEAT FTP command and returns the features advertised by
+// the server, with their parameters. The features are probed by Login unless
+// DialWithoutInitialProbe is used, in which case Features must be called to
+// use MLSD, MFMT, MDTM and PRET.
+func (c *ServerConn) Features() (map[string]string, error) {
+	c.features = make(map[string]string)
+	if err := c.feat(); err != nil {
+		return nil, err
+	}
+	c.applyFeatures()
+
+	features := make(map[string]string, len(c.features))
+	for k, v := range c.features {
+		features[k] = v
+	}
+	return features, nil
+}
+
+// applyFeatures enables the commands advertised in the features.
+func (c *ServerConn) applyFeatures() {
+	_, mlstSupported := c.features["MLST"]
+	c.mlstSupported = mlstSupported && !c.options.disableMLSD
+
+	_, c.usePRET = c.features["PRET"]
+	c.usePRET = c.usePRET || c.options.pret
+
+	_, c.mfmtSupported = c.features["MFMT"]
+	_, c.mdtmSupported = c.features["MDTM"]
+	c.mdtmCanWrite = c.mdtmSupported && c.options.writingMDTM
+}
+
 // feat issues a FEAT FTP command to list the additional commands supported by
 // the remote FTP server.
 // FEAT is described in RFC 2389
@@ -414,6 +1510,9 @@ func (c *ServerConn) feat() error {
 		return nil
 	}
 
+	// textproto.ReadResponse only ends the reply on a line starting with the
+	// opening code and a space, so indented features starting with digits
+	// are kept in the message.
 	lines := strings.Split(message, "\n")
 	for _, line := range lines {
 		if !strings.HasPrefix(line, " ") {
@@ -468,7 +1567,7 @@ func (c *ServerConn) setUTF8() error {
 
 // epsv issues an "EPSV" command to get a port number for a data connection.
 func (c *ServerConn) epsv() (port int, err error) {
-	_, line, err := c.cmd(StatusExtendedPassiveMode, "EPSV")
+	_, line, err := c.exchange(StatusExtendedPassiveMode, "EPSV")
 	if err != nil {
 		return 0, err
 	}
@@ -484,7 +1583,7 @@ func (c *ServerConn) epsv() (port int, err error) {
 
 // pasv issues a "PASV" command to get a port number for a data connection.
 func (c *ServerConn) pasv() (host string, port int, err error) {
-	_, line, err := c.cmd(StatusPassiveMode, "PASV")
+	_, line, err := c.exchange(StatusPassiveMode, "PASV")
 	if err != nil {
 		return "", 0, err
 	}
@@ -517,6 +1616,10 @@ func (c *ServerConn) pasv() (host string, port int, err error) {
 	// Recompose port
 	port = portPart1*256 + portPart2
 
+	if c.options.forcePasvHost {
+		return c.host, port, nil
+	}
+
 	// Make the IP address to connect to
 	host = strings.Join(pasvData[0:4], ".")
 
@@ -539,34 +1642,52 @@ func isBogusDataIP(cmdIP, dataIP net.IP) bool {
 		cmdIP.IsLoopback() != dataIP.IsLoopback()
 }
 
-// getDataConnPort returns a host, port for a new data connection
+// getDataConnPort returns a network, host, port for a new data connection
 // it uses the best available method to do so
-func (c *ServerConn) getDataConnPort() (string, int, error) {
+func (c *ServerConn) getDataConnPort() (string, string, int, error) {
 	if !c.options.disableEPSV && !c.skipEPSV {
 		if port, err := c.epsv(); err == nil {
-			return c.host, port, nil
+			network, host := c.epsvNetwork()
+			return network, host, port, nil
 		}
 
 		// if there is an error, skip EPSV for the next attempts
 		c.skipEPSV = true
 	}
 
-	return c.pasv()
+	host, port, err := c.pasv()
+	return "tcp", host, port, err
+}
+
+// epsvNetwork returns the network and host to dial for data connections
+// opened with EPSV.
+func (c *ServerConn) epsvNetwork() (string, string) {
+	switch c.options.dataNetwork {
+	case "tcp4", "tcp6":
+		isIPv4 := net.ParseIP(c.host).To4() != nil
+		if isIPv4 == (c.options.dataNetwork == "tcp4") {
+			return c.options.dataNetwork, c.host
+		}
+		return c.options.dataNetwork, c.hostname
+	}
+	return "tcp", c.host
 }
 
 // openDataConn creates a new FTP data connection.
 func (c *ServerConn) openDataConn() (net.Conn, error) {
-	host, port, err := c.getDataConnPort()
+	network, host, port, err := c.getDataConnPort()
 	if err != nil {
 		return nil, err
 	}
 
 	addr := net.JoinHostPort(host, strconv.Itoa(port))
 	if c.options.dialFunc != nil {
-		return c.options.dialFunc("tcp", addr)
+		return c.options.dialFunc(network, addr)
 	}
 
-	if c.options.tlsConfig != nil {
+	dialer := c.dataDialer()
+
+	if c.options.tlsConfig != nil && c.options.dataProtectionLevel() == ProtLevelPrivate {
 		// We don't use tls.DialWithDialer here (which does Dial, create
 		// the Client and then do the Handshake) because it seems to
 		// hang with some FTP servers, namely proftpd and pureftpd.
@@ -579,369 +1700,1944 @@ func (c *ServerConn) openDataConn() (net.Conn, error) {
 		// won't have been called. This is done in StorFrom().
 		//
 		// See: https://github.com/jlaffaye/ftp/issues/282
-		conn, err := c.options.dialer.Dial("tcp", addr)
+		conn, err := c.dialData(dialer, network, addr)
 		if err != nil {
-			return nil, err
+			return nil, dataConnError(addr, err)
 		}
-		tlsConn := tls.Client(conn, c.options.tlsConfig)
-		return tlsConn, nil
+		return newDataTLSConn(conn, c.options.tlsConfig), nil
 	}
 
-	return c.options.dialer.Dial("tcp", addr)
-}
-
-// cmd is a helper function to execute a command and check for the expected FTP
-// return code
-func (c *ServerConn) cmd(expected int, format string, args ...interface{}) (int, string, error) {
-	_, err := c.conn.Cmd(format, args...)
+	conn, err := c.dialData(dialer, network, addr)
 	if err != nil {
-		return 0, "", err
+		return nil, dataConnError(addr, err)
 	}
-
-	return c.conn.ReadResponse(expected)
+	return conn, nil
 }
 
-// cmdDataConnFrom executes a command which require a FTP data connection.
-// Issues a REST FTP command to specify the number of bytes to skip for the transfer.
-func (c *ServerConn) cmdDataConnFrom(offset uint64, format string, args ...interface{}) (net.Conn, error) {
-	// If server requires PRET send the PRET command to warm it up
-	// See: https://tools.ietf.org/html/draft-dd-pret-00
-	if c.usePRET {
-		_, _, err := c.cmd(-1, "PRET "+format, args...)
-		if err != nil {
-			return nil, err
-		}
+// dialData dials a data connection, from a local port of the range set with
+// DialWithDataPortRange if any. The ports are tried in turn, starting after
+// the one of the previous connection, which may still be in TIME_WAIT.
+func (c *ServerConn) dialData(dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	min, max := c.options.dataPortMin, c.options.dataPortMax
+	if min <= 0 || max < min {
+		return dialer.Dial(network, addr)
 	}
 
-	conn, err := c.openDataConn()
-	if err != nil {
-		return nil, err
+	var ip net.IP
+	if local, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		ip = local.IP
+	}
+	if c.dataPort < min || c.dataPort > max {
+		c.dataPort = min
 	}
 
-	if offset != 0 {
-		_, _, err = c.cmd(StatusRequestFilePending, "REST %d", offset)
-		if err != nil {
-			_ = conn.Close()
+	for i := 0; i <= max-min; i++ {
+		port := c.dataPort
+		c.dataPort++
+		if c.dataPort > max {
+			c.dataPort = min
+		}
+
+		d := *dialer
+		d.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+		conn, err := d.Dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if !isAddrInUse(err) {
 			return nil, err
 		}
 	}
+	return nil, ErrNoDataPortAvailable
+}
 
-	_, err = c.conn.Cmd(format, args...)
-	if err != nil {
-		_ = conn.Close()
-		return nil, err
-	}
+// dataConnError wraps the error of the dial of a data connection, which often
+// fails because of a firewall.
+func dataConnError(addr string, err error) error {
+	return fmt.Errorf("data connection to %s could not be established: %w", addr, err)
+}
 
-	code, msg, err := c.conn.ReadResponse(-1)
-	if err != nil {
-		_ = conn.Close()
-		return nil, err
-	}
-	if code != StatusAlreadyOpen && code != StatusAboutToSend {
-		_ = conn.Close()
-		return nil, &textproto.Error{Code: code, Msg: msg}
-	}
+// dataTLSConn is a data connection protected by TLS, whose handshake errors
+// are returned as a *DataTLSError.
+type dataTLSConn struct {
+	*tls.Conn
+}
 
-	return conn, nil
+// newDataTLSConn returns the data connection protected by TLS. The handshake
+// is done by the first read or write.
+func newDataTLSConn(conn net.Conn, config *tls.Config) net.Conn {
+	return &dataTLSConn{tls.Client(conn, config)}
 }
 
-// Type switches the transfer mode for the connection.
-func (c *ServerConn) Type(transferType TransferType) (err error) {
-	_, _, err = c.cmd(StatusCommandOK, "TYPE "+string(transferType))
-	return err
+// Handshake runs the TLS handshake if it has not been run yet.
+func (c *dataTLSConn) Handshake() error {
+	if err := c.Conn.Handshake(); err != nil {
+		return &DataTLSError{Err: err}
+	}
+	return nil
 }
 
-// NameList issues an NLST FTP command.
-func (c *ServerConn) NameList(path string) (entries []string, err error) {
-	space := " "
-	if path == "" {
-		space = ""
+func (c *dataTLSConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
 	}
-	conn, err := c.cmdDataConnFrom(0, "NLST%s%s", space, path)
-	if err != nil {
-		return nil, err
+	return c.Conn.Read(b)
+}
+
+func (c *dataTLSConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
 	}
+	return c.Conn.Write(b)
+}
 
-	var errs *multierror.Error
+// dataDialer returns the dialer of the data connections, with the timeout
+// given by DialWithDataConnTimeout. With DialWithTransferBufferSize, the send
+// and receive buffers of the sockets are sized before connecting: shrinking
+// them on an established connection can stall it, as the window was already
+// advertised.
+func (c *ServerConn) dataDialer() *net.Dialer {
+	dialer := c.options.dialer
+	if c.options.dataConnTimeout > 0 {
+		dialer.Timeout = c.options.dataConnTimeout
+	}
+	if c.options.bufferSize <= 0 {
+		return &dialer
+	}
 
-	r := &Response{conn: conn, c: c}
+	control := dialer.Control
+	dialer.Control = func(network, address string, rc syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, rc); err != nil {
+				return err
+			}
+		}
+		return rc.Control(func(fd uintptr) {
+			// Failures are ignored, the system keeps its own sizes
+			setSocketBuffers(fd, c.options.bufferSize)
+		})
+	}
+	return &dialer
+}
 
-	scanner := bufio.NewScanner(c.options.wrapStream(r))
-	for scanner.Scan() {
-		entries = append(entries, scanner.Text())
+// copyData copies src to dst through a buffer of the size given by
+// DialWithTransferBufferSize, or like io.Copy by default.
+func (c *ServerConn) copyData(dst io.Writer, src io.Reader) (int64, error) {
+	if c.options.bufferSize <= 0 {
+		return io.Copy(dst, src)
 	}
+	// Hide io.ReaderFrom and io.WriterTo so that the buffer is used
+	buf := make([]byte, c.options.bufferSize)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
 
-	if err := scanner.Err(); err != nil {
-		errs = multierror.Append(errs, err)
+// cmd is a helper function to execute a command and check for the expected FTP
+// return code
+func (c *ServerConn) cmd(expected int, format string, args ...interface{}) (int, string, error) {
+	if err := c.claim(); err != nil {
+		return 0, "", err
 	}
-	if err := r.Close(); err != nil {
-		errs = multierror.Append(errs, err)
+	defer c.unclaim()
+
+	c.keepAlive.begin()
+	defer c.keepAlive.end()
+
+	// Checked once begin waited for a NOOP in flight, which may get a 421
+	if c.closing != nil {
+		return 0, "", c.closing
 	}
 
-	return entries, errs.ErrorOrNil()
+	return c.exchange(expected, format, args...)
 }
 
-// List issues a LIST FTP command.
-func (c *ServerConn) List(path string) (entries []*Entry, err error) {
-	var cmd string
-	var parser parseFunc
+// exchange sends a command and reads its reply, while the control connection
+// is already claimed.
+func (c *ServerConn) exchange(expected int, format string, args ...interface{}) (int, string, error) {
+	if _, err := c.sendCmd(format, args...); err != nil {
+		return 0, "", err
+	}
 
-	if c.mlstSupported && !c.options.forceListHidden {
-		cmd = "MLSD"
-		parser = parseRFC3659ListLine
-	} else {
-		cmd = "LIST"
-		if c.options.forceListHidden {
-			cmd += " -a"
-		}
-		parser = parseListLine
-	}
+	return c.readResponse(expected)
+}
 
-	space := " "
-	if path == "" {
-		space = ""
-	}
-	conn, err := c.cmdDataConnFrom(0, "%s%s%s", cmd, space, path)
-	if err != nil {
-		return nil, err
+// sendCmd sends a command on the control connection, counting it for Stats,
+// without reading the reply.
+func (c *ServerConn) sendCmd(format string, args ...interface{}) (uint, error) {
+	id, err := c.conn.Cmd(format, args...)
+	if err == nil {
+		c.statsMu.Lock()
+		c.stats.CommandsSent++
+		c.statsMu.Unlock()
 	}
+	return id, err
+}
 
-	var errs *multierror.Error
+// countData counts the bytes sent and received on the data connections for
+// Stats.
+func (c *ServerConn) countData(sent, received int64) {
+	c.statsMu.Lock()
+	c.stats.BytesSent += sent
+	c.stats.BytesReceived += received
+	c.statsMu.Unlock()
+}
 
-	r := &Response{conn: conn, c: c}
+// claim reserves the control connection for a command, or returns
+// ErrConcurrentTransfer if another command or a data transfer holds it.
+func (c *ServerConn) claim() error {
+	c.busyMu.Lock()
+	defer c.busyMu.Unlock()
 
-	scanner := bufio.NewScanner(c.options.wrapStream(r))
-	now := time.Now()
-	for scanner.Scan() {
-		entry, errParse := parser(scanner.Text(), now, c.options.location)
-		if errParse == nil {
-			entries = append(entries, entry)
-		}
+	if c.busy {
+		return ErrConcurrentTransfer
 	}
+	c.busy = true
+	return nil
+}
 
-	if err := scanner.Err(); err != nil {
-		errs = multierror.Append(errs, err)
-	}
-	if err := r.Close(); err != nil {
-		errs = multierror.Append(errs, err)
-	}
+// unclaim releases the control connection reserved by claim.
+func (c *ServerConn) unclaim() {
+	c.busyMu.Lock()
+	c.busy = false
+	c.transfer = false
+	c.busyMu.Unlock()
+}
 
-	return entries, errs.ErrorOrNil()
+// startTransfer marks the claim of the control connection as held by a data
+// transfer, once it is opened.
+func (c *ServerConn) startTransfer() {
+	c.busyMu.Lock()
+	c.transfer = true
+	c.busyMu.Unlock()
 }
 
-// GetEntry issues a MLST FTP command which retrieves one single Entry using the
-// control connection. The returnedEntry will describe the current directory
-// when no path is given.
-func (c *ServerConn) GetEntry(path string) (entry *Entry, err error) {
-	if !c.mlstSupported {
-		return nil, &textproto.Error{Code: StatusNotImplemented, Msg: StatusText(StatusNotImplemented)}
+// inTransfer reports whether a data transfer holds the control connection.
+func (c *ServerConn) inTransfer() bool {
+	c.busyMu.Lock()
+	defer c.busyMu.Unlock()
+	return c.transfer
+}
+
+// endTransfer releases the control connection once the closing status of a
+// data transfer is read.
+func (c *ServerConn) endTransfer() {
+	c.keepAlive.end()
+	c.unclaim()
+}
+
+// readResponse reads a reply from the server like textproto.Conn.ReadResponse
+// and records it for LastResponse. A 421 reply closes the connection.
+func (c *ServerConn) readResponse(expected int) (int, string, error) {
+	code, msg, err := c.conn.ReadResponse(expected)
+	if code != 0 {
+		c.lastCode, c.lastMsg = code, msg
 	}
-	space := " "
-	if path == "" {
-		space = ""
+	if code == StatusNotAvailable {
+		err = c.serviceClosing(code, msg)
+		c.keepAlive.shutdown()
+		return code, msg, err
 	}
-	_, msg, err := c.cmd(StatusRequestedFileActionOK, "%s%s%s", "MLST", space, path)
-	if err != nil {
-		return nil, err
+	return code, msg, err
+}
+
+// serviceClosing records the 421 reply of a server closing the connection,
+// which is closed, and returns the error of the next commands.
+func (c *ServerConn) serviceClosing(code int, msg string) error {
+	c.closing = &classifiedError{
+		err:  &textproto.Error{Code: code, Msg: msg},
+		kind: ErrServiceClosing,
 	}
+	_ = c.closeConn()
+	return c.closing
+}
 
-	// The expected reply will look something like:
-	//
-	//    250-File details
-	//     Type=file;Size=1024;Modify=20220813133357; path
-	//    250 End
-	//
-	// Multiple lines are allowed though, so it can also be in the form:
-	//
-	//    250-File details
-	//     Type=file;Size=1024; path
-	//     Modify=20220813133357; path
-	//    250 End
-	lines := strings.Split(msg, "\n")
-	lc := len(lines)
+// isExpectedCode checks a reply code the same way as
+// textproto.Conn.ReadResponse: expected can be a code prefix of one or two
+// digits, and any code is accepted when expected is not positive.
+func isExpectedCode(code, expected int) bool {
+	switch {
+	case expected <= 0:
+		return true
+	case expected < 10:
+		return code/100 == expected
+	case expected < 100:
+		return code/10 == expected
+	default:
+		return code == expected
+	}
+}
 
-	// lines must be a multi-line message with a length of 3 or more, and we
-	// don't care about the first and last line
-	if lc < 3 {
-		return nil, errors.New("invalid response")
+// classifiedError is an error, usually a protocol error, matching a sentinel
+// error with errors.Is.
+type classifiedError struct {
+	err  error
+	kind error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.kind
+}
+
+// notFoundMessages are the parts of the 550 messages telling that a file does
+// not exist.
+var notFoundMessages = []string{"no such", "not found", "cannot find"}
+
+// classifyFileError classifies a 550 reply to a command on a file as
+// ErrFileNotFound or ErrPermission, depending on its message.
+func classifyFileError(err error) error {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != StatusFileUnavailable {
+		return err
 	}
 
-	e := &Entry{}
-	for _, l := range lines[1 : lc-1] {
-		// According to RFC 3659, the entry lines must start with a space when passed over the
-		// control connection. Some servers don't seem to add that space though. Both forms are
-		// accepted here.
-		if len(l) > 0 && l[0] == ' ' {
-			l = l[1:]
+	msg := strings.ToLower(protoErr.Msg)
+	for _, notFound := range notFoundMessages {
+		if strings.Contains(msg, notFound) {
+			return &classifiedError{err: protoErr, kind: ErrFileNotFound}
 		}
-		// Some severs seem to send a blank line at the end which we ignore
-		if l == "" {
+	}
+	return &classifiedError{err: protoErr, kind: ErrPermission}
+}
+
+// isPermanentError returns true if err is a protocol error carrying a
+// permanent negative completion reply (5xx).
+func isPermanentError(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500 && protoErr.Code < 600
+}
+
+// cmdDataConnFrom executes a command which require a FTP data connection.
+// Issues a REST FTP command to specify the number of bytes to skip for the transfer.
+func (c *ServerConn) cmdDataConnFrom(offset uint64, format string, args ...interface{}) (net.Conn, error) {
+	conn, _, err := c.cmdDataConnReply(offset, format, args...)
+	return conn, err
+}
+
+// cmdDataConnReply is like cmdDataConnFrom but also returns the message of the
+// preliminary reply of the server.
+func (c *ServerConn) cmdDataConnReply(offset uint64, format string, args ...interface{}) (net.Conn, string, error) {
+	for retry := 0; ; retry++ {
+		conn, msg, err := c.cmdDataConnOnce(offset, format, args...)
+		if retry < c.options.dataConnRetries && isDataConnError(err) {
 			continue
 		}
-		if e, err = parseNextRFC3659ListLine(l, c.options.location, e); err != nil {
-			return nil, err
-		}
+		return conn, msg, err
 	}
-	return e, nil
 }
 
-// IsTimePreciseInList returns true if client and server support the MLSD
-// command so List can return time with 1-second precision for all files.
-func (c *ServerConn) IsTimePreciseInList() bool {
-	return c.mlstSupported
+// isDataConnError returns true if err is a protocol error telling that the
+// server could not open the data connection.
+func isDataConnError(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code == StatusCanNotOpenDataConnection
 }
 
-// ChangeDir issues a CWD FTP command, which changes the current directory to
-// the specified path.
-func (c *ServerConn) ChangeDir(path string) error {
-	_, _, err := c.cmd(StatusRequestedFileActionOK, "CWD %s", path)
-	return err
+// cmdDataConnSafe is like cmdDataConnFrom but retries the commands failing
+// with a transient error, as configured with DialWithTransientRetry. It must
+// only be used for commands which are safe to repeat.
+func (c *ServerConn) cmdDataConnSafe(offset uint64, format string, args ...interface{}) (conn net.Conn, err error) {
+	err = c.retryTransient(func() error {
+		conn, err = c.cmdDataConnFrom(offset, format, args...)
+		return err
+	})
+	return conn, err
 }
 
-// ChangeDirToParent issues a CDUP FTP command, which changes the current
-// directory to the parent directory.  This is similar to a call to ChangeDir
-// with a path set to "..".
-func (c *ServerConn) ChangeDirToParent() error {
-	_, _, err := c.cmd(StatusRequestedFileActionOK, "CDUP")
-	return err
+// cmdSafe is like cmd but retries the commands failing with a transient
+// error, as configured with DialWithTransientRetry. It must only be used for
+// commands which are safe to repeat.
+func (c *ServerConn) cmdSafe(expected int, format string, args ...interface{}) (code int, msg string, err error) {
+	err = c.retryTransient(func() error {
+		code, msg, err = c.cmd(expected, format, args...)
+		return err
+	})
+	return code, msg, err
 }
 
-// CurrentDir issues a PWD FTP command, which Returns the path of the current
-// directory.
-func (c *ServerConn) CurrentDir() (string, error) {
-	_, msg, err := c.cmd(StatusPathCreated, "PWD")
-	if err != nil {
-		return "", err
+// retryTransient calls fn until it does not fail with a transient error, or
+// the attempts set with DialWithTransientRetry are exhausted.
+func (c *ServerConn) retryTransient(fn func() error) error {
+	backoff := c.options.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if attempt >= c.options.retryAttempts || !isTransientError(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	start := strings.Index(msg, "\"")
-	end := strings.LastIndex(msg, "\"")
+// isTransientError returns true if err is a protocol error carrying a reply
+// which may not happen again: 425, 450 or 451.
+func isTransientError(err error) bool {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return false
+	}
+	switch protoErr.Code {
+	case StatusCanNotOpenDataConnection, StatusFileActionIgnored, StatusActionAborted:
+		return true
+	}
+	return false
+}
 
-	if start == -1 || end == -1 {
-		return "", errors.New("unsuported PWD response format")
+// cmdDataConnOnce makes a single attempt of cmdDataConnReply.
+//
+// The control connection stays claimed until the closing status of the data
+// connection is read by readDataShut.
+func (c *ServerConn) cmdDataConnOnce(offset uint64, format string, args ...interface{}) (conn net.Conn, msg string, err error) {
+	if err := c.claim(); err != nil {
+		return nil, "", err
 	}
 
-	return msg[start+1 : end], nil
-}
+	c.keepAlive.begin()
+	defer func() {
+		if err != nil {
+			c.endTransfer()
+		} else {
+			c.startTransfer()
+		}
+	}()
 
-// FileSize issues a SIZE FTP command, which Returns the size of the file
-func (c *ServerConn) FileSize(path string) (int64, error) {
-	_, msg, err := c.cmd(StatusFile, "SIZE %s", path)
+	if c.closing != nil {
+		return nil, "", c.closing
+	}
+
+	// If server requires PRET send the PRET command to warm it up
+	// See: https://tools.ietf.org/html/draft-dd-pret-00
+	// The reply is only checked if PRET was requested with DialWithPRET.
+	if c.usePRET {
+		expected := -1
+		if c.options.pret {
+			expected = StatusCommandOK
+		}
+		_, _, err := c.exchange(expected, "PRET "+format, args...)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	conn, err = c.openDataConn()
 	if err != nil {
-		return 0, err
+		return nil, "", err
 	}
 
-	return strconv.ParseInt(msg, 10, 64)
+	if offset != 0 {
+		var restMsg string
+		_, restMsg, err = c.exchange(StatusRequestFilePending, "REST %d", offset)
+		if err == nil && !isRestartOffsetAccepted(restMsg, offset) {
+			// Clear the marker so that it does not apply to the next transfer
+			_, _, _ = c.exchange(StatusRequestFilePending, "REST 0")
+			err = fmt.Errorf("%w: %s", ErrRestartOffsetMismatch, restMsg)
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, "", err
+		}
+	}
+
+	_, err = c.sendCmd(format, args...)
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", err
+	}
+
+	code, msg, err := c.readResponse(-1)
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", err
+	}
+	if code != StatusAlreadyOpen && code != StatusAboutToSend {
+		_ = conn.Close()
+		return nil, "", &textproto.Error{Code: code, Msg: msg}
+	}
+
+	if c.compressed {
+		return &deflateConn{Conn: conn, level: c.options.compressLevel}, msg, nil
+	}
+	return conn, msg, nil
 }
 
-// GetTime issues the MDTM FTP command to obtain the file modification time.
-// It returns a UTC time.
-func (c *ServerConn) GetTime(path string) (time.Time, error) {
-	var t time.Time
-	if !c.mdtmSupported {
-		return t, errors.New("GetTime is not supported")
+// isRestartOffsetAccepted checks the offset echoed by some servers in the reply
+// to REST, eg. "Restarting at 1024" or "Restart position accepted (1024)". Only
+// the number following "at", or else a number alone in parentheses, is taken
+// as the echoed offset. The reply is accepted if it has no such number.
+func isRestartOffsetAccepted(msg string, offset uint64) bool {
+	echoed := ""
+	fields := strings.Fields(msg)
+	for i := 0; i+1 < len(fields); i++ {
+		if strings.EqualFold(fields[i], "at") {
+			echoed = strings.TrimRight(fields[i+1], ".,;:")
+			break
+		}
+	}
+	if echoed == "" {
+		if start := strings.IndexByte(msg, '('); start >= 0 {
+			if end := strings.IndexByte(msg[start:], ')'); end > 0 {
+				echoed = strings.TrimSpace(msg[start+1 : start+end])
+			}
+		}
 	}
-	_, msg, err := c.cmd(StatusFile, "MDTM %s", path)
+
+	n, err := strconv.ParseUint(echoed, 10, 64)
 	if err != nil {
-		return t, err
+		return true
 	}
-	return time.ParseInLocation(timeFormat, msg, time.UTC)
+	return n == offset
 }
 
-// IsGetTimeSupported allows library callers to check in advance that they
-// can use GetTime to get file time.
-func (c *ServerConn) IsGetTimeSupported() bool {
-	return c.mdtmSupported
+// Type switches the transfer mode for the connection.
+func (c *ServerConn) Type(transferType TransferType) (err error) {
+	_, _, err = c.cmd(StatusCommandOK, "TYPE "+string(transferType))
+	if err == nil {
+		c.transferType = transferType
+	}
+	return err
 }
 
-// SetTime issues the MFMT FTP command to set the file modification time.
-// Also it can use a non-standard form of the MDTM command supported by
-// the VsFtpd server instead of MFMT for the same purpose.
-// See "mdtm_write" in https://security.appspot.com/vsftpd/vsftpd_conf.html
-func (c *ServerConn) SetTime(path string, t time.Time) (err error) {
-	utime := t.In(time.UTC).Format(timeFormat)
-	switch {
-	case c.mfmtSupported:
-		_, _, err = c.cmd(StatusFile, "MFMT %s %s", utime, path)
-	case c.mdtmCanWrite:
-		_, _, err = c.cmd(StatusFile, "MDTM %s %s", utime, path)
-	default:
-		err = errors.New("SetTime is not supported")
+// switchType switches the transfer type to transferType, and returns the type
+// to switch back to afterwards, or an empty type if it did not change or was
+// unknown. An unknown type is taken for binary, the type set by Login.
+func (c *ServerConn) switchType(transferType TransferType) (TransferType, error) {
+	prev := c.transferType
+	if prev == transferType || (prev == "" && transferType == TransferTypeBinary) {
+		return "", nil
 	}
-	return
+
+	return prev, c.Type(transferType)
 }
 
-// IsSetTimeSupported allows library callers to check in advance that they
-// can use SetTime to set file time.
-func (c *ServerConn) IsSetTimeSupported() bool {
-	return c.mfmtSupported || c.mdtmCanWrite
+// restoreType switches back to the transfer type returned by switchType.
+func (c *ServerConn) restoreType(transferType TransferType) error {
+	if transferType == "" {
+		return nil
+	}
+	return c.Type(transferType)
 }
 
-// Retr issues a RETR FTP command to fetch the specified file from the remote
-// FTP server.
+// NameList issues an NLST FTP command.
 //
-// The returned ReadCloser must be closed to cleanup the FTP data connection.
-func (c *ServerConn) Retr(path string) (*Response, error) {
-	return c.RetrFrom(path, 0)
+// With DialWithForceListHidden, NLST -a is sent to include the hidden files.
+// As some servers take the flag for a file name, the command is sent again
+// without the flag if the listing is refused or empty.
+func (c *ServerConn) NameList(path string) (entries []string, err error) {
+	space := " "
+	if path == "" {
+		space = ""
+	}
+
+	if c.options.forceListHidden {
+		entries, err = c.nameList("NLST -a%s%s", space, path)
+		var protoErr *textproto.Error
+		if len(entries) > 0 || (err != nil && !errors.As(err, &protoErr)) {
+			return entries, err
+		}
+	}
+	return c.nameList("NLST%s%s", space, path)
 }
 
-// RetrFrom issues a RETR FTP command to fetch the specified file from the remote
-// FTP server, the server will not send the offset first bytes of the file.
-//
-// The returned ReadCloser must be closed to cleanup the FTP data connection.
-func (c *ServerConn) RetrFrom(path string, offset uint64) (*Response, error) {
-	conn, err := c.cmdDataConnFrom(offset, "RETR %s", path)
+// nameList issues the given NLST FTP command and returns the listed names.
+func (c *ServerConn) nameList(format string, args ...interface{}) (entries []string, err error) {
+	conn, err := c.cmdDataConnSafe(0, format, args...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Response{conn: conn, c: c}, nil
-}
+	var errs *multierror.Error
 
-// Stor issues a STOR FTP command to store a file to the remote FTP server.
-// Stor creates the specified file with the content of the io.Reader.
-//
-// Hint: io.Pipe() can be used if an io.Writer is required.
-func (c *ServerConn) Stor(path string, r io.Reader) error {
-	return c.StorFrom(path, r, 0)
-}
+	r := &Response{conn: conn, c: c}
 
-// checkDataShut reads the "closing data connection" status from the
-// control connection. It is called after transferring a piece of data
-// on the data connection during which the control connection was idle.
-// This may result in the idle timeout triggering on the control connection
+	scanner := bufio.NewScanner(c.options.wrapStream(r))
+	for scanner.Scan() {
+		name, errDecode := c.options.decodeName(scanner.Text())
+		if errDecode != nil {
+			errs = multierror.Append(errs, errDecode)
+			continue
+		}
+		entries = append(entries, name)
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if err := r.Close(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return entries, errs.ErrorOrNil()
+}
+
+// List issues a LIST FTP command, or MLSD if the server supports it.
+//
+// If path is a file, its entry is returned alone: servers refusing MLSD on a
+// file are asked with MLST, and LIST usually lists the file itself.
+func (c *ServerConn) List(path string) (entries []*Entry, err error) {
+	err = c.listFunc(path, func(entry *Entry) {
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+// ListDirs is like List but only returns the directories. The current and
+// parent directories listed by some servers, like "." and "..", are excluded.
+func (c *ServerConn) ListDirs(path string) (entries []*Entry, err error) {
+	err = c.listFunc(path, func(entry *Entry) {
+		if entry.FileMode.IsDir() && !isDotEntry(entry) {
+			entries = append(entries, entry)
+		}
+	})
+	return entries, err
+}
+
+// ListFiles is like List but only returns the entries which are not
+// directories, like regular files and symbolic links.
+func (c *ServerConn) ListFiles(path string) (entries []*Entry, err error) {
+	err = c.listFunc(path, func(entry *Entry) {
+		if !entry.FileMode.IsDir() {
+			entries = append(entries, entry)
+		}
+	})
+	return entries, err
+}
+
+// ListStream is like List but sends the entries on the returned channel as they
+// are read from the data connection, instead of holding the whole listing in
+// memory. The entries channel is closed at the end of the listing, then the
+// error channel receives the error of the listing, if any, and is closed.
+//
+// The entries channel must be drained, or ctx canceled, as the listing
+// completes in the background and holds the connection until then. When ctx
+// is canceled, the transfer is aborted and the error channel receives the
+// error of ctx.
+func (c *ServerConn) ListStream(ctx context.Context, path string) (<-chan *Entry, <-chan error) {
+	entries := make(chan *Entry)
+	errs := make(chan error, 1)
+
+	go func() {
+		canceled := false
+		err := c.listUntil(path, func(entry *Entry) bool {
+			select {
+			case entries <- entry:
+				return true
+			case <-ctx.Done():
+				canceled = true
+				return false
+			}
+		})
+		if canceled && err == nil {
+			err = ctx.Err()
+		}
+		close(entries)
+		if err != nil {
+			errs <- err
+		}
+		close(errs)
+	}()
+
+	return entries, errs
+}
+
+// ListPage is like List but only returns the entries within
+// [offset, offset+limit) in the listing order. The other entries are discarded
+// as they are read, so that the memory used does not depend on the size of
+// the directory, while the whole listing is still read from the data
+// connection.
+func (c *ServerConn) ListPage(path string, offset, limit int) ([]*Entry, error) {
+	entries, _, err := c.listRange(path, offset, limit)
+	return entries, err
+}
+
+// listRange is like List but only returns the entries within
+// [offset, offset+limit) in the listing order, discarding the others while
+// still reading the whole listing. more is true if there are entries after
+// the returned ones.
+func (c *ServerConn) listRange(path string, offset, limit int) (entries []*Entry, more bool, err error) {
+	i := 0
+	err = c.listFunc(path, func(entry *Entry) {
+		if i >= offset && i < offset+limit {
+			entries = append(entries, entry)
+		}
+		i++
+	})
+	return entries, i > offset+limit, err
+}
+
+// ListedWith returns the FTP command used by the most recent listing, or an
+// empty ListMethod if no listing succeeded yet.
+func (c *ServerConn) ListedWith() ListMethod {
+	return c.listedWith
+}
+
+// listFunc issues a LIST FTP command, or MLSD if supported, and calls fn for
+// each entry of the listing as it is read. If LIST is not implemented by the
+// server, it falls back to NLST and the entries only have a name.
+func (c *ServerConn) listFunc(path string, fn func(*Entry)) error {
+	return c.listUntil(path, func(entry *Entry) bool {
+		fn(entry)
+		return true
+	})
+}
+
+// listUntil is like listFunc but stops the listing when fn returns false,
+// aborting the transfer.
+func (c *ServerConn) listUntil(path string, fn func(*Entry) bool) error {
+	var cmd string
+	var parser parseFunc
+	var method ListMethod
+
+	if c.mlstSupported && !c.options.forceListHidden {
+		cmd = "MLSD"
+		method = ListMethodMLSD
+		parser = parseRFC3659ListLine
+	} else {
+		cmd = "LIST"
+		method = ListMethodLIST
+		if c.options.forceListHidden {
+			cmd += " -a"
+		}
+		parser = parseListLine
+		if order := c.parserOrder(); order != nil {
+			parser = newListLineParser(order)
+		}
+	}
+
+	space := " "
+	if path == "" {
+		space = ""
+	}
+	conn, err := c.cmdDataConnSafe(0, "%s%s%s", cmd, space, path)
+	if err != nil && method == ListMethodLIST && isNotImplemented(err) {
+		method = ListMethodNLST
+		parser = parseNameListLine
+		conn, err = c.cmdDataConnSafe(0, "NLST%s%s", space, path)
+	}
+	if err != nil && method == ListMethodMLSD && path != "" && isPermanentError(err) {
+		// MLSD only lists directories: a file is described with MLST
+		if entry, errMLST := c.GetEntry(path); errMLST == nil && !entry.FileMode.IsDir() {
+			c.listedWith = method
+			fn(entry)
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	c.listedWith = method
+
+	var errs *multierror.Error
+
+	r := &Response{conn: conn, c: c}
+
+	c.unparsedLines = nil
+	count := 0
+	tooMany := false
+	stopped := false
+
+	scanner := bufio.NewScanner(c.options.wrapStream(r))
+	now := time.Now()
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isIgnoredListLine(line) {
+			continue
+		}
+
+		entry, errParse := parser(line, now, c.options.location)
+		if errParse != nil {
+			if c.options.lenientList {
+				c.unparsedLines = append(c.unparsedLines, line)
+			}
+			continue
+		}
+		if err := c.options.decodeEntry(entry); err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if !isDotEntry(entry) {
+			if c.options.maxListEntries > 0 && count == c.options.maxListEntries {
+				tooMany = true
+				break
+			}
+			count++
+		}
+		if !fn(entry) {
+			stopped = true
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if tooMany || stopped {
+		// Stop the transfer rather than reading the rest of the listing
+		if tooMany {
+			errs = multierror.Append(errs, fmt.Errorf("%w: more than %d", ErrTooManyEntries, c.options.maxListEntries))
+		}
+		if err := r.Abort(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		return errs.ErrorOrNil()
+	}
+	closeErr := r.Close()
+	if closeErr != nil {
+		errs = multierror.Append(errs, closeErr)
+	}
+
+	if c.options.truncationCheck && isRoundListCount(count) {
+		if closeErr != nil {
+			errs = multierror.Append(errs, ErrListTruncated)
+		} else if statCount, err := c.statEntryCount(path); err == nil && statCount > count {
+			errs = multierror.Append(errs, ErrListTruncated)
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// isNotImplemented reports whether err is the reply of a server which does not
+// implement a command.
+func isNotImplemented(err error) bool {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return false
+	}
+	return protoErr.Code == StatusBadCommand || protoErr.Code == StatusNotImplemented
+}
+
+// isRoundListCount reports whether count is a number of entries at which
+// servers are known to truncate listings.
+func isRoundListCount(count int) bool {
+	return count > 0 && count%1000 == 0
+}
+
+// isDotEntry reports whether the entry is the current or parent directory.
+func isDotEntry(entry *Entry) bool {
+	return entry.pseudoDir || entry.Name == "." || entry.Name == ".."
+}
+
+// statEntryCount issues a STAT FTP command on the given path and returns the
+// number of entries listed in the reply.
+func (c *ServerConn) statEntryCount(path string) (int, error) {
+	space := " "
+	if path == "" {
+		space = ""
+	}
+	_, msg, err := c.cmd(2, "STAT%s%s", space, path)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	now := time.Now()
+	for _, line := range strings.Split(msg, "\n") {
+		entry, err := parseListLine(strings.TrimSpace(line), now, c.options.location)
+		if err == nil && !isDotEntry(entry) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// UnparsedListLines returns the lines of the last List call which could not be
+// parsed. The lines are only collected with the DialWithLenientListParsing
+// option. Blank lines and "total" headers are never returned.
+func (c *ServerConn) UnparsedListLines() []string {
+	return c.unparsedLines
+}
+
+// GetEntry issues a MLST FTP command which retrieves one single Entry using the
+// control connection. The returnedEntry will describe the current directory
+// when no path is given.
+func (c *ServerConn) GetEntry(path string) (entry *Entry, err error) {
+	if !c.mlstSupported {
+		return nil, &textproto.Error{Code: StatusNotImplemented, Msg: StatusText(StatusNotImplemented)}
+	}
+	space := " "
+	if path == "" {
+		space = ""
+	}
+	_, msg, err := c.cmd(StatusRequestedFileActionOK, "%s%s%s", "MLST", space, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The expected reply will look something like:
+	//
+	//    250-File details
+	//     Type=file;Size=1024;Modify=20220813133357; path
+	//    250 End
+	//
+	// Multiple lines are allowed though, so it can also be in the form:
+	//
+	//    250-File details
+	//     Type=file;Size=1024; path
+	//     Modify=20220813133357; path
+	//    250 End
+	lines := strings.Split(msg, "\n")
+	lc := len(lines)
+
+	// lines must be a multi-line message with a length of 3 or more, and we
+	// don't care about the first and last line
+	if lc < 3 {
+		return nil, errors.New("invalid response")
+	}
+
+	e := &Entry{}
+	for _, l := range lines[1 : lc-1] {
+		// According to RFC 3659, the entry lines must start with a space when passed over the
+		// control connection. Some servers don't seem to add that space though. Both forms are
+		// accepted here.
+		if len(l) > 0 && l[0] == ' ' {
+			l = l[1:]
+		}
+		// Some severs seem to send a blank line at the end which we ignore
+		if l == "" {
+			continue
+		}
+		if e, err = parseNextRFC3659ListLine(l, c.options.location, e); err != nil {
+			return nil, err
+		}
+	}
+	if err = c.options.decodeEntry(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// LastResponse returns the code and message of the most recent reply of the
+// server, including the replies turned into errors. The code is 0 if no reply
+// was received yet.
+//
+// This is useful to report the raw text of the server, eg. when a command
+// failed.
+func (c *ServerConn) LastResponse() (code int, message string) {
+	return c.lastCode, c.lastMsg
+}
+
+// Stats returns the counters of the connection since it was opened.
+func (c *ServerConn) Stats() Stats {
+	c.statsMu.Lock()
+	stats := c.stats
+	c.statsMu.Unlock()
+
+	stats.Uptime = time.Since(c.connected)
+	return stats
+}
+
+// IsTimePreciseInList returns true if client and server support the MLSD
+// command so List can return time with 1-second precision for all files.
+func (c *ServerConn) IsTimePreciseInList() bool {
+	return c.mlstSupported
+}
+
+// ChangeDir issues a CWD FTP command, which changes the current directory to
+// the specified path.
+//
+// With the DialWithVerifyChdir option, the new current directory is checked
+// with PWD and ErrChangeDirNotApplied is returned if the server remained in
+// the previous directory. A directory different from the requested one is
+// accepted as long as it changed, as servers may resolve symbolic links.
+//
+// With the DialWithCWDCache option, nothing is sent if the connection is
+// already in the directory.
+func (c *ServerConn) ChangeDir(path string) error {
+	target := c.cwdTarget(path)
+	if target != "" && target == c.cwd {
+		return nil
+	}
+	c.cwd = ""
+
+	if !c.options.verifyChdir {
+		_, _, err := c.cmd(StatusRequestedFileActionOK, "CWD %s", path)
+		if err == nil {
+			c.cwd = target
+		}
+		return err
+	}
+
+	prev, err := c.CurrentDir()
+	if err != nil {
+		return err
+	}
+	if _, _, err = c.cmd(StatusRequestedFileActionOK, "CWD %s", path); err != nil {
+		c.cwd = ""
+		return err
+	}
+	cur, err := c.CurrentDir()
+	if err != nil {
+		return err
+	}
+
+	if !isDirChanged(prev, cur, path) {
+		return ErrChangeDirNotApplied
+	}
+	return nil
+}
+
+// cwdTarget returns the directory the connection will be in after changing
+// to dir, with the DialWithCWDCache option, or an empty string if unknown.
+//
+// A dir going up with ".." is unknown: after a symbolic link, the server goes
+// to the parent of the target of the link rather than the lexical parent.
+func (c *ServerConn) cwdTarget(dir string) string {
+	if !c.options.cwdCache {
+		return ""
+	}
+	for _, elem := range strings.Split(dir, "/") {
+		if elem == ".." {
+			return ""
+		}
+	}
+	if path.IsAbs(dir) {
+		return path.Clean(dir)
+	}
+	if c.cwd == "" {
+		return ""
+	}
+	return path.Join(c.cwd, dir)
+}
+
+// isDirChanged reports whether moving from the prev directory to dir, as
+// requested, led to the cur directory. Any directory but prev is accepted, as
+// servers may resolve symbolic links.
+func isDirChanged(prev, cur, dir string) bool {
+	prev, cur = path.Clean(prev), path.Clean(cur)
+	if !path.IsAbs(dir) {
+		dir = path.Join(prev, dir)
+	}
+	return cur != prev || cur == path.Clean(dir)
+}
+
+// ChangeDirToParent issues a CDUP FTP command, which changes the current
+// directory to the parent directory.  This is similar to a call to ChangeDir
+// with a path set to "..".
+//
+// If the server rejects CDUP with a permanent error, "CWD .." is tried
+// instead. The move is then verified with a PWD FTP command and the new
+// current directory is returned. ErrAlreadyAtRoot is returned when the
+// current directory is the root directory and the server refuses to go up.
+func (c *ServerConn) ChangeDirToParent() (string, error) {
+	c.cwd = ""
+	_, _, err := c.cmd(StatusRequestedFileActionOK, "CDUP")
+	if isPermanentError(err) {
+		_, _, err = c.cmd(StatusRequestedFileActionOK, "CWD ..")
+	}
+	if err != nil {
+		if isPermanentError(err) {
+			if dir, errPwd := c.CurrentDir(); errPwd == nil && dir == "/" {
+				return "", ErrAlreadyAtRoot
+			}
+		}
+		return "", err
+	}
+
+	return c.CurrentDir()
+}
+
+// CurrentDir issues a PWD FTP command, which Returns the path of the current
+// directory.
+func (c *ServerConn) CurrentDir() (string, error) {
+	_, msg, err := c.cmd(StatusPathCreated, "PWD")
+	if err != nil {
+		return "", err
+	}
+
+	dir, ok := parseQuotedPath(msg)
+	if !ok {
+		return "", errors.New("unsuported PWD response format")
+	}
+	if c.options.cwdCache {
+		c.cwd = dir
+	}
+	return dir, nil
+}
+
+// parseQuotedPath returns the path quoted in a 257 reply. As defined in
+// RFC 959, the quotes in the path are doubled, and the path may be followed
+// by a comment.
+func parseQuotedPath(msg string) (string, bool) {
+	start := strings.Index(msg, "\"")
+	if start == -1 {
+		return "", false
+	}
+
+	var b strings.Builder
+	for i := start + 1; i < len(msg); i++ {
+		if msg[i] != '"' {
+			b.WriteByte(msg[i])
+			continue
+		}
+		if i+1 < len(msg) && msg[i+1] == '"' {
+			b.WriteByte('"')
+			i++
+			continue
+		}
+		return b.String(), true
+	}
+	return "", false
+}
+
+// AbsPath returns the absolute path of p, joined to the current directory
+// if it is relative.
+func (c *ServerConn) AbsPath(p string) (string, error) {
+	if path.IsAbs(p) {
+		return path.Clean(p), nil
+	}
+
+	dir, err := c.CurrentDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, p), nil
+}
+
+// FileSize issues a SIZE FTP command, which Returns the size of the file
+//
+// When the server replies with 550, the error matches ErrFileNotFound with
+// errors.Is if the message tells that the file does not exist, and
+// ErrPermission otherwise. The *textproto.Error is still available with
+// errors.As. As the messages vary between servers, this is best-effort.
+//
+// As SIZE is only defined in binary mode by RFC 3659, and some servers refuse
+// it otherwise, the transfer type is switched to binary for the command, and
+// then restored.
+func (c *ServerConn) FileSize(path string) (int64, error) {
+	prev, err := c.switchType(TransferTypeBinary)
+	if err != nil {
+		return 0, err
+	}
+
+	_, msg, err := c.cmdSafe(StatusFile, "SIZE %s", path)
+	if err != nil {
+		err = classifyFileError(err)
+	}
+	if errType := c.restoreType(prev); errType != nil {
+		if err == nil {
+			return 0, errType
+		}
+		err = multierror.Append(err, errType)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(msg, 10, 64)
+}
+
+// GetTime issues the MDTM FTP command to obtain the file modification time.
+// It returns a UTC time.
+func (c *ServerConn) GetTime(path string) (time.Time, error) {
+	var t time.Time
+	if !c.mdtmSupported {
+		return t, errors.New("GetTime is not supported")
+	}
+	_, msg, err := c.cmdSafe(StatusFile, "MDTM %s", path)
+	if err != nil {
+		return t, err
+	}
+	return time.ParseInLocation(timeFormat, msg, time.UTC)
+}
+
+// IsGetTimeSupported allows library callers to check in advance that they
+// can use GetTime to get file time.
+func (c *ServerConn) IsGetTimeSupported() bool {
+	return c.mdtmSupported
+}
+
+// SetTime issues the MFMT FTP command to set the file modification time.
+// Also it can use a non-standard form of the MDTM command supported by
+// the VsFtpd server instead of MFMT for the same purpose.
+// See "mdtm_write" in https://security.appspot.com/vsftpd/vsftpd_conf.html
+//
+// Both commands take the time in UTC, whatever the location set with
+// DialWithLocation.
+func (c *ServerConn) SetTime(path string, t time.Time) (err error) {
+	utime := t.In(time.UTC).Format(timeFormat)
+	switch {
+	case c.mfmtSupported:
+		_, _, err = c.cmd(StatusFile, "MFMT %s %s", utime, path)
+	case c.mdtmCanWrite:
+		_, _, err = c.cmd(StatusFile, "MDTM %s %s", utime, path)
+	default:
+		err = errors.New("SetTime is not supported")
+	}
+	return
+}
+
+// SetFacts issues a MFF FTP command, defined in RFC 3659, to set the given facts
+// of a file, like "UNIX.mode", "UNIX.owner" or "UNIX.group".
+//
+// ErrMFFNotSupported is returned when the server does not advertise MFF, and
+// ErrFactNotSupported, before sending anything, when one of the facts is not
+// advertised as modifiable. At least one fact must be given.
+func (c *ServerConn) SetFacts(path string, facts map[string]string) error {
+	params, ok := c.features["MFF"]
+	if !ok {
+		return ErrMFFNotSupported
+	}
+	if len(facts) == 0 {
+		return errors.New("no facts to set")
+	}
+
+	supported := make(map[string]bool)
+	for _, fact := range strings.Split(params, ";") {
+		if fact != "" {
+			supported[strings.ToLower(fact)] = true
+		}
+	}
+
+	names := make([]string, 0, len(facts))
+	for name := range facts {
+		if !supported[strings.ToLower(name)] {
+			return fmt.Errorf("%w: %s", ErrFactNotSupported, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name + "=" + facts[name] + ";")
+	}
+
+	_, _, err := c.cmd(StatusFile, "MFF %s %s", sb.String(), path)
+	return err
+}
+
+// SetMLSTFacts issues an OPTS MLST FTP command, defined in RFC 3659, to select
+// the facts returned by the server for the next MLSD and MLST commands, eg.
+// "type", "size" and "modify". The facts which are not selected are not sent,
+// which reduces the size of the listings.
+//
+// ErrMLSTNotSupported is returned when the server does not advertise MLST, and
+// ErrUnknownFact, before sending anything, when one of the facts is not listed
+// by the server.
+func (c *ServerConn) SetMLSTFacts(facts ...string) error {
+	params, ok := c.features["MLST"]
+	if !ok {
+		return ErrMLSTNotSupported
+	}
+
+	// The facts selected by default are marked with an asterisk
+	supported := make(map[string]bool)
+	for _, fact := range strings.Split(params, ";") {
+		supported[strings.ToLower(strings.TrimSuffix(fact, "*"))] = true
+	}
+
+	var sb strings.Builder
+	for _, fact := range facts {
+		if !supported[strings.ToLower(fact)] {
+			return fmt.Errorf("%w: %s", ErrUnknownFact, fact)
+		}
+		sb.WriteString(fact + ";")
+	}
+
+	_, _, err := c.cmd(StatusCommandOK, "OPTS MLST %s", sb.String())
+	return err
+}
+
+// ClockSkew estimates the difference between the clock of the server and the
+// local clock. A positive duration means that the server clock is ahead.
+//
+// A temporary empty file is stored in the current directory and the
+// modification time assigned to it by the server is compared to the local
+// time of the upload. If SetTime is supported, a known time is also set on
+// the file and read back to correct the estimate of servers which do not
+// report times in UTC. The temporary file is removed afterwards.
+// The estimate is only precise to about one second.
+func (c *ServerConn) ClockSkew() (skew time.Duration, err error) {
+	if !c.mdtmSupported {
+		return 0, errors.New("ClockSkew is not supported")
+	}
+
+	path := ".clockskew-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	before := time.Now()
+	if err = c.Stor(path, strings.NewReader("")); err != nil {
+		return 0, err
+	}
+	after := time.Now()
+
+	defer func() {
+		if errDelete := c.Delete(path); errDelete != nil && err == nil {
+			err = errDelete
+		}
+	}()
+
+	serverNow, err := c.GetTime(path)
+	if err != nil {
+		return 0, err
+	}
+	localNow := before.Add(after.Sub(before) / 2).Truncate(time.Second)
+	skew = serverNow.Sub(localNow)
+
+	if c.IsSetTimeSupported() {
+		known := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		if err = c.SetTime(path, known); err != nil {
+			return 0, err
+		}
+		readBack, err := c.GetTime(path)
+		if err != nil {
+			return 0, err
+		}
+		skew -= readBack.Sub(known)
+	}
+
+	return skew, nil
+}
+
+// IsSetTimeSupported allows library callers to check in advance that they
+// can use SetTime to set file time.
+func (c *ServerConn) IsSetTimeSupported() bool {
+	return c.mfmtSupported || c.mdtmCanWrite
+}
+
+// Retr issues a RETR FTP command to fetch the specified file from the remote
+// FTP server.
+//
+// The returned ReadCloser must be closed to cleanup the FTP data connection.
+func (c *ServerConn) Retr(path string) (*Response, error) {
+	return c.RetrFrom(path, 0)
+}
+
+// RetrAscii is like Retr but transfers the file in ASCII mode, letting the
+// server translate the line endings. The previous transfer type is restored
+// when the Response is closed, or on error.
+func (c *ServerConn) RetrAscii(path string) (*Response, error) {
+	prev, err := c.switchType(TransferTypeASCII)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.RetrFrom(path, 0)
+	if err != nil {
+		if errType := c.restoreType(prev); errType != nil {
+			err = multierror.Append(err, errType)
+		}
+		return nil, err
+	}
+
+	r.restoreType = prev
+	return r, nil
+}
+
+// RetrFrom issues a RETR FTP command to fetch the specified file from the remote
+// FTP server, the server will not send the offset first bytes of the file.
+//
+// The returned ReadCloser must be closed to cleanup the FTP data connection.
+func (c *ServerConn) RetrFrom(path string, offset uint64) (*Response, error) {
+	// The size of a file transferred in ASCII mode may change
+	expected := int64(-1)
+	if c.options.verifySize && c.transferType != TransferTypeASCII {
+		if size, err := c.FileSize(path); err == nil && size >= int64(offset) {
+			expected = size - int64(offset)
+		}
+	}
+
+	conn, err := c.cmdDataConnSafe(offset, "RETR %s", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{conn: conn, c: c, verify: expected >= 0, expected: expected}, nil
+}
+
+// TransferStatus issues a STAT FTP command during a data transfer, as allowed
+// by RFC 959, and returns the status of the transfer sent by the server.
+//
+// It is meant to be called from another goroutine while a transfer started by
+// Retr or List is in progress, and returns ErrNoTransfer otherwise. The
+// transfer itself is not disrupted: if the server completes the transfer
+// before answering, its closing status is kept for Response.Close.
+func (c *ServerConn) TransferStatus() (string, error) {
+	c.shutMu.Lock()
+	defer c.shutMu.Unlock()
+
+	if !c.inTransfer() {
+		return "", ErrNoTransfer
+	}
+
+	if _, err := c.sendCmd("STAT"); err != nil {
+		return "", err
+	}
+
+	for {
+		code, msg, err := c.readResponse(-1)
+		if err != nil {
+			return "", err
+		}
+
+		switch code {
+		case StatusSystem, StatusDirectory, StatusFile:
+			return msg, nil
+		case StatusClosingDataConnection, StatusRequestedFileActionOK,
+			StatusTransfertAborted, StatusActionAborted, Status452,
+			StatusPageTypeUnknown, StatusExceededStorage:
+			if c.pendingShut == nil {
+				// The transfer completed before the STAT reply
+				c.pendingShut = &textproto.Error{Code: code, Msg: msg}
+				continue
+			}
+		}
+		return "", &textproto.Error{Code: code, Msg: msg}
+	}
+}
+
+// RetrLazy is like Retr but the RETR FTP command is only issued, and the data
+// connection opened, on the first call to Read of the returned ReadCloser.
+//
+// Closing the ReadCloser before any Read does not send anything to the server.
+// Otherwise it must be closed to cleanup the FTP data connection.
+func (c *ServerConn) RetrLazy(path string) (io.ReadCloser, error) {
+	return &lazyResponse{c: c, path: path}, nil
+}
+
+// lazyResponse is the io.ReadCloser returned by RetrLazy
+type lazyResponse struct {
+	c      *ServerConn
+	path   string
+	resp   *Response
+	err    error
+	closed bool
+}
+
+// Read implements the io.Reader interface, issuing the RETR FTP command on
+// the first call.
+func (r *lazyResponse) Read(buf []byte) (int, error) {
+	if r.closed {
+		return 0, net.ErrClosed
+	}
+	if r.resp == nil && r.err == nil {
+		r.resp, r.err = r.c.Retr(r.path)
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.resp.Read(buf)
+}
+
+// Close implements the io.Closer interface, closing the data connection if it
+// was opened.
+func (r *lazyResponse) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	if r.resp == nil {
+		return nil
+	}
+	return r.resp.Close()
+}
+
+// ReadFile downloads the specified file and returns its content. If the file
+// is larger than the limit set with DialWithMaxReadFileSize, the transfer is
+// aborted and ErrFileTooLarge is returned.
+func (c *ServerConn) ReadFile(path string) ([]byte, error) {
+	limit := c.options.maxReadFileSize
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid maximum file size %d", limit)
+	}
+
+	r, err := c.Retr(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read one byte past the limit to detect larger files.
+	n := limit
+	if n < math.MaxInt64 {
+		n++
+	}
+	data, err := io.ReadAll(io.LimitReader(r, n))
+	if err == nil && int64(len(data)) > limit {
+		err = fmt.Errorf("%w: %s is larger than %d bytes", ErrFileTooLarge, path, limit)
+	}
+	if err != nil {
+		_ = r.Abort()
+		return nil, err
+	}
+
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFile stores data in the specified file, creating or truncating it.
+func (c *ServerConn) WriteFile(path string, data []byte) error {
+	return c.Stor(path, bytes.NewReader(data))
+}
+
+// Stor issues a STOR FTP command to store a file to the remote FTP server.
+// Stor creates the specified file with the content of the io.Reader.
+//
+// Hint: io.Pipe() can be used if an io.Writer is required.
+func (c *ServerConn) Stor(path string, r io.Reader) error {
+	return c.StorFrom(path, r, 0)
+}
+
+// StorAscii is like Stor but transfers the file in ASCII mode, letting the
+// server translate the line endings. The previous transfer type is restored
+// afterwards, even on error.
+func (c *ServerConn) StorAscii(path string, r io.Reader) error {
+	prev, err := c.switchType(TransferTypeASCII)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+
+	if err := c.StorFrom(path, r, 0); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	if err := c.restoreType(prev); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// StorText is like Stor but translates the line endings of the io.Reader on
+// the client side, for servers translating them poorly in ASCII mode. Both
+// "\n" and "\r\n" are replaced with lineEnding, "\r\n" if empty, and the
+// file is transferred in binary mode. The previous transfer type is restored
+// afterwards, even on error.
+func (c *ServerConn) StorText(path string, r io.Reader, lineEnding string) error {
+	if lineEnding == "" {
+		lineEnding = "\r\n"
+	}
+
+	prev, err := c.switchType(TransferTypeBinary)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+
+	if err := c.StorFrom(path, newLineEndingReader(r, lineEnding), 0); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	if err := c.restoreType(prev); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// StorRetryable is like Stor but retries the upload once from the start if it
+// fails, which is not possible otherwise with a non-seekable io.Reader.
+//
+// Up to maxBufferedBytes of the io.Reader are kept in memory to be sent again.
+// Once more bytes were read, the upload is committed and is not retried.
+// Uploads rejected with a permanent error (5xx) are not retried either.
+func (c *ServerConn) StorRetryable(path string, r io.Reader, maxBufferedBytes int) error {
+	rr := &replayReader{r: r, max: maxBufferedBytes}
+
+	err := c.Stor(path, rr)
+	if err != nil && !isPermanentError(err) && rr.rewind() {
+		err = c.Stor(path, rr)
+	}
+	return err
+}
+
+// replayReader records the first bytes read from an io.Reader, up to max,
+// so that they can be read again after a rewind.
+type replayReader struct {
+	r         io.Reader
+	max       int
+	buf       []byte
+	off       int  // read offset in buf
+	committed bool // more than max bytes were read
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	if rr.off < len(rr.buf) {
+		n := copy(p, rr.buf[rr.off:])
+		rr.off += n
+		return n, nil
+	}
+
+	n, err := rr.r.Read(p)
+	if !rr.committed {
+		if len(rr.buf)+n <= rr.max {
+			rr.buf = append(rr.buf, p[:n]...)
+			rr.off = len(rr.buf)
+		} else {
+			rr.committed = true
+			rr.buf = nil
+			rr.off = 0
+		}
+	}
+	return n, err
+}
+
+// rewind restarts the reading from the first byte. It returns false if this
+// is not possible as more than max bytes were read.
+func (rr *replayReader) rewind() bool {
+	if rr.committed {
+		return false
+	}
+	rr.off = 0
+	return true
+}
+
+// lineEndingReader replaces the line endings of an io.Reader, either "\n" or
+// "\r\n", with the given one. A lone "\r" is kept as is.
+type lineEndingReader struct {
+	r      io.Reader
+	ending string
+	in     []byte
+	buf    []byte
+	out    []byte // translated bytes not read yet, in buf
+	cr     bool   // the last byte read is a pending "\r"
+	err    error
+}
+
+func newLineEndingReader(r io.Reader, ending string) *lineEndingReader {
+	return &lineEndingReader{r: r, ending: ending, in: make([]byte, 32*1024)}
+}
+
+func (lr *lineEndingReader) Read(p []byte) (int, error) {
+	for len(lr.out) == 0 {
+		if lr.err != nil {
+			return 0, lr.err
+		}
+
+		n, err := lr.r.Read(lr.in)
+		out := lr.buf[:0]
+		for _, b := range lr.in[:n] {
+			if lr.cr {
+				lr.cr = false
+				if b == '\n' {
+					out = append(out, lr.ending...)
+					continue
+				}
+				out = append(out, '\r')
+			}
+			switch b {
+			case '\r':
+				lr.cr = true
+			case '\n':
+				out = append(out, lr.ending...)
+			default:
+				out = append(out, b)
+			}
+		}
+		if err != nil {
+			if lr.cr {
+				lr.cr = false
+				out = append(out, '\r')
+			}
+			lr.err = err
+		}
+		lr.buf, lr.out = out, out
+	}
+
+	n := copy(p, lr.out)
+	lr.out = lr.out[n:]
+	return n, nil
+}
+
+// checkDataShut reads the "closing data connection" status from the
+// control connection. It is called after transferring a piece of data
+// on the data connection during which the control connection was idle.
+// This may result in the idle timeout triggering on the control connection
 // right when we try to read the response.
 // The ShutTimeout dial option will rescue here. It will nudge the control
 // connection deadline right before checking the data closing status.
 func (c *ServerConn) checkDataShut() error {
+	_, _, err := c.readDataShut(StatusClosingDataConnection)
+	return err
+}
+
+// readDataShut reads the "closing data connection" status like checkDataShut
+// and returns it.
+func (c *ServerConn) readDataShut(expected int) (int, string, error) {
+	c.shutMu.Lock()
+	defer c.shutMu.Unlock()
+	defer c.endTransfer()
+	return c.readShut(expected)
+}
+
+// readShut reads the closing status of a data transfer, which still holds
+// the control connection. The caller must hold shutMu.
+func (c *ServerConn) readShut(expected int) (int, string, error) {
+	if shut := c.pendingShut; shut != nil {
+		c.pendingShut = nil
+		c.lastCode, c.lastMsg = shut.Code, shut.Msg
+		if !isExpectedCode(shut.Code, expected) {
+			return shut.Code, shut.Msg, shut
+		}
+		return shut.Code, shut.Msg, nil
+	}
+
 	if c.options.shutTimeout != 0 {
 		shutDeadline := time.Now().Add(c.options.shutTimeout)
-		if err := c.netConn.SetDeadline(shutDeadline); err != nil {
+		if err := c.setDeadline(shutDeadline); err != nil {
+			return 0, "", err
+		}
+	}
+
+	for {
+		code, msg, err := c.readResponse(expected)
+		// Some servers send several preliminary replies before the data,
+		// like 125 then 150: the ones not read yet are skipped
+		if code/100 == 1 {
+			continue
+		}
+		return code, msg, err
+	}
+}
+
+// StorFrom issues a STOR FTP command to store a file to the remote FTP server.
+// Stor creates the specified file with the content of the io.Reader, writing
+// on the server will start at the given file offset.
+//
+// Hint: io.Pipe() can be used if an io.Writer is required.
+func (c *ServerConn) StorFrom(path string, r io.Reader, offset uint64) error {
+	conn, err := c.cmdDataConnFrom(offset, "STOR %s", path)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+
+	// if the upload fails we still need to try to read the server
+	// response otherwise if the failure is not due to a connection problem,
+	// for example the server denied the upload for quota limits, we miss
+	// the response and we cannot use the connection to send other commands.
+	if err := c.sendData(conn, r); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	if err := c.checkDataShut(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// StorWithSize is like Stor but announces the size of the file with an ALLO
+// FTP command first, if the server advertises it, so that it can preallocate
+// the space or check the quota. ALLO is advisory: its failures are ignored,
+// except the 452 and 552 replies telling that there is not enough storage,
+// which are returned before any data is sent.
+func (c *ServerConn) StorWithSize(path string, r io.Reader, size int64) error {
+	if _, ok := c.features["ALLO"]; ok {
+		code, msg, err := c.cmd(-1, "ALLO %d", size)
+		if err != nil {
 			return err
 		}
+		if code == Status452 || code == StatusExceededStorage {
+			return &textproto.Error{Code: code, Msg: msg}
+		}
+	}
+	return c.Stor(path, r)
+}
+
+// StorFile is like Stor but uploads the content of a file. On plaintext data
+// connections, the file is sent with ReadFrom of the TCP connection, which
+// uses the zero-copy mechanisms of the system like sendfile, unless the
+// bandwidth is limited by DialWithRateLimit. Such an upload can only be paused
+// by PauseTransfer before it starts. Other connections, like TLS ones, use the
+// buffered copy of Stor.
+func (c *ServerConn) StorFile(path string, f *os.File) error {
+	conn, err := c.cmdDataConnFrom(0, "STOR %s", path)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok && c.limiter == nil {
+		c.gate.wait()
+		n, err := tcpConn.ReadFrom(f)
+		c.countData(n, 0)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		if err := conn.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	} else if err := c.sendData(conn, f); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	if err := c.checkDataShut(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// StorResume is like Stor but resumes an interrupted upload of the content of
+// the io.Reader: the size of the remote file is queried with a SIZE FTP
+// command, that many bytes of the io.Reader are skipped, and the rest is
+// stored from that offset with REST and STOR. A missing file is uploaded from
+// the start. The new size of the remote file is returned on success.
+//
+// The io.Reader is expected at the start of the content. It is sought if it
+// implements io.Seeker, read and discarded otherwise. ErrRemoteFileLarger is
+// returned, before anything is stored, if the remote file is larger than the
+// content.
+func (c *ServerConn) StorResume(path string, r io.Reader) (int64, error) {
+	size, err := c.FileSize(path)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code == StatusFileUnavailable {
+		size, err = 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if size > 0 {
+		if err := skipContent(r, size); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := c.StorFrom(path, r, uint64(size)); err != nil {
+		return 0, err
+	}
+
+	return c.FileSize(path)
+}
+
+// skipContent skips the first n bytes of r, seeking it if it implements
+// io.Seeker, and returns ErrRemoteFileLarger if r is shorter.
+func skipContent(r io.Reader, n int64) error {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		_, err := io.CopyN(io.Discard, r, n)
+		if err == io.EOF {
+			return ErrRemoteFileLarger
+		}
+		return err
+	}
+
+	// Seeking past the end is allowed, so the length is checked first
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if end-start < n {
+		_, _ = seeker.Seek(start, io.SeekStart)
+		return ErrRemoteFileLarger
+	}
+	_, err = seeker.Seek(start+n, io.SeekStart)
+	return err
+}
+
+// StorWithCheckpoints is like Stor but checks with a SIZE FTP command, after
+// each interval bytes sent, that the server persists the uploaded data.
+//
+// The upload is stopped early with ErrUploadNotPersisted when the remote file
+// lags behind the data sent by more than interval bytes, which catches
+// conditions like a full disk before sending the whole file. The partial file
+// is left on the server. The interval must be positive.
+//
+// As most servers do not read commands during a transfer, the checks are sent
+// on a second connection, opened like with Clone. The ServerConn must have
+// been opened with Dial, and DialWithStoredCredentials must be used if it is
+// logged in.
+func (c *ServerConn) StorWithCheckpoints(path string, r io.Reader, interval int64) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid checkpoint interval %d", interval)
+	}
+
+	checker, err := c.Clone()
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.cmdDataConnFrom(0, "STOR %s", path)
+	if err != nil {
+		_ = checker.Quit()
+		return err
+	}
+
+	cr := &checkpointReader{
+		Reader:   r,
+		interval: interval,
+		next:     interval,
+		check: func(sent int64) error {
+			size, err := checker.FileSize(path)
+			if err != nil {
+				return err
+			}
+			if size < sent-interval {
+				return ErrUploadNotPersisted
+			}
+			return nil
+		},
+	}
+
+	var errs *multierror.Error
+
+	if err := c.sendData(conn, cr); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	if err := c.checkDataShut(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	if err := checker.Quit(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// checkpointReader is an io.Reader calling check each time interval bytes
+// were read, before reading more. Reading fails with the error of check.
+type checkpointReader struct {
+	io.Reader
+	interval int64
+	sent     int64
+	next     int64
+	check    func(sent int64) error
+}
+
+func (r *checkpointReader) Read(buf []byte) (int, error) {
+	if r.sent >= r.next {
+		if err := r.check(r.sent); err != nil {
+			return 0, err
+		}
+		r.next += r.interval
 	}
-	_, _, err := c.conn.ReadResponse(StatusClosingDataConnection)
-	return err
-}
 
-// StorFrom issues a STOR FTP command to store a file to the remote FTP server.
-// Stor creates the specified file with the content of the io.Reader, writing
-// on the server will start at the given file offset.
-//
-// Hint: io.Pipe() can be used if an io.Writer is required.
-func (c *ServerConn) StorFrom(path string, r io.Reader, offset uint64) error {
-	conn, err := c.cmdDataConnFrom(offset, "STOR %s", path)
-	if err != nil {
-		return err
+	if max := r.next - r.sent; int64(len(buf)) > max {
+		buf = buf[:max]
 	}
+	n, err := r.Reader.Read(buf)
+	r.sent += int64(n)
+	return n, err
+}
 
+// sendData copies the content of the io.Reader to the data connection and
+// closes it.
+func (c *ServerConn) sendData(conn net.Conn, r io.Reader) error {
 	var errs *multierror.Error
 
-	// if the upload fails we still need to try to read the server
-	// response otherwise if the failure is not due to a connection problem,
-	// for example the server denied the upload for quota limits, we miss
-	// the response and we cannot use the connection to send other commands.
-	if n, err := io.Copy(conn, r); err != nil {
+	n, err := c.copyData(conn, &gatedReader{Reader: r, gate: &c.gate, limiter: c.limiter})
+	c.countData(n, 0)
+	if err != nil {
 		errs = multierror.Append(errs, err)
 	} else if n == 0 {
 		// If we wrote no bytes and got no error, make sure we call
@@ -962,11 +3658,54 @@ func (c *ServerConn) StorFrom(path string, r io.Reader, offset uint64) error {
 		errs = multierror.Append(errs, err)
 	}
 
-	if err := c.checkDataShut(); err != nil {
+	return errs.ErrorOrNil()
+}
+
+// StorUnique issues a STOU FTP command to store a file to the remote FTP
+// server under a unique name chosen by the server, which is returned.
+//
+// The format of the name in the server replies is not standardized: it is
+// looked up as "FILE: name" or as a quoted name in the preliminary reply, then
+// in a 250 completion reply. An empty name with a nil error means that the
+// upload succeeded but that the server did not tell the name, which must be
+// discovered by listing the directory.
+func (c *ServerConn) StorUnique(r io.Reader) (remoteName string, err error) {
+	conn, msg, err := c.cmdDataConnReply(0, "STOU")
+	if err != nil {
+		return "", err
+	}
+
+	var errs *multierror.Error
+
+	remoteName = uniqueName(msg)
+
+	if err := c.sendData(conn, r); err != nil {
 		errs = multierror.Append(errs, err)
 	}
 
-	return errs.ErrorOrNil()
+	code, msg, err := c.readDataShut(2)
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	} else if remoteName == "" && code == StatusRequestedFileActionOK {
+		remoteName = uniqueName(msg)
+	}
+
+	if err := errs.ErrorOrNil(); err != nil {
+		return "", err
+	}
+	return remoteName, nil
+}
+
+// uniqueName returns the name given in a reply to STOU, either as
+// "FILE: name" or quoted, or an empty string if the reply has none.
+func uniqueName(msg string) string {
+	if i := strings.Index(msg, "FILE:"); i >= 0 {
+		return strings.TrimSpace(msg[i+len("FILE:"):])
+	}
+	if name, ok := parseQuotedPath(msg); ok {
+		return name
+	}
+	return ""
 }
 
 // Append issues a APPE FTP command to store a file to the remote FTP server.
@@ -982,7 +3721,9 @@ func (c *ServerConn) Append(path string, r io.Reader) error {
 
 	var errs *multierror.Error
 
-	if _, err := io.Copy(conn, r); err != nil {
+	n, err := c.copyData(conn, &gatedReader{Reader: r, gate: &c.gate, limiter: c.limiter})
+	c.countData(n, 0)
+	if err != nil {
 		errs = multierror.Append(errs, err)
 	}
 
@@ -997,7 +3738,38 @@ func (c *ServerConn) Append(path string, r io.Reader) error {
 	return errs.ErrorOrNil()
 }
 
+// AppendVerified is like Append but guards against appending twice the same
+// data when a previous attempt partially succeeded.
+//
+// The size of the remote file is first checked with a SIZE FTP command and
+// ErrAppendSizeMismatch is returned without appending if it is not
+// expectedStartSize, so the caller can reconcile. A missing file is considered
+// to be empty. The new size of the remote file is returned on success.
+func (c *ServerConn) AppendVerified(path string, r io.Reader, expectedStartSize int64) (int64, error) {
+	size, err := c.FileSize(path)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code == StatusFileUnavailable {
+		size, err = 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if size != expectedStartSize {
+		return size, ErrAppendSizeMismatch
+	}
+
+	if err := c.Append(path, r); err != nil {
+		return 0, err
+	}
+
+	return c.FileSize(path)
+}
+
 // Rename renames a file on the remote FTP server.
+//
+// The RNFR FTP command must be answered with exactly 350 and the RNTO FTP
+// command with exactly 250, otherwise a *textproto.Error is returned. RNTO is
+// not sent when RNFR fails.
 func (c *ServerConn) Rename(from, to string) error {
 	_, _, err := c.cmd(StatusRequestFilePending, "RNFR %s", from)
 	if err != nil {
@@ -1015,6 +3787,53 @@ func (c *ServerConn) Delete(path string) error {
 	return err
 }
 
+// deleteWindow is the number of DELE commands sent by DeleteAll ahead of the
+// reply to the oldest one.
+const deleteWindow = 16
+
+// DeleteAll deletes the specified files from the remote FTP server with DELE
+// FTP commands. The commands are pipelined: up to 16 are sent before their
+// replies are read, which hides the latency of the connection.
+//
+// All the files are tried: the failures are returned together as
+// *fs.PathError in a *multierror.Error. If the control connection fails, the
+// remaining files are not deleted.
+func (c *ServerConn) DeleteAll(paths []string) error {
+	if err := c.claim(); err != nil {
+		return err
+	}
+	defer c.unclaim()
+
+	c.keepAlive.begin()
+	defer c.keepAlive.end()
+
+	if c.closing != nil {
+		return c.closing
+	}
+
+	var errs *multierror.Error
+	sent := 0
+	for read := range paths {
+		for ; sent < len(paths) && sent-read < deleteWindow; sent++ {
+			if _, err := c.sendCmd("DELE %s", paths[sent]); err != nil {
+				return multierror.Append(errs, err)
+			}
+		}
+
+		// Each reply is read, even negative, so that the next one is
+		// the reply to the next path
+		_, _, err := c.readResponse(StatusRequestedFileActionOK)
+		var protoErr *textproto.Error
+		if err != nil && !errors.As(err, &protoErr) {
+			return multierror.Append(errs, err)
+		}
+		if err != nil {
+			errs = multierror.Append(errs, &fs.PathError{Op: "delete", Path: paths[read], Err: classifyFileError(err)})
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
 // RemoveDirRecur deletes a non-empty folder recursively using
 // RemoveDir and Delete
 func (c *ServerConn) RemoveDirRecur(path string) error {
@@ -1047,7 +3866,7 @@ func (c *ServerConn) RemoveDirRecur(path string) error {
 			}
 		}
 	}
-	err = c.ChangeDirToParent()
+	_, err = c.ChangeDirToParent()
 	if err != nil {
 		return err
 	}
@@ -1058,10 +3877,26 @@ func (c *ServerConn) RemoveDirRecur(path string) error {
 // MakeDir issues a MKD FTP command to create the specified directory on the
 // remote FTP server.
 func (c *ServerConn) MakeDir(path string) error {
-	_, _, err := c.cmd(StatusPathCreated, "MKD %s", path)
+	_, err := c.MakeDirPath(path)
 	return err
 }
 
+// MakeDirPath is like MakeDir but returns the path of the created directory
+// quoted in the reply of the server, which is usually absolute and
+// normalized. The given path is returned if the reply does not include it.
+func (c *ServerConn) MakeDirPath(path string) (string, error) {
+	_, msg, err := c.cmd(StatusPathCreated, "MKD %s", path)
+	if err != nil {
+		return "", err
+	}
+
+	created, ok := parseQuotedPath(msg)
+	if !ok || created == "" {
+		return path, nil
+	}
+	return created, nil
+}
+
 // RemoveDir issues a RMD FTP command to remove the specified directory from
 // the remote FTP server.
 func (c *ServerConn) RemoveDir(path string) error {
@@ -1069,9 +3904,215 @@ func (c *ServerConn) RemoveDir(path string) error {
 	return err
 }
 
+// Site issues a SITE FTP command with the given arguments, eg. "CHMOD 644 file",
+// and returns the raw reply of the server. This gives access to the
+// non-standard features of the servers.
+//
+// The error is only set when the reply could not be read: a negative reply is
+// not an error.
+func (c *ServerConn) Site(args string) (code int, message string, err error) {
+	return c.cmd(-1, "SITE %s", args)
+}
+
+// Raw issues an arbitrary FTP command and returns the raw reply of the
+// server, for the commands not covered by ServerConn.
+//
+// The error is only set when the reply could not be read: a negative reply is
+// not an error. Commands opening a data connection must not be issued with Raw.
+func (c *ServerConn) Raw(cmd string) (code int, message string, err error) {
+	// The command may change the current directory
+	c.cwd = ""
+	return c.cmd(-1, "%s", cmd)
+}
+
+// Chmod changes the permissions of the specified file with the non-standard
+// SITE CHMOD FTP command. Only the permission bits of mode are used.
+func (c *ServerConn) Chmod(path string, mode os.FileMode) error {
+	code, message, err := c.Site(fmt.Sprintf("CHMOD %04o %s", mode.Perm(), path))
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return &textproto.Error{Code: code, Msg: message}
+	}
+	return nil
+}
+
+// Chown changes the owner and the group of the specified file or directory
+// with the non-standard SITE CHOWN and SITE CHGRP FTP commands. An empty owner
+// or group is left unchanged.
+//
+// The support of the commands is checked once with SITE HELP:
+// ErrSiteCommandUnsupported is returned, before any change, if one of the
+// needed commands is not listed.
+func (c *ServerConn) Chown(path string, owner, group string) error {
+	var commands [][2]string
+	if owner != "" {
+		commands = append(commands, [2]string{"CHOWN", owner})
+	}
+	if group != "" {
+		commands = append(commands, [2]string{"CHGRP", group})
+	}
+
+	for _, command := range commands {
+		supported, err := c.siteSupports(command[0])
+		if err != nil {
+			return err
+		}
+		if !supported {
+			return fmt.Errorf("%w: %s", ErrSiteCommandUnsupported, command[0])
+		}
+	}
+
+	for _, command := range commands {
+		code, message, err := c.Site(command[0] + " " + command[1] + " " + path)
+		if err != nil {
+			return err
+		}
+		if code/100 != 2 {
+			return &textproto.Error{Code: code, Msg: message}
+		}
+	}
+	return nil
+}
+
+// Copy copies a file on the remote FTP server, without transferring its content,
+// with the non-standard SITE CPFR and SITE CPTO FTP commands of ProFTPD.
+//
+// The support of the commands is checked once with SITE HELP:
+// ErrServerSideCopyUnsupported is returned if they are not listed.
+func (c *ServerConn) Copy(src, dst string) error {
+	for _, command := range []string{"CPFR", "CPTO"} {
+		supported, err := c.siteSupports(command)
+		if err != nil {
+			return err
+		}
+		if !supported {
+			return ErrServerSideCopyUnsupported
+		}
+	}
+
+	_, _, err := c.cmd(StatusRequestFilePending, "SITE CPFR %s", src)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.cmd(StatusRequestedFileActionOK, "SITE CPTO %s", dst)
+	return err
+}
+
+// siteSupports reports whether the SITE command is listed by the server in
+// reply to SITE HELP, which is only issued on the first call.
+func (c *ServerConn) siteSupports(command string) (bool, error) {
+	if c.siteCommands == nil {
+		code, message, err := c.Site("HELP")
+		if err != nil {
+			return false, err
+		}
+
+		c.siteCommands = make(map[string]bool)
+		if code/100 == 2 {
+			c.siteCommands = parseSiteHelp(message)
+		}
+	}
+
+	return c.siteCommands[strings.ToUpper(command)], nil
+}
+
+// parseSiteHelp returns the commands listed in the reply to SITE HELP, eg.
+//
+//	214-The following SITE commands are recognized (* =>'s unimplemented)
+//	 CHMOD <sp> mode <sp> pathname
+//	 CPFR <sp> pathname
+//	 HELP*
+//	214 Direct comments to root
+//
+// The first line is an introduction when there are several lines. The
+// commands marked as unimplemented are left out.
+func parseSiteHelp(message string) map[string]bool {
+	lines := strings.Split(message, "\n")
+	if len(lines) > 1 {
+		lines = lines[1:]
+	}
+
+	commands := make(map[string]bool)
+	for _, line := range lines {
+		for _, field := range strings.Fields(line) {
+			if isSiteCommandName(field) {
+				commands[field] = true
+			}
+		}
+	}
+	return commands
+}
+
+// isSiteCommandName reports whether the field of a SITE HELP reply is the name
+// of a command: a word in capital letters.
+func isSiteCommandName(field string) bool {
+	if len(field) < 2 {
+		return false
+	}
+	for _, r := range field {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// WalkCallback walks the directory tree rooted at root like Walk, calling fn
+// for each file or directory in the manner of filepath.Walk. Like with Walk,
+// root itself is not visited.
+//
+// If fn returns fs.SkipDir for a directory, its contents are skipped, and for
+// a file, the remaining entries of its directory are skipped. Any other error
+// stops the walk and is returned. When a directory cannot be listed, fn is
+// called again for it with the error: the directory is skipped and the walk
+// goes on, unless fn returns an error other than fs.SkipDir.
+func (c *ServerConn) WalkCallback(root string, fn func(path string, entry *Entry, err error) error) error {
+	w := c.Walk(root)
+	for {
+		if !w.Next() {
+			err := w.Err()
+			if err == nil {
+				return nil
+			}
+			if err = fn(w.Path(), w.Stat(), err); err != nil && err != fs.SkipDir {
+				return err
+			}
+			w.skipFailedDir()
+			continue
+		}
+
+		err := fn(w.Path(), w.Stat(), nil)
+		switch {
+		case err == fs.SkipDir && w.Stat().FileMode.IsDir():
+			w.SkipDir()
+		case err == fs.SkipDir:
+			w.skipSiblings()
+		case err != nil:
+			return err
+		}
+	}
+}
+
 // Walk prepares the internal walk function so that the caller can begin traversing the directory
 func (c *ServerConn) Walk(root string) *Walker {
+	return c.WalkWithOptions(root, WalkOptions{})
+}
+
+// WalkOrder is like Walk but visits the directories in the given order
+// relative to their contents. With PostOrder, the contents of a directory are
+// visited before it, which suits recursive deletions.
+func (c *ServerConn) WalkOrder(root string, order WalkMode) *Walker {
+	return c.WalkWithOptions(root, WalkOptions{Order: order})
+}
+
+// WalkWithOptions is like Walk with the given options.
+func (c *ServerConn) WalkWithOptions(root string, opts WalkOptions) *Walker {
 	w := new(Walker)
+	w.maxBreadth = opts.MaxBreadth
+	w.order = opts.Order
 	w.serverConn = c
 
 	if !strings.HasSuffix(root, "/") {
@@ -1084,6 +4125,23 @@ func (c *ServerConn) Walk(root string) *Walker {
 	return w
 }
 
+// PauseTransfer pauses the data transfers of the connection without closing
+// the data connection: the reads of a Response and the uploads block until
+// ResumeTransfer is called. Transfers started while paused block as well.
+//
+// Unlike the other methods, PauseTransfer can be called concurrently with a
+// transfer in progress. Note that the server may still close a data
+// connection which stays idle for too long.
+func (c *ServerConn) PauseTransfer() {
+	c.gate.pause()
+}
+
+// ResumeTransfer resumes the data transfers paused by PauseTransfer.
+// It can be called concurrently with a transfer in progress.
+func (c *ServerConn) ResumeTransfer() {
+	c.gate.resume()
+}
+
 // NoOp issues a NOOP FTP command.
 // NOOP has no effects and is usually used to prevent the remote FTP server to
 // close the otherwise idle connection.
@@ -1092,18 +4150,92 @@ func (c *ServerConn) NoOp() error {
 	return err
 }
 
+// Ping checks that the server is alive with a NOOP FTP command, accepting any
+// positive completion reply. Combined with DialWithTimeout, it is a cheap
+// liveness probe.
+func (c *ServerConn) Ping() error {
+	_, _, err := c.cmd(2, "NOOP")
+	return err
+}
+
+// PingAuth connects to the server at addr, logs in with the given credentials,
+// pings the server and quits. It returns the first error met, which makes it
+// suited to health checks of the server and the credentials.
+func PingAuth(addr, user, password string, options ...DialOption) (err error) {
+	c, err := Dial(addr, options...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errQuit := c.Quit(); errQuit != nil && err == nil {
+			err = errQuit
+		}
+	}()
+
+	if err := c.Login(user, password); err != nil {
+		return err
+	}
+	return c.Ping()
+}
+
 // Logout issues a REIN FTP command to logout the current user.
 func (c *ServerConn) Logout() error {
 	_, _, err := c.cmd(StatusReady, "REIN")
 	return err
 }
 
+// Reinit issues a REIN FTP command to end the session of the current user
+// without closing the connection. The state learnt since the connection is
+// reset: the features, the transfer type, the transfer mode, UTF-8 and the
+// credentials, so that the connection is ready for a new Login.
+//
+// ErrReinitUnsupported is returned if the server refuses the command, in which
+// case a new connection should be dialed.
+func (c *ServerConn) Reinit() error {
+	code, message, err := c.cmd(-1, "REIN")
+	if err != nil {
+		return err
+	}
+	if code == StatusReadyMinute {
+		code, message, err = c.readResponse(-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	if code/100 == 5 {
+		return &classifiedError{
+			err:  &textproto.Error{Code: code, Msg: message},
+			kind: ErrReinitUnsupported,
+		}
+	}
+	if code != StatusReady {
+		return &textproto.Error{Code: code, Msg: message}
+	}
+
+	c.features = make(map[string]string)
+	c.applyFeatures()
+	c.siteCommands = nil
+	c.compressed = false
+	c.transferType = ""
+	c.utf8Enabled = false
+	c.loggedIn = false
+	c.cwd = ""
+	c.user, c.password, c.account = "", "", ""
+	return nil
+}
+
 // Quit issues a QUIT FTP command to properly close the connection from the
 // remote FTP server.
 func (c *ServerConn) Quit() error {
+	c.keepAlive.shutdown()
+	if c.closing != nil {
+		return c.closing
+	}
+
 	var errs *multierror.Error
 
-	if _, err := c.conn.Cmd("QUIT"); err != nil {
+	if _, err := c.sendCmd("QUIT"); err != nil {
 		errs = multierror.Append(errs, err)
 	}
 
@@ -1114,13 +4246,85 @@ func (c *ServerConn) Quit() error {
 	return errs.ErrorOrNil()
 }
 
+// QuitWithTimeout is like Quit but waits at most the given duration for the
+// server to acknowledge the QUIT FTP command. The connection is closed in any
+// case, so that a dead server never blocks the caller for longer.
+func (c *ServerConn) QuitWithTimeout(d time.Duration) error {
+	c.keepAlive.shutdown()
+
+	var errs *multierror.Error
+
+	if err := c.setDeadline(time.Now().Add(d)); err != nil {
+		errs = multierror.Append(errs, err)
+	} else if _, _, err := c.cmd(StatusClosing, "QUIT"); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	if err := c.Close(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// Close closes the connection immediately, without sending the QUIT FTP
+// command to the server. Use Quit to properly close the connection.
+func (c *ServerConn) Close() error {
+	err := c.closeConn()
+	c.keepAlive.shutdown()
+	return err
+}
+
+// closeConn closes the control connection.
+func (c *ServerConn) closeConn() error {
+	if c.netConn != nil {
+		return c.netConn.Close()
+	}
+	return c.conn.Close()
+}
+
+// setDeadline sets the deadline of the control connection. It does nothing
+// when the control connection is not a net.Conn.
+func (c *ServerConn) setDeadline(t time.Time) error {
+	if c.netConn == nil {
+		return nil
+	}
+	return c.netConn.SetDeadline(t)
+}
+
 // Read implements the io.Reader interface on a FTP data connection.
 func (r *Response) Read(buf []byte) (int, error) {
-	return r.conn.Read(buf)
+	r.c.gate.wait()
+	timeout := r.c.options.idleTimeout
+	if timeout > 0 {
+		if err := r.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.c.limiter.read(r.conn, buf)
+	var netErr net.Error
+	if timeout > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		err = ErrTransferIdleTimeout
+	}
+	r.received += int64(n)
+	r.c.countData(0, int64(n))
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// WriteTo implements the io.WriterTo interface on a FTP data connection, so
+// that io.Copy uses the buffer size given by DialWithTransferBufferSize.
+func (r *Response) WriteTo(w io.Writer) (int64, error) {
+	return r.c.copyData(w, struct{ io.Reader }{r})
 }
 
 // Close implements the io.Closer interface on a FTP data connection.
 // After the first call, Close will do nothing and return nil.
+//
+// Close waits for the server to complete the transfer. Use Abort to cancel a
+// transfer in progress.
 func (r *Response) Close() error {
 	if r.closed {
 		return nil
@@ -1134,12 +4338,61 @@ func (r *Response) Close() error {
 
 	if err := r.c.checkDataShut(); err != nil {
 		errs = multierror.Append(errs, err)
+	} else if r.verify && r.eof && r.received != r.expected {
+		errs = multierror.Append(errs, fmt.Errorf("%w: received %d bytes, expected %d", ErrTruncatedTransfer, r.received, r.expected))
+	}
+
+	if err := r.c.restoreType(r.restoreType); err != nil {
+		errs = multierror.Append(errs, err)
 	}
 
 	r.closed = true
 	return errs.ErrorOrNil()
 }
 
+// Abort cancels the transfer in progress with an ABOR FTP command, then closes
+// the data connection. The replies of the server to the transfer, usually 426,
+// and to ABOR are read, so that the connection is ready for other commands.
+// Abort does nothing after Close.
+func (r *Response) Abort() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	var errs *multierror.Error
+
+	r.c.shutMu.Lock()
+	_, cmdErr := r.c.sendCmd("ABOR")
+	if err := r.conn.Close(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	if cmdErr != nil {
+		r.c.endTransfer()
+		r.c.shutMu.Unlock()
+		errs = multierror.Append(errs, cmdErr)
+		return errs.ErrorOrNil()
+	}
+
+	// The transfer completes with 226, or 426 when aborted, then ABOR
+	// itself is acknowledged
+	_, _, err := r.c.readShut(-1)
+	if err == nil {
+		_, _, err = r.c.readResponse(2)
+	}
+	r.c.endTransfer()
+	r.c.shutMu.Unlock()
+	if err == nil {
+		err = r.c.restoreType(r.restoreType)
+	}
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return errs.ErrorOrNil()
+}
+
 // SetDeadline sets the deadlines associated with the connection.
 func (r *Response) SetDeadline(t time.Time) error {
 	return r.conn.SetDeadline(t)
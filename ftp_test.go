@@ -1,8 +1,26 @@
 package ftp
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
 	"net"
+	"net/textproto"
+	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestBogusDataIP(t *testing.T) {
@@ -20,3 +38,408 @@ func TestBogusDataIP(t *testing.T) {
 		}
 	}
 }
+
+func TestEPSVNetwork(t *testing.T) {
+	for _, tC := range []struct {
+		dataNetwork, host     string
+		network, expectedHost string
+	}{
+		{"", "192.168.1.1", "tcp", "192.168.1.1"},
+		{"tcp", "192.168.1.1", "tcp", "192.168.1.1"},
+		{"tcp4", "192.168.1.1", "tcp4", "192.168.1.1"},
+		{"tcp6", "192.168.1.1", "tcp6", "ftp.example.org"},
+		{"tcp4", "::1", "tcp4", "ftp.example.org"},
+		{"tcp6", "::1", "tcp6", "::1"},
+	} {
+		c := &ServerConn{
+			options:  &dialOptions{dataNetwork: tC.dataNetwork},
+			host:     tC.host,
+			hostname: "ftp.example.org",
+		}
+		network, host := c.epsvNetwork()
+		if network != tC.network || host != tC.expectedHost {
+			t.Errorf("%s,%s got %s,%s, wanted %s,%s", tC.dataNetwork, tC.host, network, host, tC.network, tC.expectedHost)
+		}
+	}
+}
+
+func TestSessionReuseConfig(t *testing.T) {
+	original := &tls.Config{InsecureSkipVerify: true}
+
+	config := sessionReuseConfig(original, "ftp.example.org")
+	if config.ClientSessionCache == nil {
+		t.Error("expected a session cache")
+	}
+	if config.ServerName != "ftp.example.org" {
+		t.Errorf("got server name %q, wanted %q", config.ServerName, "ftp.example.org")
+	}
+	if original.ClientSessionCache != nil || original.ServerName != "" {
+		t.Error("the original config must not be modified")
+	}
+
+	cache := tls.NewLRUClientSessionCache(1)
+	config = sessionReuseConfig(&tls.Config{ClientSessionCache: cache, ServerName: "example.org"}, "ftp.example.org")
+	if config.ClientSessionCache != cache {
+		t.Error("the session cache must be kept")
+	}
+	if config.ServerName != "example.org" {
+		t.Errorf("got server name %q, wanted %q", config.ServerName, "example.org")
+	}
+}
+
+// selfSignedCert returns a certificate which is not trusted by the clients.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ftp.example.org"},
+		DNSNames:     []string{"ftp.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestReuseTLSSession(t *testing.T) {
+	reuse, noReuse := true, false
+	config := &tls.Config{}
+	for _, tC := range []struct {
+		do    dialOptions
+		reuse bool
+	}{
+		{dialOptions{}, false},
+		{dialOptions{tlsConfig: config, explicitTLS: true}, true},
+		{dialOptions{tlsConfig: config}, false},
+		{dialOptions{tlsConfig: config, explicitTLS: true, tlsReuse: &noReuse}, false},
+		{dialOptions{tlsConfig: config, tlsReuse: &reuse}, true},
+	} {
+		if got := tC.do.reuseTLSSession(); got != tC.reuse {
+			t.Errorf("explicit %t, option %v: got %t, wanted %t", tC.do.explicitTLS, tC.do.tlsReuse, got, tC.reuse)
+		}
+	}
+}
+
+// serveExplicitTLS serves a control connection upgraded with AUTH TLS, which
+// sends data on a TLS data connection for RETR. Whether the data connections
+// resumed the session of the control connection is sent to resumed.
+func serveExplicitTLS(t *testing.T, l, dl net.Listener, config *tls.Config, resumed chan<- bool) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	if _, err := conn.Write([]byte("220 Ready\r\n")); err != nil {
+		return
+	}
+	if _, err := r.ReadLine(); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte("234 AUTH TLS successful\r\n")); err != nil {
+		return
+	}
+
+	tlsConn := tls.Server(conn, config)
+	r = textproto.NewReader(bufio.NewReader(tlsConn))
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+
+		var reply string
+		switch line {
+		case "EPSV":
+			reply = fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)", dl.Addr().(*net.TCPAddr).Port)
+		case "RETR file":
+			if _, err := tlsConn.Write([]byte("150 Opening data connection\r\n")); err != nil {
+				return
+			}
+			dataConn, err := dl.Accept()
+			if err != nil {
+				return
+			}
+			data := dataConn.(*tls.Conn)
+			if err := data.Handshake(); err != nil {
+				t.Error(err)
+			}
+			resumed <- data.ConnectionState().DidResume
+			_, _ = data.Write([]byte("data"))
+			_ = data.Close()
+			reply = "226 Transfer complete"
+		case "QUIT":
+			_, _ = tlsConn.Write([]byte("221 Goodbye\r\n"))
+			return
+		default:
+			reply = "502 Not implemented"
+		}
+		if _, err := tlsConn.Write([]byte(reply + "\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+func TestTLSSessionReuse(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		t.Run(tls.VersionName(version), func(t *testing.T) {
+			config := &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}, MaxVersion: version}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			dl, err := tls.Listen("tcp", "127.0.0.1:0", config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dl.Close()
+
+			resumed := make(chan bool, 2)
+			go serveExplicitTLS(t, l, dl, config, resumed)
+
+			c, err := Dial(l.Addr().String(), DialWithExplicitTLS(&tls.Config{InsecureSkipVerify: true}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				r, err := c.Retr("file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadAll(r); err != nil {
+					t.Error(err)
+				}
+				if err := r.Close(); err != nil {
+					t.Error(err)
+				}
+				if !<-resumed {
+					t.Errorf("data connection %d did not resume the TLS session", i)
+				}
+			}
+			if err := c.Quit(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDataTLSError(t *testing.T) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("data"))
+		_ = conn.Close()
+	}()
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newDataTLSConn(raw, &tls.Config{ServerName: "ftp.example.org"})
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 4))
+	var tlsErr *DataTLSError
+	if !errors.As(err, &tlsErr) {
+		t.Fatalf("got %v, wanted a DataTLSError", err)
+	}
+	var certErr x509.UnknownAuthorityError
+	if !errors.As(err, &certErr) {
+		t.Errorf("got %v, wanted the certificate error", tlsErr.Err)
+	}
+}
+
+func TestDialWithTLSPin(t *testing.T) {
+	cert := selfSignedCert(t)
+	pin := sha256.Sum256(cert.Certificate[0])
+	config := &tls.Config{InsecureSkipVerify: true}
+
+	for _, tC := range []struct {
+		desc string
+		pin  []byte
+		err  error
+	}{
+		{"matching", pin[:], nil},
+		{"mismatching", make([]byte, sha256.Size), ErrCertPinMismatch},
+	} {
+		t.Run(tC.desc, func(t *testing.T) {
+			l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if _, err := conn.Write([]byte("220 Ready\r\n")); err != nil {
+					return
+				}
+				_, _ = textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+				_, _ = conn.Write([]byte("221 Goodbye\r\n"))
+			}()
+
+			c, err := Dial(l.Addr().String(), DialWithTLS(config), DialWithTLSPin(tC.pin))
+			if !errors.Is(err, tC.err) {
+				t.Fatalf("got %v, wanted %v", err, tC.err)
+			}
+			if err == nil {
+				if err := c.Quit(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDataTLSPin(t *testing.T) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("data"))
+		_ = conn.Close()
+	}()
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := pinnedConfig(&tls.Config{InsecureSkipVerify: true}, make([]byte, sha256.Size))
+	conn := newDataTLSConn(raw, config)
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 4))
+	var tlsErr *DataTLSError
+	if !errors.As(err, &tlsErr) {
+		t.Fatalf("got %v, wanted a DataTLSError", err)
+	}
+	if !errors.Is(err, ErrCertPinMismatch) {
+		t.Errorf("got %v, wanted %v", err, ErrCertPinMismatch)
+	}
+}
+
+func TestRestartOffsetAccepted(t *testing.T) {
+	for _, tC := range []struct {
+		msg      string
+		offset   uint64
+		accepted bool
+	}{
+		{"Restarting at 1024. Send STORE or RETRIEVE to initiate transfer", 1024, true},
+		{"Restart position accepted (1024).", 1024, true},
+		{"Restarting at 0. Send STORE or RETRIEVE to initiate transfer", 1024, false},
+		{"Restart position accepted (512).", 1024, false},
+		{"Requested file action pending further information", 1024, true},
+		{"Restarting at 0 (requested 1024)", 1024, false},
+		{"Restarting at 1024 (was 0)", 1024, true},
+		{"Restart marker set, 2 connections open", 1024, true},
+		{"Restart position accepted (0 of 1024).", 1024, true},
+	} {
+		if got, want := isRestartOffsetAccepted(tC.msg, tC.offset), tC.accepted; got != want {
+			t.Errorf("%q,%d got %t, wanted %t", tC.msg, tC.offset, got, want)
+		}
+	}
+}
+
+func TestEntryFileInfo(t *testing.T) {
+	e := &Entry{
+		Name:     "pub/file.txt",
+		FileMode: 0644,
+		Size:     42,
+		Time:     time.Date(2020, 12, 13, 20, 24, 0, 0, time.UTC),
+	}
+
+	var info fs.FileInfo = e.FileInfo()
+	if info.Name() != "file.txt" {
+		t.Errorf("got name %q, wanted %q", info.Name(), "file.txt")
+	}
+	if info.Size() != 42 || info.Mode() != 0644 || !info.ModTime().Equal(e.Time) || info.IsDir() {
+		t.Errorf("unexpected file info %v %v %v %t", info.Size(), info.Mode(), info.ModTime(), info.IsDir())
+	}
+	if info.Sys() != e {
+		t.Error("Sys must return the entry")
+	}
+
+	e.FileMode = os.ModeDir | 0755
+	if !e.FileInfo().IsDir() {
+		t.Error("expected a directory")
+	}
+}
+
+func TestParseQuotedPath(t *testing.T) {
+	for _, tC := range []struct {
+		msg  string
+		path string
+		ok   bool
+	}{
+		{`"/incoming"`, "/incoming", true},
+		{`"/incoming" is the current directory`, "/incoming", true},
+		{`"/say ""hello""" is the current directory`, `/say "hello"`, true},
+		{`"/dir" created, "quoted" comment`, "/dir", true},
+		{`"/home/user/new ""dir""" directory created`, `/home/user/new "dir"`, true},
+		{`MKD command successful: "/a/b" created`, "/a/b", true},
+		{`""`, "", true},
+		{`"/unterminated`, "", false},
+		{`no path`, "", false},
+	} {
+		path, ok := parseQuotedPath(tC.msg)
+		if path != tC.path || ok != tC.ok {
+			t.Errorf("%q got %q,%t, wanted %q,%t", tC.msg, path, ok, tC.path, tC.ok)
+		}
+	}
+}
+
+func TestLineEndingReader(t *testing.T) {
+	const input = "a\nb\r\nc\rd\r\n\ne\r"
+	for _, tC := range []struct {
+		ending string
+		output string
+	}{
+		{"\r\n", "a\r\nb\r\nc\rd\r\n\r\ne\r"},
+		{"\n", "a\nb\nc\rd\n\ne\r"},
+	} {
+		// One byte at a time, "\r\n" is split across the reads
+		got, err := io.ReadAll(newLineEndingReader(iotest.OneByteReader(strings.NewReader(input)), tC.ending))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tC.output {
+			t.Errorf("%q got %q, wanted %q", tC.ending, got, tC.output)
+		}
+
+		// The translation is idempotent
+		again, err := io.ReadAll(newLineEndingReader(strings.NewReader(string(got)), tC.ending))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != tC.output {
+			t.Errorf("%q got %q again, wanted %q", tC.ending, again, tC.output)
+		}
+	}
+}
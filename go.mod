@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/hashicorp/go-multierror v1.1.1
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/text v0.13.0
 )
 
 require (
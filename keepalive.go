@@ -0,0 +1,88 @@
+package ftp
+
+import (
+	"sync"
+	"time"
+)
+
+// keepAlive sends NOOP commands on an idle control connection.
+// The zero value does nothing.
+type keepAlive struct {
+	mu   sync.Mutex // held during the exchanges of the keep-alive
+	busy int        // number of exchanges or transfers in flight
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// begin marks the control connection busy, waiting for a NOOP in flight to
+// complete. Each call must be followed by a call to end.
+func (k *keepAlive) begin() {
+	k.mu.Lock()
+	k.busy++
+	k.mu.Unlock()
+}
+
+// end marks the end of an exchange or transfer started with begin.
+func (k *keepAlive) end() {
+	k.mu.Lock()
+	k.busy--
+	k.mu.Unlock()
+}
+
+// start sends a NOOP command every interval while the control connection is
+// not busy, until shutdown is called.
+func (k *keepAlive) start(c *ServerConn, interval time.Duration) {
+	k.stop = make(chan struct{})
+	k.done = make(chan struct{})
+
+	go func() {
+		defer close(k.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-k.stop:
+				return
+			case <-ticker.C:
+			}
+
+			k.mu.Lock()
+			if k.busy == 0 {
+				// The reply is not recorded for LastResponse
+				_, err := c.sendCmd("NOOP")
+				if err == nil {
+					var code int
+					var msg string
+					code, msg, err = c.conn.ReadResponse(StatusCommandOK)
+					if code == StatusNotAvailable {
+						// Like readResponse, without waiting for this
+						// goroutine to stop
+						err = c.serviceClosing(code, msg)
+					}
+				}
+				if err != nil {
+					k.mu.Unlock()
+					return
+				}
+			}
+			k.mu.Unlock()
+		}
+	}()
+}
+
+// shutdown stops sending NOOP commands, waiting for a NOOP in flight to
+// complete.
+func (k *keepAlive) shutdown() {
+	if k.stop == nil {
+		return
+	}
+
+	k.stopOnce.Do(func() {
+		close(k.stop)
+	})
+	<-k.done
+}
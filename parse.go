@@ -1,11 +1,14 @@
 package ftp
 
 import (
+	"bufio"
 	"errors"
-	"fmt"
+	"io"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,16 +16,54 @@ var errUnsupportedListLine = errors.New("unsupported LIST line")
 var errUnsupportedListDate = errors.New("unsupported LIST date")
 var errUnknownListEntryType = errors.New("unknown entry type")
 
+// maxClockSkew is the tolerated difference between the clock of the server and
+// the local clock when guessing the year of recent files.
+const maxClockSkew = time.Hour
+
 type parseFunc func(string, time.Time, *time.Location) (*Entry, error)
 
+// ParserKind identifies one of the built-in LIST line parsers.
+type ParserKind int
+
+// The different LIST line parsers
+const (
+	ParserRFC3659   ParserKind = iota // RFC 3659 facts, as returned by MLSD
+	ParserLs                          // output of the UNIX ls command
+	ParserDOS                         // output of the MS-DOS DIR command
+	ParserHostedFTP                   // non-standard format used by hostedftp.com
+	ParserTandem                      // HP NonStop (Tandem) Guardian file listings
+	ParserUnisys                      // Unisys MCP file listings
+)
+
+var listLineParsersByKind = map[ParserKind]parseFunc{
+	ParserRFC3659:   parseRFC3659ListLine,
+	ParserLs:        parseLsListLine,
+	ParserDOS:       parseDirListLine,
+	ParserHostedFTP: parseHostedFTPLine,
+	ParserTandem:    parseTandemListLine,
+	ParserUnisys:    parseUnisysListLine,
+}
+
 var listLineParsers = []parseFunc{
 	parseRFC3659ListLine,
 	parseLsListLine,
 	parseDirListLine,
 	parseHostedFTPLine,
+	parseTandemListLine,
+	parseUnisysListLine,
 }
 
 var dirTimeFormats = []string{
+	// With seconds, or a space before the meridiem. They are tried first, as
+	// the "15:04" forms would match their prefix.
+	"01-02-06  03:04:05PM",
+	"01-02-06  03:04 PM",
+	"01-02-06  03:04:05 PM",
+	"01-02-2006  03:04:05PM",
+	"01-02-2006  03:04 PM",
+	"01-02-2006  03:04:05 PM",
+	"01-02-2006 03:04:05 PM",
+
 	"01-02-06  03:04PM",
 	"2006-01-02  15:04",
 	"01-02-2006  03:04PM",
@@ -31,7 +72,12 @@ var dirTimeFormats = []string{
 
 // parseRFC3659ListLine parses the style of directory line defined in RFC 3659.
 func parseRFC3659ListLine(line string, _ time.Time, loc *time.Location) (*Entry, error) {
-	return parseNextRFC3659ListLine(line, loc, &Entry{})
+	e := newEntry()
+	if _, err := parseNextRFC3659ListLine(line, loc, e); err != nil {
+		releaseEntry(e)
+		return nil, err
+	}
+	return e, nil
 }
 
 func parseNextRFC3659ListLine(line string, loc *time.Location, e *Entry) (*Entry, error) {
@@ -68,20 +114,68 @@ func parseNextRFC3659ListLine(line string, loc *time.Location, e *Entry) (*Entry
 			}
 		case "type":
 			switch value {
-			case "dir", "cdir", "pdir":
+			case "dir":
 				e.FileMode |= os.ModeDir
+			case "cdir", "pdir":
+				e.FileMode |= os.ModeDir
+				e.pseudoDir = true
 			case "file":
 				e.FileMode |= os.FileMode(0)
+			default:
+				e.FileMode |= unixFileType(value)
 			}
-		case "size":
+		case "size", "sizd":
 			if err := e.setSize(value); err != nil {
 				return nil, err
 			}
+		case "perm":
+			e.Perm = parsePerm(value)
+		case "unique":
+			e.Unique = value
+		case "unix.mode":
+			// Octal permissions, an invalid value is ignored like an
+			// unknown fact
+			if mode, err := strconv.ParseUint(value, 8, 32); err == nil {
+				e.FileMode |= os.FileMode(mode) & os.ModePerm
+			}
 		}
 	}
 	return e, nil
 }
 
+// unixFileTypes are the modes of the special files listed by MLSD with the
+// "OS.unix" types, eg. "type=OS.unix=chr".
+var unixFileTypes = map[string]os.FileMode{
+	"chr":  os.ModeDevice | os.ModeCharDevice,
+	"blk":  os.ModeDevice,
+	"fifo": os.ModeNamedPipe,
+	"sock": os.ModeSocket,
+}
+
+// unixFileType returns the mode of the special file of an "OS.unix" type, or
+// zero for a regular file if the type is unknown.
+func unixFileType(value string) os.FileMode {
+	const prefix = "os.unix="
+	if len(value) <= len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return 0
+	}
+	return unixFileTypes[strings.ToLower(value[len(prefix):])]
+}
+
+// permLetters are the letters of the perm fact, in the order of the Perm bits.
+const permLetters = "acdeflmprw"
+
+// parsePerm parses the value of a perm fact. Unknown letters are ignored.
+func parsePerm(value string) Perm {
+	var perm Perm
+	for _, r := range strings.ToLower(value) {
+		if i := strings.IndexRune(permLetters, r); i >= 0 {
+			perm |= 1 << i
+		}
+	}
+	return perm
+}
+
 // parseLsListLine parses a directory line in a format based on the output of
 // the UNIX ls command.
 func parseLsListLine(line string, now time.Time, loc *time.Location) (*Entry, error) {
@@ -101,10 +195,9 @@ func parseLsListLine(line string, now time.Time, loc *time.Location) (*Entry, er
 	}
 
 	if fields[1] == "folder" && fields[2] == "0" {
-		e := &Entry{
-			FileMode: os.ModeDir,
-			Name:     scanner.Remaining(),
-		}
+		e := newEntry()
+		e.FileMode = os.ModeDir
+		e.Name = scanner.Remaining()
 		if err := e.setFileMod(fields[0]); err != nil {
 			return nil, err
 		}
@@ -117,15 +210,13 @@ func parseLsListLine(line string, now time.Time, loc *time.Location) (*Entry, er
 
 	if fields[1] == "0" {
 		fields = append(fields, scanner.Next())
-		e := &Entry{
-			FileMode: os.FileMode(0),
-			Name:     scanner.Remaining(),
-		}
+		e := newEntry()
+		e.Name = scanner.Remaining()
 
 		if err := e.setFileMod(fields[0]); err != nil {
 			return nil, err
 		}
-		if err := e.setSize(fields[2]); err != nil {
+		if err := e.setLsSize(fields[2]); err != nil {
 			return nil, errUnsupportedListLine
 		}
 		if err := e.setTime(fields[4:7], now, loc); err != nil {
@@ -135,23 +226,48 @@ func parseLsListLine(line string, now time.Time, loc *time.Location) (*Entry, er
 		return e, nil
 	}
 
-	// Read two more fields
-	fields = append(fields, scanner.NextFields(2)...)
-	if len(fields) < 8 {
+	// Some embedded servers omit the link count, so the date starts one
+	// field earlier: an empty link count keeps the offsets of the fields.
+	if isDateStart(fields[4]) && !isDateStart(fields[5]) {
+		fields = append(fields[:1], append([]string{""}, fields[1:]...)...)
+	}
+
+	// Read the remaining fields of the date: "Jan 15 09:30", or "09:30" for
+	// the "2021-01-15 09:30" ISO form of some gateways.
+	dateFields := 3
+	if isISODate(fields[5]) {
+		dateFields = 2
+	}
+	if len(fields) < 4+dateFields {
+		fields = append(fields, scanner.NextFields(4+dateFields-len(fields))...)
+	}
+	position := scanner.position
+	if len(fields) == 4+dateFields {
+		if field := scanner.Next(); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) < 5+dateFields {
 		return nil, errUnsupportedListLine
 	}
 
-	e := &Entry{
-		Name: scanner.Remaining(),
+	// Some archival servers list old files with the month and the day only:
+	// the last field read is then the start of the name.
+	dateOnly := dateFields == 3 && !isLsTimeOrYear(fields[7])
+	if dateOnly {
+		scanner.position = position
 	}
 
+	e := newEntry()
+	e.Name = scanner.Remaining()
+
 	if err := e.setFileMod(fields[0]); err != nil {
 		return nil, err
 	}
 	switch fields[0][0] {
 	case '-':
 		e.FileMode |= os.FileMode(0)
-		if err := e.setSize(fields[4]); err != nil {
+		if err := e.setLsSize(fields[4]); err != nil {
 			return nil, err
 		}
 	case 'd':
@@ -159,31 +275,89 @@ func parseLsListLine(line string, now time.Time, loc *time.Location) (*Entry, er
 	case 'l':
 		e.FileMode |= os.ModeSymlink
 
-		// Split link name and target
-		if i := strings.Index(e.Name, " -> "); i > 0 {
+		// Split link name and target on the last arrow, which ls adds
+		if i := strings.LastIndex(e.Name, " -> "); i > 0 {
 			e.Target = e.Name[i+4:]
 			e.Name = e.Name[:i]
 		}
 	default:
 		return nil, errUnknownListEntryType
 	}
-	if err := e.setTime(fields[5:8], now, loc); err != nil {
-		return nil, err
+	switch {
+	case dateFields == 2:
+		if err := e.setISOTime(fields[5:7], loc); err != nil {
+			return nil, err
+		}
+	case dateOnly:
+		// The year is inferred like for a recent file, at midnight
+		if err := e.setTime([]string{fields[5], fields[6], "00:00"}, now, loc); err != nil {
+			return nil, err
+		}
+	default:
+		if err := e.setTime(fields[5:8], now, loc); err != nil {
+			return nil, err
+		}
 	}
 
 	return e, nil
 }
 
+// isISODate returns true if the field is a date of the "2006-01-02" form.
+func isISODate(field string) bool {
+	return len(field) == 10 && field[4] == '-' && field[7] == '-'
+}
+
+// isLsTimeOrYear reports whether field looks like the last field of an ls
+// date, either a time or a year, even if malformed.
+func isLsTimeOrYear(field string) bool {
+	if strings.Contains(field, ":") {
+		return true
+	}
+	for i := 0; i < len(field); i++ {
+		if field[i] < '0' || field[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isDateStart reports whether field is the first field of an ls date, either
+// an abbreviated month name or an ISO date.
+func isDateStart(field string) bool {
+	if isISODate(field) {
+		return true
+	}
+	return isMonthName(field)
+}
+
+// isMonthName reports whether field is an abbreviated month name, in any case.
+func isMonthName(field string) bool {
+	if len(field) != 3 {
+		return false
+	}
+	for m := time.January; m <= time.December; m++ {
+		if strings.EqualFold(field, m.String()[:3]) {
+			return true
+		}
+	}
+	return false
+}
+
 // parseDirListLine parses a directory line in a format based on the output of
 // the MS-DOS DIR command.
 func parseDirListLine(line string, now time.Time, loc *time.Location) (*Entry, error) {
-	e := &Entry{}
+	// All the time formats start with a digit
+	if line == "" || line[0] < '0' || line[0] > '9' {
+		return nil, errUnsupportedListLine
+	}
+
+	var t time.Time
 	var err error
 
 	// Try various time formats that DIR might use, and stop when one works.
 	for _, format := range dirTimeFormats {
 		if len(line) > len(format) {
-			e.Time, err = time.ParseInLocation(format, line[:len(format)], loc)
+			t, err = time.ParseInLocation(format, line[:len(format)], loc)
 			if err == nil {
 				line = line[len(format):]
 				break
@@ -195,24 +369,29 @@ func parseDirListLine(line string, now time.Time, loc *time.Location) (*Entry, e
 		return nil, errUnsupportedListLine
 	}
 
+	var mode os.FileMode
+	var size uint64
 	line = strings.TrimLeft(line, " ")
 	if strings.HasPrefix(line, "<DIR>") {
-		e.FileMode |= os.ModeDir
+		mode = os.ModeDir
 		line = strings.TrimPrefix(line, "<DIR>")
 	} else {
 		space := strings.Index(line, " ")
 		if space == -1 {
 			return nil, errUnsupportedListLine
 		}
-		e.Size, err = strconv.ParseUint(line[:space], 10, 64)
+		size, err = strconv.ParseUint(line[:space], 10, 64)
 		if err != nil {
 			return nil, errUnsupportedListLine
 		}
-		e.FileMode |= os.FileMode(0)
 		line = line[space:]
 	}
 
+	e := newEntry()
 	e.Name = strings.TrimLeft(line, " ")
+	e.FileMode = mode
+	e.Size = size
+	e.Time = t
 	return e, nil
 }
 
@@ -237,10 +416,173 @@ func parseHostedFTPLine(line string, now time.Time, loc *time.Location) (*Entry,
 	return parseLsListLine(fields[0]+" 1 "+scanner.Remaining(), now, loc)
 }
 
+// tandemSubvolCode is the Guardian file code listed for subvolume-like
+// entries, which are reported as directories.
+const tandemSubvolCode = "101"
+
+// parseTandemListLine parses a directory line in the format of the HP NonStop
+// (Tandem) Guardian FTP server: the name, the file code, the size, the date
+// and time of the last modification and the security, eg.
+// FILE.DAT    101 20,480   15-JAN-2021 09:30:00 "RWEP","RWEP"
+func parseTandemListLine(line string, _ time.Time, loc *time.Location) (*Entry, error) {
+	scanner := newScanner(line)
+	fields := scanner.NextFields(5)
+	if len(fields) < 5 {
+		return nil, errUnsupportedListLine
+	}
+
+	if _, err := strconv.ParseUint(fields[1], 10, 16); err != nil {
+		return nil, errUnsupportedListLine
+	}
+
+	t, err := time.ParseInLocation("02-Jan-2006 15:04:05", fields[3]+" "+fields[4], loc)
+	if err != nil {
+		return nil, errUnsupportedListLine
+	}
+
+	size, err := strconv.ParseUint(strings.ReplaceAll(fields[2], ",", ""), 10, 64)
+	if err != nil {
+		return nil, errUnsupportedListLine
+	}
+
+	e := newEntry()
+	e.Name = fields[0]
+	e.Size = size
+	e.Time = t
+	if fields[1] == tandemSubvolCode {
+		e.FileMode = os.ModeDir
+	}
+
+	return e, nil
+}
+
+// unisysDirType is the file type listed for directories by the Unisys MCP
+// FTP server.
+const unisysDirType = "DIRECTORY"
+
+// parseUnisysListLine parses a directory line in the format of the Unisys MCP
+// FTP server: the qualified name, the file type, the size and the date and
+// time of the last modification, eg.
+// *SYSTEM/FILE    SEQDATA    100  2021/01/15 09:30
+//
+// The qualified name is kept as is, with its slash-separated nodes.
+func parseUnisysListLine(line string, _ time.Time, loc *time.Location) (*Entry, error) {
+	scanner := newScanner(line)
+	fields := scanner.NextFields(5)
+	if len(fields) < 5 {
+		return nil, errUnsupportedListLine
+	}
+
+	t, err := time.ParseInLocation("2006/01/02 15:04", fields[3]+" "+fields[4], loc)
+	if err != nil {
+		return nil, errUnsupportedListLine
+	}
+
+	size, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return nil, errUnsupportedListLine
+	}
+
+	e := newEntry()
+	e.Name = fields[0]
+	e.Size = size
+	e.Time = t
+	if strings.EqualFold(fields[1], unisysDirType) {
+		e.FileMode = os.ModeDir
+	}
+
+	return e, nil
+}
+
+// parseNameListLine parses a line of a NLST output, which only has the name of
+// the entry.
+func parseNameListLine(line string, _ time.Time, _ *time.Location) (*Entry, error) {
+	e := newEntry()
+	e.Name = line
+	return e, nil
+}
+
+// isIgnoredListLine returns true for the lines of a LIST output which do not
+// describe an entry: blank lines and the "total <n>" header of ls.
+func isIgnoredListLine(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true
+	}
+
+	if !strings.HasPrefix(line, "total ") {
+		return false
+	}
+	_, err := strconv.ParseUint(line[len("total "):], 10, 64)
+	return err == nil
+}
+
+// entryPool recycles the entries of ParseListLines, once passed to the callback.
+var entryPool = sync.Pool{
+	New: func() interface{} {
+		return new(Entry)
+	},
+}
+
+// newEntry returns a zero Entry, recycled if possible.
+func newEntry() *Entry {
+	return entryPool.Get().(*Entry)
+}
+
+// releaseEntry resets the entry and makes it available to newEntry. The entry
+// must not be used afterwards.
+func releaseEntry(e *Entry) {
+	*e = Entry{}
+	entryPool.Put(e)
+}
+
+// ParseListLines parses a listing in one of the formats supported by List,
+// read from r, and calls fn for each entry. The lines which cannot be parsed
+// are skipped. The year of the recent files of ls listings is guessed from
+// now, and the times are in the loc time zone.
+//
+// This is meant for large listings, eg. saved to files: to limit the
+// allocations, the entries are recycled. The *Entry given to fn is only valid
+// until fn returns, and must be copied to be kept.
+func ParseListLines(r io.Reader, now time.Time, loc *time.Location, fn func(*Entry)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isIgnoredListLine(line) {
+			continue
+		}
+
+		entry, err := parseListLine(line, now, loc)
+		if err != nil {
+			continue
+		}
+		fn(entry)
+		releaseEntry(entry)
+	}
+	return scanner.Err()
+}
+
+// systemParserOrder returns the order of the LIST line parsers suited to the
+// system type given by SYST, or nil to keep the default order. All the
+// parsers are kept, as some servers can use another format.
+func systemParserOrder(system string) []ParserKind {
+	fields := strings.Fields(system)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "Windows_NT") {
+		return []ParserKind{ParserDOS, ParserRFC3659, ParserLs, ParserHostedFTP, ParserTandem, ParserUnisys}
+	}
+	return nil
+}
+
 // parseListLine parses the various non-standard format returned by the LIST
 // FTP command.
 func parseListLine(line string, now time.Time, loc *time.Location) (*Entry, error) {
-	for _, f := range listLineParsers {
+	return parseListLineWith(listLineParsers, line, now, loc)
+}
+
+// parseListLineWith parses a LIST line with the first of the given parsers
+// supporting it.
+func parseListLineWith(parsers []parseFunc, line string, now time.Time, loc *time.Location) (*Entry, error) {
+	for _, f := range parsers {
 		e, err := f(line, now, loc)
 		if err != errUnsupportedListLine {
 			return e, err
@@ -249,6 +591,21 @@ func parseListLine(line string, now time.Time, loc *time.Location) (*Entry, erro
 	return nil, errUnsupportedListLine
 }
 
+// newListLineParser returns a parseFunc trying the parsers of the given kinds
+// in order. Unknown kinds are ignored.
+func newListLineParser(order []ParserKind) parseFunc {
+	parsers := make([]parseFunc, 0, len(order))
+	for _, kind := range order {
+		if f, ok := listLineParsersByKind[kind]; ok {
+			parsers = append(parsers, f)
+		}
+	}
+
+	return func(line string, now time.Time, loc *time.Location) (*Entry, error) {
+		return parseListLineWith(parsers, line, now, loc)
+	}
+}
+
 func (e *Entry) setFileMod(str string) (err error) {
 	runeStr := []rune(str)
 	if len(runeStr) < 10 {
@@ -272,9 +629,9 @@ func (e *Entry) setFileMod(str string) (err error) {
 	}
 
 	modeUint := uint32(0)
-	modeUint += parsePerm(runeStr[1:4]) * 100 // owner
-	modeUint += parsePerm(runeStr[4:7]) * 10  // group
-	modeUint += parsePerm(runeStr[7:10])      // other
+	modeUint += parsePerm(runeStr[1:4]) << 6 // owner
+	modeUint += parsePerm(runeStr[4:7]) << 3 // group
+	modeUint += parsePerm(runeStr[7:10])     // other
 
 	e.FileMode |= os.FileMode(modeUint)
 
@@ -287,10 +644,128 @@ func (e *Entry) setSize(str string) (err error) {
 	return
 }
 
+// sizeSuffixes are the multipliers of the human-readable sizes of ls -h.
+var sizeSuffixes = map[byte]float64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+	'P': 1 << 50,
+}
+
+// setLsSize sets the size from the size column of ls, which some servers
+// group with thousands separators, like "1,234,567", or print in the
+// human-readable form of ls -h, like "1.2K", "3.4M" or "1G".
+func (e *Entry) setLsSize(str string) error {
+	if err := e.setSize(str); err == nil {
+		return nil
+	}
+
+	if isGroupedSize(str) {
+		if err := e.setSize(strings.ReplaceAll(str, ",", "")); err != nil {
+			return errUnsupportedListLine
+		}
+		return nil
+	}
+
+	if len(str) < 2 {
+		return errUnsupportedListLine
+	}
+	multiplier, ok := sizeSuffixes[str[len(str)-1]]
+	if !ok || !isDecimalSize(str[:len(str)-1]) {
+		return errUnsupportedListLine
+	}
+	value, err := strconv.ParseFloat(str[:len(str)-1], 64)
+	if err != nil || value*multiplier >= math.MaxUint64 {
+		return errUnsupportedListLine
+	}
+	e.Size = uint64(math.Round(value * multiplier))
+	return nil
+}
+
+// isGroupedSize reports whether str is a number grouped by thousands with
+// commas, like "1,234,567".
+func isGroupedSize(str string) bool {
+	groups := strings.Split(str, ",")
+	if len(groups) < 2 || len(groups[0]) > 3 || !isDigits(groups[0]) {
+		return false
+	}
+	for _, group := range groups[1:] {
+		if len(group) != 3 || !isDigits(group) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDecimalSize reports whether str is a number with an optional fraction,
+// like "1" or "1.2".
+func isDecimalSize(str string) bool {
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		return isDigits(str[:i]) && isDigits(str[i+1:])
+	}
+	return isDigits(str)
+}
+
+// isDigits reports whether str is a non-empty string of decimal digits.
+func isDigits(str string) bool {
+	if str == "" {
+		return false
+	}
+	for i := 0; i < len(str); i++ {
+		if str[i] < '0' || str[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// setISOTime sets the time from the date and time fields of the
+// "2006-01-02 15:04" form. As the year is given, it is never guessed.
+func (e *Entry) setISOTime(fields []string, loc *time.Location) (err error) {
+	e.Time, err = time.ParseInLocation("2006-01-02 15:04", fields[0]+" "+fields[1], loc)
+	if err != nil {
+		return errUnsupportedListDate
+	}
+	return nil
+}
+
+// maxYearsAhead is how far in the future a year of an ls date can be. Four
+// digits beyond are read as a time.
+const maxYearsAhead = 5
+
+// compactLsTime returns the time of an ls date written as HHMM without colon,
+// as some NAS do, in the HH:MM form. The field is left to be read as a year
+// when it can be one, between 1970 and a few years after now, whatever its
+// alignment: ls servers do not pad the years consistently.
+func compactLsTime(field string, now time.Time) (string, bool) {
+	if len(field) != 4 {
+		return "", false
+	}
+	for i := 0; i < len(field); i++ {
+		if field[i] < '0' || field[i] > '9' {
+			return "", false
+		}
+	}
+
+	n, _ := strconv.Atoi(field)
+	if n >= 1970 && n <= now.Year()+maxYearsAhead {
+		return "", false
+	}
+	if n/100 >= 24 || n%100 >= 60 {
+		return "", false
+	}
+	return field[:2] + ":" + field[2:], true
+}
+
 func (e *Entry) setTime(fields []string, now time.Time, loc *time.Location) (err error) {
+	if hhmm, ok := compactLsTime(fields[2], now); ok {
+		fields = []string{fields[0], fields[1], hhmm}
+	}
+
 	if strings.Contains(fields[2], ":") { // contains time
 		thisYear, _, _ := now.Date()
-		timeStr := fmt.Sprintf("%s %s %d %s", fields[1], fields[0], thisYear, fields[2])
+		timeStr := fields[1] + " " + fields[0] + " " + strconv.Itoa(thisYear) + " " + fields[2]
 		e.Time, err = time.ParseInLocation("_2 Jan 2006 15:04", timeStr, loc)
 
 		/*
@@ -307,13 +782,18 @@ func (e *Entry) setTime(fields []string, now time.Time, loc *time.Location) (err
 		*/
 		if !e.Time.Before(now.AddDate(0, 6, 0)) {
 			e.Time = e.Time.AddDate(-1, 0, 0)
+		} else if e.Time.Before(now.AddDate(0, -6, 0)) && !e.Time.AddDate(1, 0, 0).After(now.Add(maxClockSkew)) {
+			// Around the new year, a server whose clock is slightly ahead
+			// of ours lists recent files of the next year. They cannot be
+			// from this year as they would be more than six months old.
+			e.Time = e.Time.AddDate(1, 0, 0)
 		}
 
 	} else { // only the date
 		if len(fields[2]) != 4 {
 			return errUnsupportedListDate
 		}
-		timeStr := fmt.Sprintf("%s %s %s 00:00", fields[1], fields[0], fields[2])
+		timeStr := fields[1] + " " + fields[0] + " " + fields[2] + " 00:00"
 		e.Time, err = time.ParseInLocation("_2 Jan 2006 15:04", timeStr, loc)
 	}
 	return
@@ -1,6 +1,7 @@
 package ftp
 
 import (
+	"bufio"
 	"os"
 	"strings"
 	"testing"
@@ -31,6 +32,13 @@ type symlinkLine struct {
 	target string
 }
 
+type permLine struct {
+	line   string
+	perm   Perm
+	size   uint64
+	unique string
+}
+
 type unsupportedLine struct {
 	line string
 	err  error
@@ -38,55 +46,119 @@ type unsupportedLine struct {
 
 var listTests = []line{
 	// UNIX ls -l style
-	{"drwxr-xr-x    3 110      1002            3 Dec 02  2009 pub", "pub", os.ModeDir | os.FileMode(755), 0, newTime(2009, time.December, 2)},
-	{"drwxr-xr-x    3 110      1002            3 Dec 02  2009 p u b", "p u b", os.ModeDir | os.FileMode(755), 0, newTime(2009, time.December, 2)},
-	{"-rw-r--r--   1 marketwired marketwired    12016 Mar 16  2016 2016031611G087802-001.newsml", "2016031611G087802-001.newsml", os.FileMode(644), 12016, newTime(2016, time.March, 16)},
-
-	{"-rwxr-xr-x    3 110      1002            1234567 Dec 02  2009 fileName", "fileName", os.FileMode(755), 1234567, newTime(2009, time.December, 2)},
-	{"lrwxrwxrwx   1 root     other          7 Jan 25 00:17 bin -> usr/bin", "bin", os.ModeSymlink | os.FileMode(777), 0, newTime(thisYear, time.January, 25, 0, 17)},
+	{"drwxr-xr-x    3 110      1002            3 Dec 02  2009 pub", "pub", os.ModeDir | os.FileMode(0755), 0, newTime(2009, time.December, 2)},
+	{"drwxr-xr-x    3 110      1002            3 Dec 02  2009 p u b", "p u b", os.ModeDir | os.FileMode(0755), 0, newTime(2009, time.December, 2)},
+	{"-rw-r--r--   1 marketwired marketwired    12016 Mar 16  2016 2016031611G087802-001.newsml", "2016031611G087802-001.newsml", os.FileMode(0644), 12016, newTime(2016, time.March, 16)},
+
+	{"-rwxr-xr-x    3 110      1002            1234567 Dec 02  2009 fileName", "fileName", os.FileMode(0755), 1234567, newTime(2009, time.December, 2)},
+	{"lrwxrwxrwx   1 root     other          7 Jan 25 00:17 bin -> usr/bin", "bin", os.ModeSymlink | os.FileMode(0777), 0, newTime(thisYear, time.January, 25, 0, 17)},
+
+	// ls style without the link count, as sent by some embedded servers
+	{"-rw-r--r-- owner group 1234 Jan 2 03:04 file", "file", os.FileMode(0644), 1234, newTime(thisYear, time.January, 2, 3, 4)},
+	{"-rw-r--r-- 1000 1000 1234 Jan 2 03:04 file name", "file name", os.FileMode(0644), 1234, newTime(thisYear, time.January, 2, 3, 4)},
+	{"-rw-r--r-- 1 owner group 1234 Jan 2 03:04 file", "file", os.FileMode(0644), 1234, newTime(thisYear, time.January, 2, 3, 4)},
+	{"drwxr-xr-x owner group 0 Dec 02  2009 pub", "pub", os.ModeDir | os.FileMode(0755), 0, newTime(2009, time.December, 2)},
+
+	// ls style with a time without colon, four digits which can be a year
+	// are a year whatever their alignment
+	{"-rw-r--r-- 1 ftp ftp 123 Jan 01 2009 file", "file", os.FileMode(0644), 123, newTime(2009, time.January, 1)},
+	{"-rw-r--r-- 1 ftp ftp 123 Jan 01  2009 file", "file", os.FileMode(0644), 123, newTime(2009, time.January, 1)},
+	{"-rw-r--r-- 1 owner group 1234 Mar 10 2015 file", "file", os.FileMode(0644), 1234, newTime(2015, time.March, 10)},
+	{"-rw-r--r-- 1 owner group 1234 Mar 10  2015 file", "file", os.FileMode(0644), 1234, newTime(2015, time.March, 10)},
+	{"-rw-r--r-- 1 owner group 1234 Feb 10 2300 file", "file", os.FileMode(0644), 1234, newTime(thisYear, time.February, 10, 23)},
+	{"-rw-r--r-- 1 owner group 1234 Dec 02  1999 file", "file", os.FileMode(0644), 1234, newTime(1999, time.December, 2)},
+
+	// ls style with the month and the day only, as sent by some archival servers
+	{"-rw-r--r-- 1 a b 123 Jan 02 file", "file", os.FileMode(0644), 123, newTime(thisYear, time.January, 2)},
+	{"-rw-r--r-- 1 a b 123 Nov 20 old  file", "old  file", os.FileMode(0644), 123, newTime(previousYear, time.November, 20)},
+	{"-rw-rw-rw- FTPUSER FTPGRP 12345 2021-01-15 09:30 DATA.FILE", "DATA.FILE", os.FileMode(0666), 12345, newTime(2021, time.January, 15, 9, 30)},
+
+	// ls style with ISO dates, as sent by Connect:Enterprise or NonStop gateways
+	{"-rw-rw-rw-   1 FTPUSER  FTPGRP     12345 2021-01-15 09:30 DATA.FILE", "DATA.FILE", os.FileMode(0666), 12345, newTime(2021, time.January, 15, 9, 30)},
+	{"-rw-rw-rw-   1 FTPUSER  FTPGRP     12345 2017-12-01 09:30 DATA.FILE", "DATA.FILE", os.FileMode(0666), 12345, newTime(2017, time.December, 1, 9, 30)},
+	{"drwxr-xr-x   2 FTPUSER  FTPGRP         0 2016-11-30 23:59 ARCHIVE DIR", "ARCHIVE DIR", os.ModeDir | os.FileMode(0755), 0, newTime(2016, time.November, 30, 23, 59)},
+
+	// ls style with grouped or human-readable sizes
+	{"-rw-r--r--   1 admin    admin    1,234,567 Mar 16  2016 backup.tar", "backup.tar", os.FileMode(0644), 1234567, newTime(2016, time.March, 16)},
+	{"-rw-r--r--   1 admin    admin         1.2K Mar 16  2016 notes.txt", "notes.txt", os.FileMode(0644), 1229, newTime(2016, time.March, 16)},
+	{"-rw-r--r--   1 admin    admin         3.4M Mar 16  2016 photo.jpg", "photo.jpg", os.FileMode(0644), 3565158, newTime(2016, time.March, 16)},
+	{"-rw-r--r--   1 admin    admin           1G Mar 16  2016 disk.img", "disk.img", os.FileMode(0644), 1 << 30, newTime(2016, time.March, 16)},
 
 	// Another ls style
-	{"drwxr-xr-x               folder        0 Aug 15 05:49 !!!-Tipp des Haus!", "!!!-Tipp des Haus!", os.ModeDir | os.FileMode(755), 0, newTime(thisYear, time.August, 15, 5, 49)},
-	{"drwxrwxrwx               folder        0 Aug 11 20:32 P0RN", "P0RN", os.ModeDir | os.FileMode(777), 0, newTime(thisYear, time.August, 11, 20, 32)},
-	{"-rw-r--r--        0   18446744073709551615 18446744073709551615 Nov 16  2006 VIDEO_TS.VOB", "VIDEO_TS.VOB", os.FileMode(644), 18446744073709551615, newTime(2006, time.November, 16)},
+	{"drwxr-xr-x               folder        0 Aug 15 05:49 !!!-Tipp des Haus!", "!!!-Tipp des Haus!", os.ModeDir | os.FileMode(0755), 0, newTime(thisYear, time.August, 15, 5, 49)},
+	{"drwxrwxrwx               folder        0 Aug 11 20:32 P0RN", "P0RN", os.ModeDir | os.FileMode(0777), 0, newTime(thisYear, time.August, 11, 20, 32)},
+	{"-rw-r--r--        0   18446744073709551615 18446744073709551615 Nov 16  2006 VIDEO_TS.VOB", "VIDEO_TS.VOB", os.FileMode(0644), 18446744073709551615, newTime(2006, time.November, 16)},
 
 	// Microsoft's FTP servers for Windows
 	{"----------   1 owner    group         1803128 Jul 10 10:18 ls-lR.Z", "ls-lR.Z", os.FileMode(0), 1803128, newTime(thisYear, time.July, 10, 10, 18)},
 	{"d---------   1 owner    group               0 Nov  9 19:45 Softlib", "Softlib", os.ModeDir, 0, newTime(previousYear, time.November, 9, 19, 45)},
 
 	// WFTPD for MSDOS
-	{"-rwxrwxrwx   1 noone    nogroup      322 Aug 19  1996 message.ftp", "message.ftp", os.FileMode(777), 322, newTime(1996, time.August, 19)},
+	{"-rwxrwxrwx   1 noone    nogroup      322 Aug 19  1996 message.ftp", "message.ftp", os.FileMode(0777), 322, newTime(1996, time.August, 19)},
 
 	// RFC3659 format: https://tools.ietf.org/html/rfc3659#section-7
-	{"modify=20150813224845;perm=fle;type=cdir;unique=119FBB87U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; .", ".", os.ModeDir, 0, newTime(2015, time.August, 13, 22, 48, 45)},
-	{"modify=20150813224845;perm=fle;type=pdir;unique=119FBB87U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; ..", "..", os.ModeDir, 0, newTime(2015, time.August, 13, 22, 48, 45)},
-	{"modify=20150806235817;perm=fle;type=dir;unique=1B20F360U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; movies", "movies", os.ModeDir, 0, newTime(2015, time.August, 6, 23, 58, 17)},
-	{"modify=20150814172949;perm=flcdmpe;type=dir;unique=85A0C168U4;UNIX.group=0;UNIX.mode=0777;UNIX.owner=0; _upload", "_upload", os.ModeDir, 0, newTime(2015, time.August, 14, 17, 29, 49)},
-	{"modify=20150813175250;perm=adfr;size=951;type=file;unique=119FBB87UE;UNIX.group=0;UNIX.mode=0644;UNIX.owner=0; welcome.msg", "welcome.msg", os.FileMode(0), 951, newTime(2015, time.August, 13, 17, 52, 50)},
+	{"modify=20150813224845;perm=fle;type=cdir;unique=119FBB87U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; .", ".", os.ModeDir | 0755, 0, newTime(2015, time.August, 13, 22, 48, 45)},
+	{"modify=20150813224845;perm=fle;type=pdir;unique=119FBB87U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; ..", "..", os.ModeDir | 0755, 0, newTime(2015, time.August, 13, 22, 48, 45)},
+	{"modify=20150806235817;perm=fle;type=dir;unique=1B20F360U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; movies", "movies", os.ModeDir | 0755, 0, newTime(2015, time.August, 6, 23, 58, 17)},
+	{"modify=20150814172949;perm=flcdmpe;type=dir;unique=85A0C168U4;UNIX.group=0;UNIX.mode=0777;UNIX.owner=0; _upload", "_upload", os.ModeDir | 0777, 0, newTime(2015, time.August, 14, 17, 29, 49)},
+	{"modify=20150813175250;perm=adfr;size=951;type=file;unique=119FBB87UE;UNIX.group=0;UNIX.mode=0644;UNIX.owner=0; welcome.msg", "welcome.msg", os.FileMode(0644), 951, newTime(2015, time.August, 13, 17, 52, 50)},
 	// Format and types have first letter UpperCase
-	{"Modify=20150813175250;Perm=adfr;Size=951;Type=file;Unique=119FBB87UE;UNIX.group=0;UNIX.mode=0644;UNIX.owner=0; welcome.msg", "welcome.msg", os.FileMode(0), 951, newTime(2015, time.August, 13, 17, 52, 50)},
-
+	{"Modify=20150813175250;Perm=adfr;Size=951;Type=file;Unique=119FBB87UE;UNIX.group=0;UNIX.mode=0644;UNIX.owner=0; welcome.msg", "welcome.msg", os.FileMode(0644), 951, newTime(2015, time.August, 13, 17, 52, 50)},
+
+	// Special files
+	{"modify=20150813175250;perm=rw;type=OS.unix=chr;UNIX.mode=0620; tty0", "tty0", os.ModeDevice | os.ModeCharDevice | 0620, 0, newTime(2015, time.August, 13, 17, 52, 50)},
+	{"modify=20150813175250;perm=rw;type=OS.unix=blk;UNIX.mode=0660; sda", "sda", os.ModeDevice | 0660, 0, newTime(2015, time.August, 13, 17, 52, 50)},
+	{"modify=20150813175250;perm=rw;type=OS.UNIX=FIFO;UNIX.mode=0644; pipe", "pipe", os.ModeNamedPipe | 0644, 0, newTime(2015, time.August, 13, 17, 52, 50)},
+	{"modify=20150813175250;perm=rw;type=os.unix=sock;UNIX.mode=0777; socket", "socket", os.ModeSocket | 0777, 0, newTime(2015, time.August, 13, 17, 52, 50)},
+	{"modify=20150813175250;perm=r;size=10;type=OS.unix=door; door", "door", os.FileMode(0), 10, newTime(2015, time.August, 13, 17, 52, 50)},
 	// DOS DIR command output
 	{"08-07-15  07:50PM                  718 Post_PRR_20150901_1166_265118_13049.dat", "Post_PRR_20150901_1166_265118_13049.dat", os.FileMode(0), 718, newTime(2015, time.August, 7, 19, 50)},
 	{"08-10-15  02:04PM       <DIR>          Billing", "Billing", os.ModeDir, 0, newTime(2015, time.August, 10, 14, 4)},
 	{"08-07-2015  07:50PM                  718 Post_PRR_20150901_1166_265118_13049.dat", "Post_PRR_20150901_1166_265118_13049.dat", os.FileMode(0), 718, newTime(2015, time.August, 7, 19, 50)},
 	{"08-10-2015  02:04PM       <DIR>          Billing", "Billing", os.ModeDir, 0, newTime(2015, time.August, 10, 14, 4)},
+	{"08-07-15  07:50:12PM                  718 report.dat", "report.dat", os.FileMode(0), 718, newTime(2015, time.August, 7, 19, 50, 12)},
+	{"08-07-15  07:50 PM                  718 report.dat", "report.dat", os.FileMode(0), 718, newTime(2015, time.August, 7, 19, 50)},
+	{"08-07-2015  07:50:12 AM                  718 report.dat", "report.dat", os.FileMode(0), 718, newTime(2015, time.August, 7, 7, 50, 12)},
+	{"08-10-2015 02:04:05 PM       <DIR>          Billing", "Billing", os.ModeDir, 0, newTime(2015, time.August, 10, 14, 4, 5)},
 
 	// dir and file names that contain multiple spaces
-	{"drwxr-xr-x    3 110      1002            3 Dec 02  2009 spaces   dir   name", "spaces   dir   name", os.ModeDir | os.FileMode(755), 0, newTime(2009, time.December, 2)},
-	{"-rwxr-xr-x    3 110      1002            1234567 Dec 02  2009 file   name", "file   name", os.FileMode(755), 1234567, newTime(2009, time.December, 2)},
-	{"-rwxr-xr-x    3 110      1002            1234567 Dec 02  2009  foo bar ", " foo bar ", os.FileMode(755), 1234567, newTime(2009, time.December, 2)},
+	{"drwxr-xr-x    3 110      1002            3 Dec 02  2009 spaces   dir   name", "spaces   dir   name", os.ModeDir | os.FileMode(0755), 0, newTime(2009, time.December, 2)},
+	{"-rwxr-xr-x    3 110      1002            1234567 Dec 02  2009 file   name", "file   name", os.FileMode(0755), 1234567, newTime(2009, time.December, 2)},
+	{"-rwxr-xr-x    3 110      1002            1234567 Dec 02  2009  foo bar ", " foo bar ", os.FileMode(0755), 1234567, newTime(2009, time.December, 2)},
 
 	// Odd link count from hostedftp.com
-	{"-r--------   0 user group     65222236 Feb 24 00:39 RegularFile", "RegularFile", os.FileMode(400), 65222236, newTime(thisYear, time.February, 24, 0, 39)},
+	{"-r--------   0 user group     65222236 Feb 24 00:39 RegularFile", "RegularFile", os.FileMode(0400), 65222236, newTime(thisYear, time.February, 24, 0, 39)},
+
+	// HP NonStop (Tandem) Guardian
+	{`FILE.DAT    101 20,480   15-JAN-2021 09:30:00 "RWEP","RWEP"`, "FILE.DAT", os.ModeDir, 20480, newTime(2021, time.January, 15, 9, 30)},
+	{`REPORT      180 1,234,567 02-Mar-2017 23:05:59 255,255 "NUNU"`, "REPORT", os.FileMode(0), 1234567, newTime(2017, time.March, 2, 23, 5, 59)},
+
+	// Unisys MCP
+	{"*SYSTEM/FILE    SEQDATA    100  2021/01/15 09:30", "*SYSTEM/FILE", os.FileMode(0), 100, newTime(2021, time.January, 15, 9, 30)},
+	{"PAYROLL/REPORTS    DIRECTORY    0  2019/11/03 17:42", "PAYROLL/REPORTS", os.ModeDir, 0, newTime(2019, time.November, 3, 17, 42)},
 
 	// Line with ACL persmissions
-	{"-rwxrw-r--+  1 521      101         2080 May 21 10:53 data.csv", "data.csv", os.FileMode(764), 2080, newTime(thisYear, time.May, 21, 10, 53)},
+	{"-rwxrw-r--+  1 521      101         2080 May 21 10:53 data.csv", "data.csv", os.FileMode(0764), 2080, newTime(thisYear, time.May, 21, 10, 53)},
+}
+
+var listTestsPerm = []permLine{
+	{"modify=20150813224845;perm=fle;type=cdir;unique=119FBB87U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; .", PermRename | PermList | PermEnter, 0, "119FBB87U4"},
+	{"modify=20150814172949;perm=flcdmpe;type=dir;unique=85A0C168U4;UNIX.group=0;UNIX.mode=0777;UNIX.owner=0; _upload", PermRename | PermList | PermCreate | PermDelete | PermMakeDir | PermPurge | PermEnter, 0, "85A0C168U4"},
+	{"modify=20150813175250;perm=adfr;size=951;type=file;unique=119FBB87UE;UNIX.group=0;UNIX.mode=0644;UNIX.owner=0; welcome.msg", PermAppend | PermDelete | PermRename | PermRetrieve, 951, "119FBB87UE"},
+	{"Modify=20150813175250;Perm=rw;Size=951;Type=file; welcome.msg", PermRetrieve | PermWrite, 951, ""},
+	{"modify=20150806235817;perm=el;sizd=4096;type=dir; movies", PermEnter | PermList, 4096, ""},
+	{"type=file;size=42; no-perm", 0, 42, ""},
+	{"-rw-r--r--   1 ftp      wheel          42 Jan 29 10:29 ls-style", 0, 42, ""},
 }
 
 var listTestsSymlink = []symlinkLine{
 	{"lrwxrwxrwx   1 root     other          7 Jan 25 00:17 bin -> usr/bin", "bin", "usr/bin"},
 	{"lrwxrwxrwx    1 0        1001           27 Jul 07  2017 R-3.4.0.pkg -> el-capitan/base/R-3.4.0.pkg", "R-3.4.0.pkg", "el-capitan/base/R-3.4.0.pkg"},
+
+	// arrows in the names
+	{"lrwxrwxrwx   1 root     other          7 Jan 25 00:17 a->b -> real/target", "a->b", "real/target"},
+	{"lrwxrwxrwx   1 root     other          7 Jan 25 00:17 link -> real->target", "link", "real->target"},
+	{"lrwxrwxrwx   1 root     other          7 Jan 25 00:17 a -> b -> real/target", "a -> b", "real/target"},
 }
 
 // Not supported, we expect a specific error message
@@ -96,6 +168,14 @@ var listTestsFail = []unsupportedLine{
 	{"drwxr-xr-x    3 110      1002            3 Dec 02  209 pub", errUnsupportedListDate},
 	{"modify=20150806235817;invalid;UNIX.owner=0; movies", errUnsupportedListLine},
 	{"Zrwxrwxrwx   1 root     other          7 Jan 25 00:17 bin -> usr/bin", errUnknownListEntryType},
+	{"-rw-r--r--   1 admin    admin         1.2X Mar 16  2016 notes.txt", errUnsupportedListLine},
+	{"-rw-r--r--   1 admin    admin         NaNK Mar 16  2016 notes.txt", errUnsupportedListLine},
+	{"-rw-r--r--   1 admin    admin         InfM Mar 16  2016 notes.txt", errUnsupportedListLine},
+	{"-rw-r--r--   1 admin    admin         1e9G Mar 16  2016 notes.txt", errUnsupportedListLine},
+	{"-rw-r--r--   1 admin    admin          .5K Mar 16  2016 notes.txt", errUnsupportedListLine},
+	{"-rw-r--r--   1 admin    admin       -1.2K Mar 16  2016 notes.txt", errUnsupportedListLine},
+	{"-rw-r--r--   1 admin    admin       1,23,4 Mar 16  2016 notes.txt", errUnsupportedListLine},
+	{"File         Code           EOF  Last Modification    Owner  RWEP", errUnsupportedListLine},
 	{"total 1", errUnsupportedListLine},
 	{"000000000x ", errUnsupportedListLine}, // see https://github.com/jlaffaye/ftp/issues/97
 	{"", errUnsupportedListLine},
@@ -127,12 +207,36 @@ func TestParseSymlinks(t *testing.T) {
 			if assert.NoError(err) {
 				assert.Equal(lt.name, entry.Name)
 				assert.Equal(lt.target, entry.Target)
-				assert.Equal(os.ModeSymlink, entry.FileMode)
+				assert.Equal(os.ModeSymlink|os.FileMode(0777), entry.FileMode)
 			}
 		})
 	}
 }
 
+func TestParsePerm(t *testing.T) {
+	for _, lt := range listTestsPerm {
+		t.Run(lt.line, func(t *testing.T) {
+			entry, err := parseListLine(lt.line, now, time.UTC)
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, lt.perm, entry.Perm)
+				assert.Equal(t, lt.size, entry.Size)
+				assert.Equal(t, lt.unique, entry.Unique)
+			}
+		})
+	}
+
+	perm := parsePerm("flcdmpe")
+	assert.True(t, perm.IsWritable())
+	assert.True(t, perm.CanList())
+	assert.True(t, perm.CanDelete())
+
+	perm = parsePerm("r")
+	assert.False(t, perm.IsWritable())
+	assert.False(t, perm.CanList())
+	assert.False(t, perm.CanDelete())
+}
+
 func TestParseUnsupportedListLine(t *testing.T) {
 	for _, lt := range listTestsFail {
 		t.Run(lt.line, func(t *testing.T) {
@@ -143,6 +247,68 @@ func TestParseUnsupportedListLine(t *testing.T) {
 	}
 }
 
+func TestParseListLines(t *testing.T) {
+	listing := "total 3\r\n" +
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 pub\r\n" +
+		"not a listing line\r\n" +
+		"\r\n" +
+		"modify=20150806235817;perm=el;type=dir; movies\r\n" +
+		"08-10-2015 02:04:05 PM       <DIR>          Billing\r\n"
+
+	var entries []Entry
+	err := ParseListLines(strings.NewReader(listing), now, time.UTC, func(e *Entry) {
+		entries = append(entries, *e)
+	})
+
+	if assert.NoError(t, err) && assert.Len(t, entries, 3) {
+		assert.Equal(t, "pub", entries[0].Name)
+		assert.Equal(t, newTime(2009, time.December, 2), entries[0].Time)
+		assert.Equal(t, "movies", entries[1].Name)
+		assert.Equal(t, PermEnter|PermList, entries[1].Perm)
+		assert.Equal(t, "Billing", entries[2].Name)
+		assert.True(t, entries[2].FileMode.IsDir())
+	}
+}
+
+func TestSystemParserOrder(t *testing.T) {
+	assert.Nil(t, systemParserOrder("UNIX Type: L8"))
+	assert.Nil(t, systemParserOrder(""))
+
+	order := systemParserOrder("Windows_NT version 5.0")
+	if assert.Len(t, order, len(listLineParsersByKind)) {
+		assert.Equal(t, ParserDOS, order[0])
+	}
+}
+
+func TestParseListLineOrder(t *testing.T) {
+	// This line is both a valid RFC3659 line and a valid ls line
+	const ambiguous = "-a=b;c=de;   1 owner group 42 Jan 25 00:17 file"
+
+	entry, err := newListLineParser([]ParserKind{ParserRFC3659, ParserLs})(ambiguous, now, time.UTC)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "  1 owner group 42 Jan 25 00:17 file", entry.Name)
+		assert.Equal(t, uint64(0), entry.Size)
+	}
+
+	entry, err = newListLineParser([]ParserKind{ParserLs, ParserRFC3659})(ambiguous, now, time.UTC)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "file", entry.Name)
+		assert.Equal(t, uint64(42), entry.Size)
+	}
+
+	// Parsers missing from the order are not used
+	_, err = newListLineParser([]ParserKind{ParserRFC3659})("08-10-15  02:04PM       <DIR>          Billing", now, time.UTC)
+	assert.Equal(t, errUnsupportedListLine, err)
+}
+
+func TestIgnoredListLine(t *testing.T) {
+	assert.True(t, isIgnoredListLine(""))
+	assert.True(t, isIgnoredListLine("  "))
+	assert.True(t, isIgnoredListLine("total 42"))
+	assert.False(t, isIgnoredListLine("total size"))
+	assert.False(t, isIgnoredListLine("-rw-r--r--   1 ftp      wheel           0 Jan 29 10:29 total 1"))
+}
+
 func TestSettime(t *testing.T) {
 	tests := []struct {
 		line     string
@@ -159,6 +325,16 @@ func TestSettime(t *testing.T) {
 
 		// far in the future
 		{"Jan 23  2019", newTime(2019, time.January, 23)},
+
+		// time without colon, as sent by some NAS
+		{"Feb 10 2300", newTime(thisYear, time.February, 10, 23)},
+		{"Feb 10 0905", newTime(thisYear, time.February, 10, 9, 5)},
+		{"Feb 10 1230", newTime(thisYear, time.February, 10, 12, 30)},
+
+		// four digits which can be a year are a year
+		{"Dec 02  2009", newTime(2009, time.December, 2)},
+		{"Jan 01 2009", newTime(2009, time.January, 1)},
+		{"Jan 23  2022", newTime(2022, time.January, 23)},
 	}
 
 	for _, test := range tests {
@@ -173,6 +349,36 @@ func TestSettime(t *testing.T) {
 	}
 }
 
+func TestSettimeClockSkew(t *testing.T) {
+	tests := []struct {
+		line     string
+		now      time.Time
+		expected time.Time
+	}{
+		// new year, the server clock is ahead of ours
+		{"Jan 01 00:10", newTime(2017, time.December, 31, 23, 30), newTime(2018, time.January, 1, 0, 10)},
+		{"Dec 31 23:10", newTime(2017, time.December, 31, 23, 30), newTime(2017, time.December, 31, 23, 10)},
+		{"Jan 01 00:50", newTime(2018, time.January, 1, 0, 10), newTime(2018, time.January, 1, 0, 50)},
+
+		// new year, the server clock is behind ours
+		{"Dec 31 23:50", newTime(2018, time.January, 1, 0, 10), newTime(2017, time.December, 31, 23, 50)},
+
+		// new year, more than the tolerated clock skew
+		{"Jan 01 01:00", newTime(2017, time.December, 31, 23, 30), newTime(2017, time.January, 1, 1, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			entry := &Entry{}
+			if err := entry.setTime(strings.Fields(test.line), test.now, time.UTC); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, test.expected, entry.Time)
+		})
+	}
+}
+
 // newTime builds a UTC time from the given year, month, day, hour and minute
 func newTime(year int, month time.Month, day int, hourMinSec ...int) time.Time {
 	var hour, min, sec int
@@ -194,3 +400,42 @@ func newTime(year int, month time.Month, day int, hourMinSec ...int) time.Time {
 
 	return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
 }
+
+// benchListing returns a listing made of the valid lines of listTests.
+func benchListing() string {
+	var b strings.Builder
+	for _, lt := range listTests {
+		b.WriteString(lt.line)
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+// BenchmarkParseListLine parses a listing line by line, like List.
+func BenchmarkParseListLine(b *testing.B) {
+	listing := benchListing()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		scanner := bufio.NewScanner(strings.NewReader(listing))
+		for scanner.Scan() {
+			if _, err := parseListLine(scanner.Text(), now, time.UTC); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkParseListLines(b *testing.B) {
+	listing := benchListing()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := ParseListLines(strings.NewReader(listing), now, time.UTC, func(*Entry) {})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
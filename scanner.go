@@ -1,15 +1,18 @@
 package ftp
 
 // A scanner for fields delimited by one or more whitespace characters
+//
+// The fields are substrings of the scanned string, so scanning does not
+// allocate.
 type scanner struct {
-	bytes    []byte
+	str      string
 	position int
 }
 
 // newScanner creates a new scanner
 func newScanner(str string) *scanner {
 	return &scanner{
-		bytes: []byte(str),
+		str: str,
 	}
 }
 
@@ -28,11 +31,11 @@ func (s *scanner) NextFields(count int) []string {
 
 // Next returns the next field
 func (s *scanner) Next() string {
-	sLen := len(s.bytes)
+	sLen := len(s.str)
 
 	// skip trailing whitespace
 	for s.position < sLen {
-		if s.bytes[s.position] != ' ' {
+		if s.str[s.position] != ' ' {
 			break
 		}
 		s.position++
@@ -42,17 +45,17 @@ func (s *scanner) Next() string {
 
 	// skip non-whitespace
 	for s.position < sLen {
-		if s.bytes[s.position] == ' ' {
+		if s.str[s.position] == ' ' {
 			s.position++
-			return string(s.bytes[start : s.position-1])
+			return s.str[start : s.position-1]
 		}
 		s.position++
 	}
 
-	return string(s.bytes[start:s.position])
+	return s.str[start:s.position]
 }
 
 // Remaining returns the remaining string
 func (s *scanner) Remaining() string {
-	return string(s.bytes[s.position:len(s.bytes)])
+	return s.str[s.position:len(s.str)]
 }
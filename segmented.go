@@ -0,0 +1,165 @@
+package ftp
+
+import (
+	"io"
+	"sync"
+)
+
+// RetrSegmented downloads a file over several connections in parallel, which
+// can make a better use of the bandwidth than a single data connection.
+//
+// The size of the file is queried with a SIZE FTP command, then the file is
+// split in the given number of segments. Each segment is fetched with REST and
+// RETR on its own connection, opened like with Clone. The segments are written
+// at their offset with WriteAt, concurrently.
+//
+// If a segment fails, the others are stopped and the first error is returned.
+// All the connections are closed before returning. The ServerConn must have
+// been opened with Dial, and DialWithStoredCredentials must be used if it is
+// logged in.
+func (c *ServerConn) RetrSegmented(path string, w io.WriterAt, segments int) error {
+	if err := c.checkClone(); err != nil {
+		return err
+	}
+
+	size, err := c.FileSize(path)
+	if err != nil {
+		return err
+	}
+	dir, err := c.CurrentDir()
+	if err != nil {
+		return err
+	}
+
+	if size == 0 {
+		return nil
+	}
+	if int64(segments) > size {
+		segments = int(size)
+	}
+	if segments < 1 {
+		segments = 1
+	}
+	segSize := (size + int64(segments) - 1) / int64(segments)
+
+	g := &segmentGroup{}
+	var wg sync.WaitGroup
+	for offset := int64(0); offset < size; offset += segSize {
+		length := segSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		wg.Add(1)
+		go func(offset, length int64) {
+			defer wg.Done()
+			if err := c.retrSegment(g, dir, path, w, offset, length, offset+length == size); err != nil {
+				g.fail(err)
+			}
+		}(offset, length)
+	}
+	wg.Wait()
+
+	return g.err
+}
+
+// retrSegment fetches length bytes of the file from offset on a new connection.
+// last is true if the segment ends with the file.
+func (c *ServerConn) retrSegment(g *segmentGroup, dir, path string, w io.WriterAt, offset, length int64, last bool) (err error) {
+	sc, err := c.clone(dir)
+	if err != nil {
+		return err
+	}
+	if !g.add(sc) {
+		_ = sc.Close()
+		return nil
+	}
+	defer func() {
+		if errQuit := sc.Quit(); errQuit != nil && err == nil {
+			err = errQuit
+		}
+	}()
+
+	r, err := sc.RetrFrom(path, uint64(offset))
+	if err != nil {
+		return err
+	}
+	if !g.add(r.conn) {
+		_ = r.conn.Close()
+		return nil
+	}
+
+	if err := copySegment(w, r, offset, length); err != nil {
+		_ = r.Abort()
+		return err
+	}
+
+	// The rest of the file is not needed
+	if !last {
+		return r.Abort()
+	}
+	return r.Close()
+}
+
+// copySegment writes length bytes of r at offset in w.
+func copySegment(w io.WriterAt, r io.Reader, offset, length int64) error {
+	buf := make([]byte, 32*1024)
+	for length > 0 {
+		if int64(len(buf)) > length {
+			buf = buf[:length]
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, errWrite := w.WriteAt(buf[:n], offset); errWrite != nil {
+				return errWrite
+			}
+			offset += int64(n)
+			length -= int64(n)
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentGroup tracks the connections of a segmented download, to stop them
+// all on the first error. Closing the data connections is needed to interrupt
+// the segments which are reading.
+type segmentGroup struct {
+	mu    sync.Mutex
+	conns []io.Closer
+	err   error
+}
+
+// add registers a control or data connection, unless the download already
+// failed.
+func (g *segmentGroup) add(c io.Closer) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.err != nil {
+		return false
+	}
+	g.conns = append(g.conns, c)
+	return true
+}
+
+// fail records the first error and closes all the connections, which
+// interrupts the other segments.
+func (g *segmentGroup) fail(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.err != nil {
+		return
+	}
+	g.err = err
+	for _, c := range g.conns {
+		_ = c.Close()
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package ftp
+
+// setSocketBuffers does nothing on this platform.
+func setSocketBuffers(fd uintptr, size int) {}
+
+// isAddrInUse returns false on this platform, so that a data port range is
+// not searched further after the first failure.
+func isAddrInUse(err error) bool {
+	return false
+}
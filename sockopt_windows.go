@@ -0,0 +1,24 @@
+package ftp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Winsock errors, missing from the syscall package.
+const (
+	wsaeaddrinuse    syscall.Errno = 10048
+	wsaeaddrnotavail syscall.Errno = 10049
+)
+
+// setSocketBuffers sets the send and receive buffer sizes of a socket.
+func setSocketBuffers(fd uintptr, size int) {
+	_ = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+	_ = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, size)
+}
+
+// isAddrInUse returns true if the dial failed because the local port is bound,
+// or already connected to the same address.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, wsaeaddrinuse) || errors.Is(err, wsaeaddrnotavail)
+}
@@ -0,0 +1,82 @@
+package ftp
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// maxSymlinkDepth is the number of symbolic links followed by ResolveSymlink
+// before returning ErrSymlinkLoop.
+const maxSymlinkDepth = 16
+
+// ResolveSymlink follows the symbolic link described by entry, listed in the
+// directory cwd, and returns the Entry of its final target. Relative targets
+// are resolved against the directory of the link. Entries which are not
+// symbolic links are returned as is.
+//
+// Each target is looked up in the listing of its parent directory, since the
+// targets of the links are only known from LIST. ErrSymlinkLoop is returned
+// after following 16 links.
+func (c *ServerConn) ResolveSymlink(entry *Entry, cwd string) (*Entry, error) {
+	entry, _, err := c.resolveSymlink(entry, path.Join(cwd, entry.Name))
+	return entry, err
+}
+
+// resolveSymlink follows the symbolic links from the entry at p and returns
+// the final entry along with its path.
+func (c *ServerConn) resolveSymlink(entry *Entry, p string) (*Entry, string, error) {
+	for depth := 0; entry.FileMode&os.ModeSymlink != 0; depth++ {
+		if depth == maxSymlinkDepth {
+			return nil, "", fmt.Errorf("%w: %s", ErrSymlinkLoop, p)
+		}
+		if entry.Target == "" {
+			return nil, "", fmt.Errorf("unknown target of the symbolic link %s", p)
+		}
+
+		if path.IsAbs(entry.Target) {
+			p = path.Clean(entry.Target)
+		} else {
+			p = path.Join(path.Dir(p), entry.Target)
+		}
+
+		var err error
+		if entry, err = c.stat(p); err != nil {
+			return nil, "", err
+		}
+	}
+	return entry, p, nil
+}
+
+// stat returns the entry of p from the listing of its parent directory.
+func (c *ServerConn) stat(p string) (*Entry, error) {
+	if p == "/" {
+		return &Entry{Name: p, FileMode: os.ModeDir}, nil
+	}
+
+	entries, err := c.List(path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(p)
+	for _, e := range entries {
+		if e.Name == name {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrFileNotFound, p)
+}
+
+// RetrFollow is like Retr but if path is a symbolic link, the file it points
+// to is downloaded instead. The link is looked up in the listing of its
+// directory before the download.
+func (c *ServerConn) RetrFollow(p string) (*Response, error) {
+	entry, err := c.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, p, err = c.resolveSymlink(entry, p); err != nil {
+		return nil, err
+	}
+	return c.Retr(p)
+}
@@ -0,0 +1,113 @@
+package ftp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// transferGate blocks the data transfers while paused.
+// The zero value is an open gate.
+type transferGate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // non-nil while paused, closed on resume
+}
+
+func (g *transferGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *transferGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+// wait blocks until the gate is open.
+func (g *transferGate) wait() {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// gatedReader is an io.Reader blocking while its gate is paused, and limited
+// by its rateLimiter.
+type gatedReader struct {
+	io.Reader
+	gate    *transferGate
+	limiter *rateLimiter
+}
+
+func (r *gatedReader) Read(buf []byte) (int, error) {
+	r.gate.wait()
+	return r.limiter.read(r.Reader, buf)
+}
+
+// rateLimiter is a token bucket limiting the bandwidth of the data transfers.
+// A nil rateLimiter does not limit anything.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  int     // maximum bytes per read
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	burst := int(bytesPerSec / 10)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:  float64(bytesPerSec),
+		burst: burst,
+		last:  time.Now(),
+	}
+}
+
+// read reads from r at most the burst of the rateLimiter, then waits until the
+// bytes read are paid for.
+func (l *rateLimiter) read(r io.Reader, buf []byte) (int, error) {
+	if l == nil {
+		return r.Read(buf)
+	}
+
+	if len(buf) > l.burst {
+		buf = buf[:l.burst]
+	}
+	n, err := r.Read(buf)
+	l.take(n)
+	return n, err
+}
+
+// take consumes n tokens, sleeping while the bucket is in debt.
+func (l *rateLimiter) take(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / l.rate * float64(time.Second)))
+	}
+}
@@ -12,12 +12,48 @@ type Walker struct {
 	cur        *item
 	stack      []*item
 	descend    bool
+	maxBreadth int
+	order      WalkMode
+}
+
+// WalkMode is the order in which a Walker visits the directories relative to
+// their contents.
+type WalkMode int
+
+// The different walk orders
+const (
+	PreOrder  WalkMode = iota // directories before their contents
+	PostOrder                 // directories after their contents
+)
+
+// WalkOptions contains the options of a walk started with WalkWithOptions
+type WalkOptions struct {
+	// MaxBreadth bounds the number of entries of a directory held in memory.
+	// When positive, the entries of a directory are processed in batches of
+	// MaxBreadth entries, and the directory is listed again for each batch.
+	// This trades extra round-trips for bounded memory with directories having
+	// an enormous number of entries. It assumes that the server lists a
+	// directory in the same order each time.
+	MaxBreadth int
+
+	// Order is the order in which the directories are visited relative to
+	// their contents. SkipDir has no effect with PostOrder, as the contents
+	// of a directory are visited before it.
+	Order WalkMode
 }
 
 type item struct {
 	path  string
 	entry *Entry
 	err   error
+
+	// a pending item lists the next batch of entries of the directory at path,
+	// starting at offset, instead of being visited
+	pending bool
+	offset  int
+
+	// an expanded directory had its entries pushed on the stack
+	expanded bool
 }
 
 // Next advances the Walker to the next file or directory,
@@ -34,49 +70,122 @@ func (w *Walker) Next() bool {
 		}
 	}
 
-	if w.descend && w.cur.entry.FileMode.IsDir() {
-		entries, err := w.serverConn.List(w.cur.path)
-
+	if w.descend && w.cur.entry.FileMode.IsDir() && !w.cur.expanded {
 		// an error occurred, drop out and stop walking
-		if err != nil {
+		if err := w.push(w.cur, 0); err != nil {
 			w.cur.err = err
 			return false
 		}
+	}
+
+	for {
+		if len(w.stack) == 0 {
+			return false
+		}
 
-		for _, entry := range entries {
-			if entry.Name == "." || entry.Name == ".." {
-				continue
+		// update cur
+		i := len(w.stack) - 1
+		w.cur = w.stack[i]
+		w.stack = w.stack[:i]
+
+		if w.cur.pending {
+			dir := &item{path: w.cur.path, entry: w.cur.entry}
+			if err := w.push(dir, w.cur.offset); err != nil {
+				dir.err = err
+				w.cur = dir
+				return false
 			}
+			continue
+		}
 
-			item := &item{
-				path:  path.Join(w.cur.path, entry.Name),
-				entry: entry,
+		if w.order == PostOrder && w.cur.entry.FileMode.IsDir() && !w.cur.expanded {
+			// visit the directory again once its entries are visited
+			w.cur.expanded = true
+			w.stack = append(w.stack, w.cur)
+			if err := w.push(w.cur, 0); err != nil {
+				w.stack = w.stack[:len(w.stack)-1]
+				w.cur.err = err
+				return false
 			}
-
-			w.stack = append(w.stack, item)
+			continue
 		}
-	}
 
-	if len(w.stack) == 0 {
-		return false
+		break
 	}
 
-	// update cur
-	i := len(w.stack) - 1
-	w.cur = w.stack[i]
-	w.stack = w.stack[:i]
-
 	// reset SkipDir
 	w.descend = true
 
 	return true
 }
 
+// push lists the directory and pushes its entries on the stack. With a
+// maximum breadth, only the batch of entries starting at offset is pushed,
+// on top of a pending item listing the next batch, if any.
+func (w *Walker) push(dir *item, offset int) error {
+	var entries []*Entry
+	var err error
+
+	if w.maxBreadth > 0 {
+		var more bool
+		entries, more, err = w.serverConn.listRange(dir.path, offset, w.maxBreadth)
+		if err == nil && more {
+			w.stack = append(w.stack, &item{
+				path:    dir.path,
+				entry:   dir.entry,
+				pending: true,
+				offset:  offset + w.maxBreadth,
+			})
+		}
+	} else {
+		entries, err = w.serverConn.List(dir.path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+
+		item := &item{
+			path:  path.Join(dir.path, entry.Name),
+			entry: entry,
+		}
+
+		w.stack = append(w.stack, item)
+	}
+
+	return nil
+}
+
 // SkipDir tells the Next function to skip the currently processed directory
 func (w *Walker) SkipDir() {
 	w.descend = false
 }
 
+// skipSiblings drops the entries of the directory of the current file or
+// directory which are not visited yet.
+func (w *Walker) skipSiblings() {
+	dir := path.Dir(w.cur.path)
+	for len(w.stack) > 0 {
+		it := w.stack[len(w.stack)-1]
+		if it.pending && path.Clean(it.path) != dir || !it.pending && path.Dir(it.path) != dir {
+			return
+		}
+		w.stack = w.stack[:len(w.stack)-1]
+	}
+}
+
+// skipFailedDir clears the error of the directory which could not be listed,
+// so that the next call to Next goes on with the rest of the tree.
+func (w *Walker) skipFailedDir() {
+	w.cur.err = nil
+	w.descend = false
+}
+
 // Err returns the error, if any, for the most recent attempt by Next to
 // visit a file or a directory. If a directory has an error, the walker
 // will not descend in that directory
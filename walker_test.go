@@ -1,7 +1,9 @@
 package ftp
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"testing"
 	"time"
@@ -210,3 +212,178 @@ func TestCurInit(t *testing.T) {
 	assert.Equal(t, 0, len(w.stack))
 	assert.Equal(t, "/root/lo", w.Path())
 }
+
+func TestWalkMaxBreadth(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			var listing string
+			switch cmdParts[1] {
+			case "/root/":
+				listing = "type=dir; a\r\n"
+				for _, name := range "bcdefghij" {
+					listing += fmt.Sprintf("type=file;size=1; %c\r\n", name)
+				}
+			case "/root/a":
+				listing = "type=file;size=1; x\r\ntype=file;size=1; y\r\n"
+			}
+			mock.sendDataConn([]byte(listing))
+			return true
+		},
+	})
+
+	w := c.WalkWithOptions("/root", WalkOptions{MaxBreadth: 3})
+
+	var paths []string
+	maxStack := 0
+	for w.Next() {
+		assert.NoError(w.Err())
+		paths = append(paths, w.Path())
+		if len(w.stack) > maxStack {
+			maxStack = len(w.stack)
+		}
+	}
+	assert.NoError(w.Err())
+
+	assert.Equal([]string{
+		"/root/c", "/root/b", "/root/a", "/root/a/y", "/root/a/x",
+		"/root/f", "/root/e", "/root/d",
+		"/root/i", "/root/h", "/root/g",
+		"/root/j",
+	}, paths)
+	assert.LessOrEqual(maxStack, 2*(3+1), "at most one batch per level must be held")
+
+	closeConn(t, mock, c, []string{
+		"EPSV", "MLSD", "EPSV", "MLSD", "EPSV", "MLSD", "EPSV", "MLSD", "EPSV", "MLSD",
+	})
+}
+
+func TestWalkOrder(t *testing.T) {
+	handlers := map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			var listing string
+			switch cmdParts[1] {
+			case "/root/":
+				listing = "type=dir; a\r\ntype=file;size=1; b\r\ntype=dir; c\r\n"
+			case "/root/a":
+				listing = "type=file;size=1; x\r\ntype=file;size=1; y\r\n"
+			case "/root/c":
+				listing = "type=file;size=1; z\r\n"
+			}
+			mock.sendDataConn([]byte(listing))
+			return true
+		},
+	}
+
+	for _, tC := range []struct {
+		order WalkMode
+		paths []string
+	}{
+		{PreOrder, []string{"/root/c", "/root/c/z", "/root/b", "/root/a", "/root/a/y", "/root/a/x"}},
+		{PostOrder, []string{"/root/c/z", "/root/c", "/root/b", "/root/a/y", "/root/a/x", "/root/a"}},
+	} {
+		mock, c := openConnHandlers(t, "127.0.0.1", "no-time", handlers)
+
+		w := c.WalkOrder("/root", tC.order)
+
+		var paths []string
+		for w.Next() {
+			assert.NoError(t, w.Err())
+			paths = append(paths, w.Path())
+		}
+		assert.NoError(t, w.Err())
+		assert.Equal(t, tC.paths, paths)
+
+		closeConn(t, mock, c, []string{"EPSV", "MLSD", "EPSV", "MLSD", "EPSV", "MLSD"})
+	}
+}
+
+func TestWalkCallback(t *testing.T) {
+	listings := map[string]string{
+		"root/":  "Type=dir; a\r\nType=dir; b\r\nType=file;Size=1; f1\r\n",
+		"root/a": "Type=file;Size=1; x\r\nType=file;Size=1; y\r\n",
+		"root/b": "Type=file;Size=1; z\r\n",
+	}
+	handlers := map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			mock.sendDataConn([]byte(listings[cmdParts[1]]))
+			return true
+		},
+	}
+
+	walk := func(fn func(path string, entry *Entry) error) ([]string, error) {
+		mock, c := openConnHandlers(t, "127.0.0.1", "no-time", handlers)
+		defer func() {
+			assert.NoError(t, c.Quit())
+			mock.Wait()
+		}()
+
+		var visited []string
+		err := c.WalkCallback("root", func(path string, entry *Entry, err error) error {
+			require.NoError(t, err)
+			visited = append(visited, path)
+			return fn(path, entry)
+		})
+		return visited, err
+	}
+
+	visited, err := walk(func(path string, entry *Entry) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"root/f1", "root/b", "root/b/z", "root/a", "root/a/y", "root/a/x"}, visited)
+
+	// SkipDir on a directory skips its contents, on a file the rest of its
+	// directory
+	visited, err = walk(func(path string, entry *Entry) error {
+		if path == "root/b" || path == "root/a/y" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"root/f1", "root/b", "root/a", "root/a/y"}, visited)
+
+	errStop := errors.New("stop")
+	visited, err = walk(func(path string, entry *Entry) error {
+		if path == "root/b" {
+			return errStop
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, []string{"root/f1", "root/b"}, visited)
+
+	// A directory which cannot be listed is skipped
+	mock, c := openConnHandlers(t, "127.0.0.1", "no-time", map[string]mockHandler{
+		"MLSD": func(mock *ftpMock, cmdParts []string) bool {
+			if cmdParts[1] == "root/b" {
+				mock.dataConn.Wait()
+				mock.printfLine("550 Permission denied")
+				mock.closeDataConn()
+				return true
+			}
+			mock.sendDataConn([]byte(listings[cmdParts[1]]))
+			return true
+		},
+		"MLST": func(mock *ftpMock, cmdParts []string) bool {
+			mock.printfLine("550 Permission denied")
+			return true
+		},
+	})
+
+	var failed []string
+	visited = nil
+	err = c.WalkCallback("root", func(path string, entry *Entry, err error) error {
+		if err != nil {
+			failed = append(failed, path)
+			return nil
+		}
+		visited = append(visited, path)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"root/f1", "root/b", "root/a", "root/a/y", "root/a/x"}, visited)
+	assert.Equal(t, []string{"root/b"}, failed)
+
+	closeConn(t, mock, c, []string{"EPSV", "MLSD", "EPSV", "MLSD", "MLST", "EPSV", "MLSD"})
+}